@@ -0,0 +1,171 @@
+package mu
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// App is a micro app served by mu
+type App interface {
+	// Name of the app e.g Chat
+	Name() string
+	// Description shown on the home screen
+	Description() string
+	// Icon url, defaults to the mu logo
+	Icon() string
+	// Routes served by the app
+	Routes() []Route
+	// Start is called before serving to load state and run background work
+	Start() error
+	// Stop is called on shutdown
+	Stop() error
+}
+
+// Route is a handler served at a path
+type Route struct {
+	// Path e.g /chat
+	Path string
+	// Handler for the path
+	Handler http.HandlerFunc
+	// Auth requires a logged in user
+	Auth bool
+	// Nav lists the route as the app's entry on the home screen
+	Nav bool
+}
+
+// Entry in the nav for an app
+type Entry struct {
+	Name        string
+	Description string
+	Icon        string
+	URL         string
+}
+
+// Auth wraps routes which require a logged in user. It's set by the user app,
+// until then everything is redirected to login.
+var Auth = func(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/login", 302)
+	}
+}
+
+// Identify wraps every route to add the logged in user, if any, to the
+// request context. It's set by the user app.
+var Identify = func(h http.HandlerFunc) http.HandlerFunc {
+	return h
+}
+
+// registered apps in order
+var apps []App
+
+// Register an app to be served
+func Register(a App) {
+	apps = append(apps, a)
+}
+
+// Apps returns the registered apps which are enabled
+func Apps() []App {
+	var enabled []App
+	for _, a := range apps {
+		if Enabled(a.Name()) {
+			enabled = append(enabled, a)
+		}
+	}
+	return enabled
+}
+
+// Nav returns an entry for every app with a nav route
+func Nav() []Entry {
+	var entries []Entry
+
+	for _, a := range Apps() {
+		for _, r := range a.Routes() {
+			if !r.Nav {
+				continue
+			}
+			icon := a.Icon()
+			if len(icon) == 0 {
+				icon = "/assets/mu.png"
+			}
+			entries = append(entries, Entry{
+				Name:        a.Name(),
+				Description: a.Description(),
+				Icon:        icon,
+				URL:         r.Path,
+			})
+		}
+	}
+
+	return entries
+}
+
+// start the apps and mount their routes
+func start(mux *http.ServeMux) error {
+	apps := Apps()
+	for i, a := range apps {
+		if err := a.Start(); err != nil {
+			// stop the ones already running in reverse like Stop
+			for j := i; j > 0; j-- {
+				if serr := apps[j-1].Stop(); serr != nil {
+					fmt.Println("Error stopping", apps[j-1].Name(), serr)
+				}
+			}
+			return fmt.Errorf("%s: %w", a.Name(), err)
+		}
+
+		for _, r := range a.Routes() {
+			h := r.Handler
+			if r.Auth {
+				h = Auth(h)
+			}
+			mux.HandleFunc(r.Path, Identify(h))
+		}
+	}
+
+	return nil
+}
+
+// Stop the apps in reverse order
+func Stop() error {
+	var err error
+	apps := Apps()
+	for i := len(apps); i > 0; i-- {
+		if serr := apps[i-1].Stop(); serr != nil {
+			err = serr
+		}
+	}
+	return err
+}
+
+// manifest serves the PWA manifest with a shortcut per app
+func manifest(w http.ResponseWriter, r *http.Request) {
+	b, err := html.ReadFile("html/manifest.webmanifest")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	var m map[string]interface{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	var shortcuts []map[string]interface{}
+	for _, e := range Nav() {
+		shortcuts = append(shortcuts, map[string]interface{}{
+			"name":        e.Name,
+			"description": e.Description,
+			"url":         e.URL,
+			"icons": []map[string]string{
+				{"src": e.Icon, "type": "image/png", "sizes": "300x300"},
+			},
+		})
+	}
+	m["shortcuts"] = shortcuts
+
+	b, _ = json.MarshalIndent(m, "", "  ")
+	w.Header().Set("Content-Type", "application/manifest+json")
+	w.Write(b)
+}
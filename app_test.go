@@ -0,0 +1,68 @@
+package mu
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// testApp records when it's started and stopped
+type testApp struct {
+	name  string
+	err   error
+	calls *[]string
+}
+
+func (a *testApp) Name() string        { return a.name }
+func (a *testApp) Description() string { return "" }
+func (a *testApp) Icon() string        { return "" }
+func (a *testApp) Routes() []Route {
+	return []Route{{Path: "/" + a.name, Handler: func(http.ResponseWriter, *http.Request) {}}}
+}
+
+func (a *testApp) Start() error {
+	*a.calls = append(*a.calls, "start "+a.name)
+	return a.err
+}
+
+func (a *testApp) Stop() error {
+	*a.calls = append(*a.calls, "stop "+a.name)
+	return nil
+}
+
+func TestStart(t *testing.T) {
+	defer func(a []App) { apps = a }(apps)
+
+	fail := errors.New("failed")
+
+	tests := []struct {
+		name  string
+		fails string
+		want  []string
+	}{
+		{"all", "", []string{"start one", "start two", "start three"}},
+		{"first", "one", []string{"start one"}},
+		{"last", "three", []string{"start one", "start two", "start three", "stop two", "stop one"}},
+	}
+
+	for _, tt := range tests {
+		var calls []string
+		apps = nil
+		for _, name := range []string{"one", "two", "three"} {
+			a := &testApp{name: name, calls: &calls}
+			if name == tt.fails {
+				a.err = fail
+			}
+			Register(a)
+		}
+
+		err := start(http.NewServeMux())
+		if (len(tt.fails) > 0) != errors.Is(err, fail) {
+			t.Errorf("%s got %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(calls, tt.want) {
+			t.Errorf("%s got %v, want %v", tt.name, calls, tt.want)
+		}
+	}
+}
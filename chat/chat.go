@@ -3,16 +3,20 @@ package chat
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
 	"io/ioutil"
 	"net/http"
 	"os"
 	//"net/url"
+	"regexp"
 	"sort"
 	//"strings"
 	"sync"
 
 	"mu.dev"
+	"mu.dev/user"
 
 	"github.com/google/uuid"
 
@@ -27,6 +31,19 @@ type Channel struct {
 	Name     string
 	Topic    string
 	Messages []string
+	// Authors of the messages by index, the asker for both the prompt and
+	// the answer, empty for messages from before they were recorded
+	Authors []string
+}
+
+// add a message, the caller holds the mutex
+func (c *Channel) add(author, msg string) {
+	// pad out older channels
+	for len(c.Authors) < len(c.Messages) {
+		c.Authors = append(c.Authors, "")
+	}
+	c.Messages = append(c.Messages, msg)
+	c.Authors = append(c.Authors, author)
 }
 
 var channels = map[string]*Channel{
@@ -41,7 +58,7 @@ type Command func(*Channel, string) string
 
 var commands = map[string]Command{
 	"openai": func(channel *Channel, prompt string) string {
-		key := os.Getenv("OPENAI_API_KEY")
+		key := mu.APIKey("openai", "OPENAI_API_KEY")
 		if len(key) == 0 {
 			return ""
 		}
@@ -95,6 +112,13 @@ var commands = map[string]Command{
 
 var updates = make(chan bool, 1)
 
+// closed to stop the save loop
+var done = make(chan bool)
+var wg sync.WaitGroup
+
+// channels changed since the last save
+var dirty = map[string]bool{}
+
 var mutex sync.RWMutex
 
 func mdToHTML(md []byte) []byte {
@@ -103,66 +127,25 @@ func mdToHTML(md []byte) []byte {
 	p := parser.NewWithExtensions(extensions)
 	doc := p.Parse(md)
 
-	// create HTML renderer with extensions
-	htmlFlags := html.CommonFlags | html.HrefTargetBlank
+	// create HTML renderer with extensions, skipping raw html and unsafe links
+	htmlFlags := html.CommonFlags | html.HrefTargetBlank | html.SkipHTML | html.Safelink
 	opts := html.RendererOptions{Flags: htmlFlags}
 	renderer := html.NewRenderer(opts)
 
 	return markdown.Render(doc, renderer)
 }
 
-func IndexHandler(w http.ResponseWriter, r *http.Request) {
-	id := uuid.New().String()
-	channel := "general"
-
-	// get cookie
-	c, err := r.Cookie("uuid")
-	if err == nil && len(c.Value) > 0 {
-		id = c.Value
-	} else {
-		http.SetCookie(w, &http.Cookie{
-			Name:  "uuid",
-			Value: id,
-		})
-	}
-
-	c, err = r.Cookie("channel")
-	if err == nil && len(c.Value) > 0 {
-		channel = c.Value
-	} else {
-		http.SetCookie(w, &http.Cookie{
-			Name:  "channel",
-			Value: channel,
-		})
-	}
-
-	mutex.Lock()
-	ch, ok := channels[channel]
-	if !ok {
-		ch = new(Channel)
-		channels[channel] = ch
-	}
-	mutex.Unlock()
-
-	// get the channel
-	text := ""
-	for i, m := range ch.Messages {
-		class := "message"
-
-		mod := i % 2
-		if mod != 0 {
-			class = "message mu"
-		}
-
-		text += fmt.Sprintf(`<div class="%s">%s</div>`, class, m)
-	}
-
-	t := mu.Template("Chat", "Ask an AI", `
+var tmpl = mu.Template("chat", `
+{{define "title"}}Chat{{end}}
+{{define "description"}}Ask an AI{{end}}
+{{define "nav"}}
       <a href="#general" class="head">General</a>
       <a href="#finance" class="head">Finance</a>
       <a href="#health" class="head">Health</a>
       <a href="#islam" class="head">Islam</a>
-      <a href="#misc" class="head">Misc</a>`, `
+      <a href="#misc" class="head">Misc</a>
+{{end}}
+{{define "content"}}
     <style>
       #input {
 	width: 100%;
@@ -200,13 +183,13 @@ func IndexHandler(w http.ResponseWriter, r *http.Request) {
        }
     </style>
 
-    <div id=text>`+text+`</div>
+    <div id=text>{{range .Messages}}<div class="{{.Class}}">{{.Text}}</div>{{end}}</div>
 
     <div id="input">
       <form id="form" action="/prompt">
-        <input id="uuid" name="uuid" type="hidden" value="`+id+`">
+        <input id="uuid" name="uuid" type="hidden" value="{{.ID}}">
         <input id="prompt" name="prompt" placeholder="ask a question" autocomplete="off">
-	<input id="channel" name="channel" type="hidden" value="`+channel+`">
+	<input id="channel" name="channel" type="hidden" value="{{.Channel}}">
         <button>submit</button>
       </form>
     </div>
@@ -231,6 +214,12 @@ func IndexHandler(w http.ResponseWriter, r *http.Request) {
 	    });
 	};
 
+      function escapeHTML(str) {
+	var div = document.createElement("div");
+	div.innerText = str;
+	return div.innerHTML;
+      }
+
       var form = document.getElementById("form");
       var text = document.getElementById("text");
 
@@ -244,14 +233,17 @@ func IndexHandler(w http.ResponseWriter, r *http.Request) {
         var prompt = form.elements["prompt"].value;
 	var channel = form.elements["channel"].value;
 	form.elements["prompt"].value = '';
-	text.innerHTML += "<div class='message mu'>" + prompt.parseURL() + "</div>";
+	text.innerHTML += "<div class='message mu'>" + escapeHTML(prompt).parseURL() + "</div>";
 	text.scrollTo(0, text.scrollHeight);
 	var data = {"uuid": uuid, "prompt": prompt, "markdown": true, channel: channel};
 
 	fetch("/chat/prompt", {
 		method: "POST",
 		body: JSON.stringify(data),
-		headers: {'Content-Type': 'application/json'},
+		headers: {
+			'Content-Type': 'application/json',
+			'X-CSRF-Token': document.querySelector('meta[name=csrf-token]').content,
+		},
 	})
 	  .then(res => res.json())
 	  .then((rsp) => {
@@ -272,7 +264,7 @@ func IndexHandler(w http.ResponseWriter, r *http.Request) {
       var hash = window.location.hash.replace("#", "");
 
       if (hash.length == 0) {
-        hash = "`+channel+`";
+        hash = {{.Channel}};
       }
 
       var el = document.querySelectorAll('#nav a');
@@ -286,7 +278,7 @@ func IndexHandler(w http.ResponseWriter, r *http.Request) {
         }
       }
 
-      document.cookie = "channel="+"`+channel+`";
+      document.cookie = "channel=" + {{.Channel}};
 
       text.scrollTo(0, text.scrollHeight);
 
@@ -303,40 +295,147 @@ func IndexHandler(w http.ResponseWriter, r *http.Request) {
         
       }
     </script>
-	`)
-	mu.Render(w, t)
+{{end}}
+`)
+
+var channelsTmpl = mu.Template("channels", `
+{{define "title"}}Channels{{end}}
+{{define "description"}}List of channels{{end}}
+{{define "content"}}
+<h1>Channels</h1>
+{{range .Channels}}<a href="/chat#{{.}}">{{.}}</a><br>{{end}}
+{{if .Create}}
+<h2>New channel</h2>
+<form action="/chat/channels" method="post">{{csrfField}}
+  <input name="name" placeholder="Name" required>
+  <input name="topic" placeholder="Topic">
+  <button>Create</button>
+</form>
+{{end}}
+{{end}}
+`)
+
+// Message to display
+type Message struct {
+	Class string
+	Text  template.HTML
+}
+
+func IndexHandler(w http.ResponseWriter, r *http.Request) {
+	id := uuid.New().String()
+	channel := "general"
+
+	// get cookie
+	c, err := r.Cookie("uuid")
+	if err == nil && len(c.Value) > 0 {
+		id = c.Value
+	} else {
+		http.SetCookie(w, &http.Cookie{
+			Name:  "uuid",
+			Value: id,
+		})
+	}
+
+	// only moderators create channels, fall back to general for any other name
+	mutex.RLock()
+	c, err = r.Cookie("channel")
+	if err == nil && channels[c.Value] != nil {
+		channel = c.Value
+	} else {
+		http.SetCookie(w, &http.Cookie{
+			Name:  "channel",
+			Value: channel,
+		})
+	}
+	ch := channels[channel]
+	mutex.RUnlock()
+
+	// get the channel
+	var messages []*Message
+
+	mutex.RLock()
+	for i, m := range ch.Messages {
+		class := "message"
+
+		mod := i % 2
+		if mod != 0 {
+			class = "message mu"
+		}
+
+		// raw html in messages is dropped by the renderer
+		messages = append(messages, &Message{
+			Class: class,
+			Text:  template.HTML(mdToHTML([]byte(m))),
+		})
+	}
+	mutex.RUnlock()
+
+	mu.Render(w, tmpl, map[string]interface{}{
+		"ID":       id,
+		"Channel":  channel,
+		"Messages": messages,
+	})
 }
 
 type Req struct {
 	UUID     string `json:"uuid"`
 	Prompt   string `json:"prompt"`
-	Markdown bool   `json:"markdown",omitempty`
-	Channel  string `json:"channel",omitempty`
+	Markdown bool   `json:"markdown,omitempty"`
+	Channel  string `json:"channel,omitempty"`
 }
 
+// channel names are short lowercase words
+var channelName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+
 func ChannelHandler(w http.ResponseWriter, r *http.Request) {
-	mutex.Lock()
+	// moderators can create channels
+	if r.Method == "POST" {
+		if !user.Has(r, user.RoleModerator) {
+			http.Error(w, "forbidden", 403)
+			return
+		}
 
-	html := "<h1>Channels</h1>"
+		name := r.PostFormValue("name")
+		if !channelName.MatchString(name) {
+			http.Error(w, "channel names are 1 to 32 lowercase letters, digits or -", 400)
+			return
+		}
 
-	var chans []string
+		mutex.Lock()
+		if _, ok := channels[name]; !ok {
+			channels[name] = &Channel{Name: name, Topic: r.PostFormValue("topic")}
+			dirty[name] = true
+		}
+		mutex.Unlock()
 
-	for ch, _ := range channels {
-		chans = append(chans, ch)
+		select {
+		case updates <- true:
+		default:
+		}
+
+		http.Redirect(w, r, "/chat/channels", 302)
+		return
 	}
 
-	sort.Strings(chans)
+	mutex.Lock()
 
-	for _, ch := range chans {
+	var chans []string
+
+	for ch, _ := range channels {
 		if len(ch) == 0 {
 			continue
 		}
-		html += fmt.Sprintf(`<a href="/#%s">%s</a><br>`, ch, ch)
+		chans = append(chans, ch)
 	}
+
 	mutex.Unlock()
 
-	t := mu.Template("Channels", "List of channels", "", html)
-	mu.Render(w, t)
+	sort.Strings(chans)
+
+	mu.Render(w, channelsTmpl, map[string]interface{}{
+		"Channels": chans,
+		"Create":   user.Has(r, user.RoleModerator),
+	})
 }
 
 func PromptHandler(w http.ResponseWriter, r *http.Request) {
@@ -360,10 +459,24 @@ func PromptHandler(w http.ResponseWriter, r *http.Request) {
 		req.Channel = "general"
 	}
 
+	mutex.RLock()
+	_, ok := channels[req.Channel]
+	mutex.RUnlock()
+	if !ok {
+		http.Error(w, "no such channel", 404)
+		return
+	}
+
+	var author string
+	if acc, ok := user.FromContext(r.Context()); ok {
+		author = acc.Username
+	}
+
 	mutex.Lock()
 	c, ok := channels[req.Channel]
 	if ok {
-		c.Messages = append(c.Messages, prompt)
+		c.add(author, prompt)
+		dirty[req.Channel] = true
 	}
 	mutex.Unlock()
 
@@ -384,11 +497,9 @@ func PromptHandler(w http.ResponseWriter, r *http.Request) {
 		//answer := command(c, strings.Join(parts[1:], " "))
 		answer := command(c, prompt)
 		markdown := ""
-		message := answer
 
 		if req.Markdown {
 			markdown = string(mdToHTML([]byte(answer)))
-			message = markdown
 		}
 
 		// get the answer
@@ -400,7 +511,8 @@ func PromptHandler(w http.ResponseWriter, r *http.Request) {
 		mutex.Lock()
 		c, ok := channels[req.Channel]
 		if ok {
-			c.Messages = append(c.Messages, message)
+			c.add(author, answer)
+			dirty[req.Channel] = true
 		}
 		mutex.Unlock()
 
@@ -419,24 +531,160 @@ func PromptHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func load() {
+	// move the old cache file into a bucket
+	if err := mu.Migrate("chat.enc", "chat", true); err != nil && !errors.Is(err, os.ErrNotExist) {
+		fmt.Println("Error migrating chat:", err)
+	}
+
+	keys, _ := mu.List("chat")
+
 	mutex.Lock()
-	mu.Load(&channels, "chat.enc", true)
+	for _, k := range keys {
+		ch := new(Channel)
+		if err := mu.Get("chat", k, ch, true); err != nil {
+			fmt.Println("Error loading channel", k, err)
+			continue
+		}
+		channels[k] = ch
+	}
 	mutex.Unlock()
 }
 
+// flush changed channels to disk
+func flush() {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for name := range dirty {
+		if ch, ok := channels[name]; ok {
+			if err := mu.Put("chat", name, ch, true); err != nil {
+				fmt.Println("Error saving channel", name, err)
+				continue
+			}
+		}
+		delete(dirty, name)
+	}
+}
+
 func save() {
+	defer wg.Done()
+
 	for {
 		select {
 		case <-updates:
-			mutex.RLock()
-			mu.Save(channels, "chat.enc", true)
-			mutex.RUnlock()
+			flush()
+		case <-done:
+			flush()
+			return
 		}
 	}
 }
 
-func Register() {
+// App is the chat app
+type App struct{}
+
+func (a *App) Name() string        { return "Chat" }
+func (a *App) Description() string { return "Ask an AI general knowledge questions" }
+func (a *App) Icon() string        { return "" }
+
+func (a *App) Routes() []mu.Route {
+	return []mu.Route{
+		{Path: "/chat", Handler: IndexHandler, Nav: true},
+		{Path: "/chat/prompt", Handler: PromptHandler, Auth: true},
+		{Path: "/chat/channels", Handler: ChannelHandler, Auth: true},
+	}
+}
+
+// Usage is the size of the user's messages
+func (a *App) Usage(username string) int64 {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	var n int64
+	for _, ch := range channels {
+		for i, author := range ch.Authors {
+			if author == username && i < len(ch.Messages) {
+				n += int64(len(ch.Messages[i]))
+			}
+		}
+	}
+	return n
+}
+
+// Export returns the user's messages and the answers to them by channel
+func (a *App) Export(username string) (interface{}, error) {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	res := map[string][]string{}
+	for name, ch := range channels {
+		for i, author := range ch.Authors {
+			if author == username && i < len(ch.Messages) {
+				res[name] = append(res[name], ch.Messages[i])
+			}
+		}
+	}
+	return res, nil
+}
+
+// Erase removes the user's messages and the answers to them
+func (a *App) Erase(username string) error {
+	var erased []string
+
+	mutex.Lock()
+	for name, ch := range channels {
+		var messages, authors []string
+		for i, msg := range ch.Messages {
+			if i < len(ch.Authors) && ch.Authors[i] == username {
+				continue
+			}
+			messages = append(messages, msg)
+			if i < len(ch.Authors) {
+				authors = append(authors, ch.Authors[i])
+			}
+		}
+		if len(messages) != len(ch.Messages) {
+			ch.Messages = messages
+			ch.Authors = authors
+			dirty[name] = true
+			erased = append(erased, name)
+		}
+	}
+	mutex.Unlock()
+
+	// write it now rather than on the next update
+	flush()
+
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	// the backups still hold the messages
+	for _, name := range erased {
+		if dirty[name] {
+			return fmt.Errorf("saving channel %s", name)
+		}
+		if err := mu.Purge("chat", name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *App) Start() error {
 	load()
 
+	wg.Add(1)
 	go save()
+
+	return nil
+}
+
+func (a *App) Stop() error {
+	close(done)
+	wg.Wait()
+	return nil
+}
+
+func Register() {
+	mu.Register(new(App))
 }
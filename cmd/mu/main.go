@@ -1,7 +1,13 @@
 package main
 
 import (
+	"bufio"
+	"flag"
+	"fmt"
 	"net/http"
+	"os"
+	"sort"
+	"strings"
 
 	"mu.dev"
 	"mu.dev/chat"
@@ -14,45 +20,64 @@ import (
 	"mu.dev/work"
 )
 
-func main() {
-	http.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(`User-agent: *
-Allow: /`))
-	})
+var configFile = flag.String("config", "", "path to mu.yaml, defaults to ./mu.yaml or ~/mu/mu.yaml")
+var dataDir = flag.String("data-dir", "", "directory for the key and data, defaults to ~/mu")
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), `Usage: mu [flags] [command]
 
-	// chat
-	http.HandleFunc("/chat", chat.IndexHandler)
-	http.HandleFunc("/chat/prompt", user.Auth(chat.PromptHandler))
-	http.HandleFunc("/chat/channels", user.Auth(chat.ChannelHandler))
+Commands:
+  serve                      run the server (default)
+  user add <name>            add a user, the password is read from stdin
+  user role <name> <role>    set the role of a user, one of member, moderator or admin
+  feeds list                 list the news feeds
+  config check               validate the config
+  rotate-key                 re-encrypt the data with a new key
 
-	// home
-	http.HandleFunc("/home", user.Auth(home.IndexHandler))
+The user commands and rotate-key write to the data directly so stop the
+server first, it won't see the changes until it's restarted.
+
+Flags:
+`)
+	flag.PrintDefaults()
+}
 
-	// news
-	http.HandleFunc("/news", news.IndexHandler)
-	http.HandleFunc("/news/feeds", user.Auth(news.FeedsHandler))
-	http.HandleFunc("/news/status", user.Auth(news.StatusHandler))
-	// http.HandleFunc("/add", addHandler)
+// cleanup runs in reverse before a command exits so the apps it started are
+// stopped and the store, which a bolt database needs, is closed
+var cleanup []func() error
 
-	// pray
-	http.HandleFunc("/pray", pray.IndexHandler)
+func exit(code int) {
+	for i := len(cleanup); i > 0; i-- {
+		if err := cleanup[i-1](); err != nil {
+			fmt.Println(err)
+		}
+	}
+	os.Exit(code)
+}
 
-	// reminder
-	http.HandleFunc("/reminder", reminder.IndexHandler)
+func fatal(v ...interface{}) {
+	fmt.Println(v...)
+	exit(1)
+}
 
-	// user auth
-	http.HandleFunc("/admin", user.Auth(user.Admin))
-	http.HandleFunc("/login", user.LoginHandler)
-	http.HandleFunc("/logout", user.LogoutHandler)
-	http.HandleFunc("/signup", user.SignupHandler)
+func main() {
+	flag.Usage = usage
+	flag.Parse()
 
-	// watch
-	http.HandleFunc("/watch", watch.WatchHandler)
+	cfg, err := mu.LoadConfig(*configFile)
+	if err != nil {
+		fatal("failed to load config:", err)
+	}
+	if len(*dataDir) > 0 {
+		cfg.DataDir = *dataDir
+	}
 
-	// work
-	http.HandleFunc("/work", work.Handler)
+	if err := mu.Init(cfg); err != nil {
+		fatal("failed to initialise:", err)
+	}
+	cleanup = append(cleanup, mu.Storage.Close)
 
-	// any other stuff
+	// register the apps
 	chat.Register()
 	home.Register()
 	news.Register()
@@ -62,5 +87,95 @@ Allow: /`))
 	watch.Register()
 	work.Register()
 
-	mu.Serve(8080)
+	cmd := strings.Join(flag.Args(), " ")
+
+	switch {
+	case cmd == "" || cmd == "serve":
+		// stops the apps and closes the store itself
+		serve(cfg)
+		return
+	case cmd == "rotate-key":
+		if err := mu.RotateKey(); err != nil {
+			fatal("failed to rotate key:", err)
+		}
+	case strings.HasPrefix(cmd, "user add ") && flag.NArg() == 3:
+		addUser(flag.Arg(2))
+	case strings.HasPrefix(cmd, "user role ") && flag.NArg() == 4:
+		setRole(flag.Arg(2), flag.Arg(3))
+	case cmd == "feeds list":
+		listFeeds()
+	case cmd == "config check":
+		if err := mu.Check(); err != nil {
+			fatal(err)
+		}
+		fmt.Println("config ok")
+	default:
+		usage()
+		exit(2)
+	}
+
+	exit(0)
+}
+
+func serve(cfg mu.Config) {
+	http.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`User-agent: *
+Allow: /`))
+	})
+
+	port := 8080
+	if cfg.Port > 0 {
+		port = cfg.Port
+	}
+
+	if err := mu.Serve(port); err != nil {
+		fatal(err)
+	}
+}
+
+// startUsers loads the existing users, stopping the app on exit
+func startUsers() {
+	app := new(user.App)
+	if err := app.Start(); err != nil {
+		fatal(err)
+	}
+	cleanup = append(cleanup, app.Stop)
+}
+
+// addUser reads the password from stdin so it's not in ps or the shell history
+func addUser(name string) {
+	fmt.Print("Password: ")
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	pass := strings.TrimSpace(line)
+	if len(pass) == 0 {
+		fatal("password required")
+	}
+
+	startUsers()
+	if err := user.Signup(name, pass); err != nil {
+		fatal("failed to add user:", err)
+	}
+	fmt.Println("added user", name)
+}
+
+func setRole(name, role string) {
+	startUsers()
+	if err := user.SetRole(name, user.Role(role)); err != nil {
+		fatal("failed to set role:", err)
+	}
+	fmt.Println("set role of", name, "to", role)
+}
+
+func listFeeds() {
+	feeds := news.Feeds()
+
+	var names []string
+	for name := range feeds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Printf("%s\t%s\n", name, feeds[name])
+	}
 }
@@ -0,0 +1,152 @@
+package mu
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// the config set by Init
+var config Config
+
+// Checker is implemented by apps which validate their config section
+type Checker interface {
+	Check() error
+}
+
+// LoadConfig reads a mu.yaml config file. An empty path looks for mu.yaml in the
+// current directory then ~/mu/mu.yaml, and returns an empty config if neither exists.
+//
+//	port: 8080
+//	store: bolt
+//	admins: [asim]
+//	apps:
+//	  watch: false
+//	keys:
+//	  openai: sk-...
+//	news:
+//	  feeds:
+//	    Tech: https://example.com/rss
+func LoadConfig(path string) (Config, error) {
+	var c Config
+
+	if len(path) == 0 {
+		paths := []string{"mu.yaml"}
+		if home, err := os.UserHomeDir(); err == nil {
+			paths = append(paths, filepath.Join(home, "mu", "mu.yaml"))
+		}
+		for _, p := range paths {
+			if _, err := os.Stat(p); err == nil {
+				path = p
+				break
+			}
+		}
+		if len(path) == 0 {
+			return c, nil
+		}
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return c, err
+	}
+	if err := yaml.Unmarshal(b, &c); err != nil {
+		return c, fmt.Errorf("%s: %v", path, err)
+	}
+
+	fmt.Println("using config", path)
+	return c, nil
+}
+
+// Check the config and every app that implements Checker
+func Check() error {
+	var errs []error
+
+	if config.Port < 0 || config.Port > 65535 {
+		errs = append(errs, fmt.Errorf("invalid port %d", config.Port))
+	}
+
+	if err := checkStore(config.Store); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := checkTLS(config.TLS); err != nil {
+		errs = append(errs, err)
+	}
+
+	names := map[string]bool{}
+	for _, a := range apps {
+		names[strings.ToLower(a.Name())] = true
+	}
+	for name := range config.Apps {
+		if !names[strings.ToLower(name)] {
+			errs = append(errs, fmt.Errorf("unknown app %s", name))
+		}
+	}
+	for name := range config.Sections {
+		if !names[strings.ToLower(name)] {
+			errs = append(errs, fmt.Errorf("unknown section %s", name))
+		}
+	}
+
+	for _, a := range apps {
+		c, ok := a.(Checker)
+		if !ok {
+			continue
+		}
+		if err := c.Check(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", strings.ToLower(a.Name()), err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// checkStore reports an unknown storage backend
+func checkStore(name string) error {
+	switch name {
+	case "", "file", "bolt":
+		return nil
+	}
+	return fmt.Errorf("unknown store %s, expected file or bolt", name)
+}
+
+// Enabled returns false if the app is disabled in the config
+func Enabled(name string) bool {
+	for k, v := range config.Apps {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return true
+}
+
+// APIKey returns the named key from the config, falling back to the env var
+func APIKey(name, env string) string {
+	if v := config.Keys[name]; len(v) > 0 {
+		return v
+	}
+	return os.Getenv(env)
+}
+
+// Admins returns the usernames to make admins from the config and USER_ADMIN
+func Admins() []string {
+	admins := append([]string{}, config.Admins...)
+	if v := os.Getenv("USER_ADMIN"); len(v) > 0 {
+		admins = append(admins, v)
+	}
+	return admins
+}
+
+// Section decodes the app's section of the config into v, leaving it untouched if there's none
+func Section(name string, v interface{}) error {
+	n, ok := config.Sections[name]
+	if !ok {
+		return nil
+	}
+	return n.Decode(v)
+}
@@ -3,13 +3,19 @@ module mu.dev
 go 1.20
 
 require (
+	github.com/fxamacker/cbor/v2 v2.6.0
 	github.com/gomarkdown/markdown v0.0.0-20240419095408-642f0ee99ae2
 	github.com/google/uuid v1.6.0
 	github.com/hablullah/go-prayer v1.1.1
 	github.com/mmcdole/gofeed v1.3.0
 	github.com/sashabaranov/go-openai v1.24.0
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
+	go.etcd.io/bbolt v1.3.7
 	golang.org/x/crypto v0.24.0
+	golang.org/x/net v0.25.0
+	golang.org/x/oauth2 v0.21.0
 	google.golang.org/api v0.183.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -32,14 +38,12 @@ require (
 	github.com/mmcdole/goxpp v1.1.1-0.20240225020742-a0c311522b23 // indirect
 	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
 	github.com/modern-go/reflect2 v1.0.2 // indirect
-	github.com/xeonx/timeago v1.0.0-rc5 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
 	go.opencensus.io v0.24.0 // indirect
 	go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp v0.49.0 // indirect
 	go.opentelemetry.io/otel v1.24.0 // indirect
 	go.opentelemetry.io/otel/metric v1.24.0 // indirect
 	go.opentelemetry.io/otel/trace v1.24.0 // indirect
-	golang.org/x/net v0.25.0 // indirect
-	golang.org/x/oauth2 v0.21.0 // indirect
 	golang.org/x/sys v0.21.0 // indirect
 	golang.org/x/text v0.16.0 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20240528184218-531527333157 // indirect
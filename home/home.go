@@ -1,21 +1,17 @@
 package home
 
 import (
-	"fmt"
 	"net/http"
 
 	"mu.dev"
+	"mu.dev/user"
 )
 
-func IndexHandler(w http.ResponseWriter, r *http.Request) {
-	nav := `<a href="/logout" class="head">Logout</a>`
-
-	c, err := r.Cookie("user")
-	if err == nil && len(c.Value) > 0 {
-		nav = fmt.Sprintf("<a href=# class=head><b>%s</b></a>", c.Value) + nav
-	}
-
-	html := mu.Template("Home", "Home screen", nav, `
+var tmpl = mu.Template("home", `
+{{define "title"}}Home{{end}}
+{{define "description"}}Home screen{{end}}
+{{define "nav"}}{{if .User}}<a href="/account" class=head><b>{{.User}}</b></a>{{end}}<a href="/logout" class="head">Logout</a><a href="/logout/all" class="head">Logout all</a>{{end}}
+{{define "content"}}
 <style>
 #title {
   margin-top: 100px;
@@ -31,40 +27,46 @@ func IndexHandler(w http.ResponseWriter, r *http.Request) {
           <p id="description"></p>
 
 	  <div class="apps">
-	    <a href="/chat">
-	      <button>
-		Chat
-	      </button>
-	    </a>
-	    <a href="/news">
-	      <button>
-		News
-	      </button>
-	    </a>
-	    <a href="/pray">
-	      <button>
-		Pray
-	      </button>
-	    </a>
-	    <a href="/reminder">
-	      <button>
-		Reminder
-	      </button>
-	    </a>
-	    <a href="/watch">
-	      <button>
-		Watch
-	      </button>
-	    </a>
-	    <a href="/work">
-	      <button>
-		Work
+	    {{range .Apps}}
+	    <a href="{{.URL}}">
+	      <button title="{{.Description}}">
+		{{.Name}}
 	      </button>
 	    </a>
+	    {{end}}
 	  </div>
-	`)
+{{end}}
+`)
+
+func IndexHandler(w http.ResponseWriter, r *http.Request) {
+	var username string
+
+	if acc, ok := user.FromContext(r.Context()); ok {
+		username = acc.Username
+	}
+
+	mu.Render(w, tmpl, map[string]interface{}{
+		"User": username,
+		"Apps": mu.Nav(),
+	})
+}
+
+// App is the home screen
+type App struct{}
+
+func (a *App) Name() string        { return "Home" }
+func (a *App) Description() string { return "Home screen" }
+func (a *App) Icon() string        { return "" }
 
-	mu.Render(w, html)
+func (a *App) Routes() []mu.Route {
+	return []mu.Route{
+		{Path: "/home", Handler: IndexHandler, Auth: true},
+	}
 }
 
-func Register() {}
+func (a *App) Start() error { return nil }
+func (a *App) Stop() error  { return nil }
+
+func Register() {
+	mu.Register(new(App))
+}
@@ -0,0 +1,281 @@
+package mu
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// the encrypted envelope version
+const version = 1
+
+// bytes of the key hash used to identify a key
+const keyIDSize = 4
+
+// bytes of the standard GCM nonce
+const nonceSize = 12
+
+// every key we've used keyed by its id
+var keyring = map[string][]byte{}
+
+func keyID(key []byte) []byte {
+	h := sha256.Sum256(key)
+	return h[:keyIDSize]
+}
+
+// validKey checks the key is hex encoded 32 bytes for AES-256
+func validKey(keyString string) error {
+	key, err := hex.DecodeString(keyString)
+	if err != nil || len(key) != 32 {
+		return errors.New("key must be 64 hex characters")
+	}
+	return nil
+}
+
+// loadKey returns the key and the resolved source it came from. The source is one of
+//
+//	env:NAME         the hex key is in environment variable NAME
+//	file:PATH        the hex key is in a file e.g a mounted secret
+//	passphrase:NAME  derive the key with scrypt from the passphrase in NAME, salt stored in Home/salt
+//
+// An empty source uses MU_KEY, MU_KEY_FILE or MU_PASSPHRASE if set,
+// otherwise Home/key which is generated if missing.
+func loadKey(source string) (string, string, error) {
+	if len(source) == 0 {
+		switch {
+		case len(os.Getenv("MU_KEY")) > 0:
+			source = "env:MU_KEY"
+		case len(os.Getenv("MU_KEY_FILE")) > 0:
+			source = "file:" + os.Getenv("MU_KEY_FILE")
+		case len(os.Getenv("MU_PASSPHRASE")) > 0:
+			source = "passphrase:MU_PASSPHRASE"
+		default:
+			source = "file:" + filepath.Join(Home, "key")
+		}
+	}
+
+	kind, val, _ := strings.Cut(source, ":")
+
+	switch kind {
+	case "env":
+		key := strings.TrimSpace(os.Getenv(val))
+		if err := validKey(key); err != nil {
+			return "", "", fmt.Errorf("%s: %v", source, err)
+		}
+		return key, source, nil
+	case "passphrase":
+		pass := os.Getenv(val)
+		if len(pass) == 0 {
+			return "", "", fmt.Errorf("%s: passphrase not set", source)
+		}
+
+		// a new salt only the first time, another would change the key
+		path := filepath.Join(Home, "salt")
+		salt, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return "", "", fmt.Errorf("%s: %v", source, err)
+		}
+		if err == nil && len(salt) == 0 {
+			return "", "", fmt.Errorf("%s: %s is empty", source, path)
+		}
+
+		if len(salt) == 0 {
+			salt = make([]byte, 16)
+			if _, err := rand.Read(salt); err != nil {
+				return "", "", err
+			}
+			if err := writeFile(path, salt, 0600); err != nil {
+				return "", "", err
+			}
+		}
+
+		b, err := scrypt.Key([]byte(pass), salt, 1<<15, 8, 1, 32)
+		if err != nil {
+			return "", "", err
+		}
+		return hex.EncodeToString(b), source, nil
+	case "file":
+	default:
+		return "", "", fmt.Errorf("unknown key source %s", source)
+	}
+
+	b, err := os.ReadFile(val)
+	if err == nil {
+		key := strings.TrimSpace(string(b))
+		if err := validKey(key); err != nil {
+			return "", "", fmt.Errorf("%s: %v", source, err)
+		}
+		return key, source, nil
+	}
+
+	// only generate our own key, not one that's meant to be provided or
+	// one we can't read which would lose everything encrypted with it
+	if !errors.Is(err, os.ErrNotExist) || val != filepath.Join(Home, "key") {
+		return "", "", fmt.Errorf("%s: %v", source, err)
+	}
+
+	// generate a new key
+	bytes := make([]byte, 32) //generate a random 32 byte key for AES-256
+	if _, err := rand.Read(bytes); err != nil {
+		return "", "", err
+	}
+
+	key := hex.EncodeToString(bytes) //encode key in bytes to string and keep as secret, put in a vault
+	fmt.Println("generating new key", val)
+
+	// write the file
+	if err := os.WriteFile(val, []byte(key), 0600); err != nil {
+		return "", "", err
+	}
+
+	return key, source, nil
+}
+
+func addKey(keyString string) {
+	key, err := hex.DecodeString(strings.TrimSpace(keyString))
+	if err != nil || len(key) != 32 {
+		return
+	}
+	keyring[string(keyID(key))] = key
+}
+
+// loadKeys reads the current key and older keys in Home/keys
+func loadKeys() {
+	keyring = map[string][]byte{}
+
+	addKey(Key)
+
+	b, _ := os.ReadFile(filepath.Join(Home, "keys"))
+	for _, k := range strings.Split(string(b), "\n") {
+		addKey(k)
+	}
+}
+
+// saveKeys writes the whole key ring to Home/keys
+func saveKeys() error {
+	var data string
+	for _, k := range keyring {
+		data += hex.EncodeToString(k) + "\n"
+	}
+	return writeFile(filepath.Join(Home, "keys"), []byte(data), 0600)
+}
+
+// RotateKey generates a new key and re-encrypts everything in the cache with it.
+// Older keys are kept in Home/keys so backups and old data can still be read.
+func RotateKey() error {
+	// keys from elsewhere have to be changed where they're set
+	if path := filepath.Join(Home, "key"); KeySource != "file:"+path {
+		return fmt.Errorf("key is set by %s, rotation only supports %s", KeySource, path)
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	key := hex.EncodeToString(b)
+
+	// save the new key in the ring before anything is written with it
+	addKey(key)
+	if err := saveKeys(); err != nil {
+		return err
+	}
+
+	// re-encrypt anything that decrypts, everything else is plain text
+	reencrypt := func(data []byte) ([]byte, bool) {
+		plaintext, err := decrypt(data, Key)
+		if err != nil {
+			return nil, false
+		}
+		enc, err := encrypt(plaintext, key)
+		if err != nil {
+			return nil, false
+		}
+		return enc, true
+	}
+
+	files, err := Storage.Files()
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		data, err := Storage.Read(file)
+		if err != nil {
+			return err
+		}
+		if enc, ok := reencrypt(data); ok {
+			if err := Storage.Write(file, enc); err != nil {
+				return err
+			}
+			fmt.Println("re-encrypted", file)
+		}
+	}
+
+	buckets, err := Storage.Buckets()
+	if err != nil {
+		return err
+	}
+	for _, bucket := range buckets {
+		keys, err := Storage.List(bucket)
+		if err != nil {
+			return err
+		}
+		var count int
+		for _, k := range keys {
+			data, err := Storage.Get(bucket, k)
+			if err != nil {
+				return err
+			}
+			if enc, ok := reencrypt(data); ok {
+				if err := Storage.Put(bucket, k, enc); err != nil {
+					return err
+				}
+				count++
+			}
+		}
+		fmt.Println("re-encrypted", count, "keys in", bucket)
+	}
+
+	// finally switch the current key
+	if err := writeFile(filepath.Join(Home, "key"), []byte(key), 0600); err != nil {
+		return err
+	}
+	Key = key
+
+	return nil
+}
+
+// signingKey is derived from the key so signing and encryption never share a key
+func signingKey() []byte {
+	m := hmac.New(sha256.New, []byte(Key))
+	m.Write([]byte("mu sign"))
+	return m.Sum(nil)
+}
+
+// Sign appends an hmac to the value so it can't be forged e.g in a cookie
+func Sign(value string) string {
+	m := hmac.New(sha256.New, signingKey())
+	m.Write([]byte(value))
+	return value + "." + base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
+
+// Unsign returns the value if the signature is valid
+func Unsign(signed string) (string, bool) {
+	i := strings.LastIndex(signed, ".")
+	if i < 0 {
+		return "", false
+	}
+	value := signed[:i]
+	if !hmac.Equal([]byte(Sign(value)), []byte(signed)) {
+		return "", false
+	}
+	return value, true
+}
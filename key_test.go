@@ -0,0 +1,282 @@
+package mu
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// sealLegacy encrypts in the format used before key ids, nonce then ciphertext
+func sealLegacy(t *testing.T, plaintext []byte, keyString string) []byte {
+	t.Helper()
+
+	key, _ := hex.DecodeString(keyString)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, _ := cipher.NewGCM(block)
+	nonce := make([]byte, gcm.NonceSize())
+	rand.Read(nonce)
+	return []byte(hex.EncodeToString(gcm.Seal(nonce, nonce, plaintext, nil)))
+}
+
+// envelopeKey is the key id an envelope was encrypted with
+func envelopeKey(t *testing.T, data []byte) []byte {
+	t.Helper()
+
+	enc, err := hex.DecodeString(string(data))
+	if err != nil || len(enc) < 1+keyIDSize || enc[0] != version {
+		t.Fatalf("not an envelope: %q", data)
+	}
+	return enc[1 : 1+keyIDSize]
+}
+
+func TestRotateKey(t *testing.T) {
+	for _, store := range []string{"file", "bolt"} {
+		t.Run(store, func(t *testing.T) {
+			testInit(t, store)
+			dir := Home
+			old := Key
+
+			Save("file", "file.enc", true)
+			Save("plain", "plain.json", false)
+			Put("bucket", "key", "value", true)
+			oldData, _ := Storage.Get("bucket", "key")
+
+			if err := RotateKey(); err != nil {
+				t.Fatal(err)
+			}
+			if Key == old {
+				t.Fatal("key not changed")
+			}
+
+			newKey, _ := hex.DecodeString(Key)
+			file, _ := Storage.Read("file.enc")
+			value, _ := Storage.Get("bucket", "key")
+			for name, data := range map[string][]byte{"file": file, "bucket": value} {
+				if !bytes.Equal(envelopeKey(t, data), keyID(newKey)) {
+					t.Errorf("%s not re-encrypted with the new key", name)
+				}
+			}
+			if plain, _ := Storage.Read("plain.json"); string(plain) != `"plain"` {
+				t.Errorf("plain file changed to %q", plain)
+			}
+
+			// reopen to load the new key and the ring from disk
+			Storage.Close()
+			if err := Init(Config{DataDir: dir, Store: store}); err != nil {
+				t.Fatal(err)
+			}
+
+			var s string
+			if err := Load(&s, "file.enc", true); err != nil || s != "file" {
+				t.Errorf("load got %q %v", s, err)
+			}
+			if err := Get("bucket", "key", &s, true); err != nil || s != "value" {
+				t.Errorf("get got %q %v", s, err)
+			}
+			// data from before, e.g a backup, still decrypts with the old key
+			if b, err := DecryptBytes(oldData); err != nil || string(b) != `"value"` {
+				t.Errorf("old data got %q %v", b, err)
+			}
+		})
+	}
+}
+
+func TestRotateKeyProvided(t *testing.T) {
+	testInit(t, "file")
+
+	t.Setenv("MU_TEST_KEY", Key)
+	KeySource = "env:MU_TEST_KEY"
+
+	if err := RotateKey(); err == nil {
+		t.Error("rotated a key set in the environment")
+	}
+	if _, err := os.Stat(filepath.Join(Home, "keys")); err == nil {
+		t.Error("wrote the key ring")
+	}
+}
+
+func TestLegacyFormat(t *testing.T) {
+	testInit(t, "file")
+
+	oldKey := Key
+	oldData := sealLegacy(t, []byte("older"), oldKey)
+
+	if err := RotateKey(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"current key", sealLegacy(t, []byte("current"), Key), "current"},
+		{"older key", oldData, "older"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := DecryptBytes(tt.data)
+			if err != nil || string(b) != tt.want {
+				t.Errorf("got %q %v, want %q", b, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSign(t *testing.T) {
+	testInit(t, "file")
+
+	signed := Sign("id.with.dots")
+	if v, ok := Unsign(signed); !ok || v != "id.with.dots" {
+		t.Fatalf("got %q %v", v, ok)
+	}
+
+	i := strings.LastIndex(signed, ".")
+	sig := signed[i+1:]
+	flip := "A"
+	if sig[0] == 'A' {
+		flip = "B"
+	}
+
+	for name, s := range map[string]string{
+		"value changed":     "id.with.dotz" + signed[i:],
+		"signature changed": signed[:i+1] + flip + sig[1:],
+		"signature cut":     signed[:len(signed)-1],
+		"no signature":      "id.with.dots",
+		"empty signature":   "id.with.dots.",
+		"empty":             "",
+	} {
+		if v, ok := Unsign(s); ok {
+			t.Errorf("%s got %q", name, v)
+		}
+	}
+
+	// a new key doesn't accept the old signatures
+	defer func(k string) { Key = k }(Key)
+	Key = strings.Repeat("ab", 32)
+	if _, ok := Unsign(signed); ok {
+		t.Error("signed with another key")
+	}
+}
+
+func TestLoadKey(t *testing.T) {
+	for _, env := range []string{"MU_KEY", "MU_KEY_FILE", "MU_PASSPHRASE"} {
+		t.Setenv(env, "")
+	}
+	defer func(h string) { Home = h }(Home)
+	Home = t.TempDir()
+
+	key := strings.Repeat("ab", 32)
+	other := strings.Repeat("cd", 32)
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	good := write("good", key+"\n")
+	empty := write("empty", "")
+	short := write("short", "abcd")
+
+	t.Setenv("MU_TEST_KEY", " "+key+"\n")
+	t.Setenv("MU_TEST_SHORT", "abcd")
+	t.Setenv("MU_TEST_PASS", "correct horse battery staple")
+
+	tests := []struct {
+		source string
+		want   string
+		ok     bool
+	}{
+		{"env:MU_TEST_KEY", key, true},
+		{"env:MU_TEST_SHORT", "", false},
+		{"env:MU_TEST_UNSET", "", false},
+		{"file:" + good, key, true},
+		{"file:" + empty, "", false},
+		{"file:" + short, "", false},
+		{"file:" + filepath.Join(dir, "missing"), "", false},
+		// a directory can't be read
+		{"file:" + dir, "", false},
+		{"passphrase:MU_TEST_UNSET", "", false},
+		{"vault:secret", "", false},
+	}
+
+	for _, tt := range tests {
+		got, source, err := loadKey(tt.source)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("%s got %q %v, want %q ok %v", tt.source, got, err, tt.want, tt.ok)
+		}
+		if tt.ok && source != tt.source {
+			t.Errorf("%s resolved to %s", tt.source, source)
+		}
+	}
+
+	// the same passphrase gives the same key with the saved salt
+	first, _, err := loadKey("passphrase:MU_TEST_PASS")
+	if err != nil || validKey(first) != nil {
+		t.Fatalf("got %q %v", first, err)
+	}
+	if again, _, _ := loadKey("passphrase:MU_TEST_PASS"); again != first {
+		t.Error("passphrase key changed")
+	}
+	t.Setenv("MU_TEST_PASS", "another passphrase")
+	if changed, _, _ := loadKey("passphrase:MU_TEST_PASS"); changed == first {
+		t.Error("another passphrase gave the same key")
+	}
+
+	// a salt which can't be read isn't replaced
+	salt := filepath.Join(Home, "salt")
+	for _, bad := range []func(){
+		func() { os.WriteFile(salt, nil, 0600) },
+		func() { os.Remove(salt); os.Mkdir(salt, 0700) },
+	} {
+		bad()
+		if _, _, err := loadKey("passphrase:MU_TEST_PASS"); err == nil {
+			t.Error("loaded with a bad salt")
+		}
+	}
+	os.Remove(salt)
+
+	// generated the first time then read back
+	generated, source, err := loadKey("")
+	if err != nil || validKey(generated) != nil || source != "file:"+filepath.Join(Home, "key") {
+		t.Fatalf("got %q from %s %v", generated, source, err)
+	}
+	if again, _, _ := loadKey(""); again != generated {
+		t.Error("generated key changed")
+	}
+	// a damaged key isn't replaced with a new one
+	os.WriteFile(filepath.Join(Home, "key"), nil, 0600)
+	if _, _, err := loadKey(""); err == nil {
+		t.Error("loaded an empty key")
+	}
+
+	// the environment in order of priority
+	t.Setenv("MU_PASSPHRASE", "correct horse battery staple")
+	if _, source, _ := loadKey(""); source != "passphrase:MU_PASSPHRASE" {
+		t.Errorf("passphrase got %s", source)
+	}
+	t.Setenv("MU_KEY_FILE", write("file", other))
+	if got, source, _ := loadKey(""); got != other || source != "file:"+filepath.Join(dir, "file") {
+		t.Errorf("key file got %s", source)
+	}
+	t.Setenv("MU_KEY", key)
+	if got, source, _ := loadKey(""); got != key || source != "env:MU_KEY" {
+		t.Errorf("key got %s", source)
+	}
+	// an explicit source wins
+	if got, _, _ := loadKey("file:" + filepath.Join(dir, "file")); got != other {
+		t.Error("source ignored")
+	}
+}
@@ -1,29 +1,37 @@
 package mu
 
 import (
+	"bytes"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
 	"embed"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
 	"io"
 	"io/fs"
 	"math"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/google/uuid"
+	"gopkg.in/yaml.v3"
 )
 
 //go:embed html/*
 var html embed.FS
 
-// user home dir
+// the data dir
 var Home string
 
 // the file cache
@@ -32,157 +40,280 @@ var Cache string
 // the secret key
 var Key string
 
-func init() {
-	user, err := os.UserHomeDir()
-	if err != nil {
-		panic(err.Error())
+// where the key was loaded from
+var KeySource string
+
+// the storage backend
+var Storage Store
+
+// Config is used to initialise mu
+type Config struct {
+	// DataDir holds the key and database, defaults to ~/mu
+	DataDir string `yaml:"data_dir"`
+	// CacheDir holds cached files, defaults to DataDir/cache
+	CacheDir string `yaml:"cache_dir"`
+	// KeySource is where to load the key from, see loadKey for the format.
+	// Defaults to the environment or DataDir/key.
+	KeySource string `yaml:"key_source"`
+	// Store is the storage backend, file or bolt. Defaults to MU_STORE then file.
+	Store string `yaml:"store"`
+	// Port to serve on, defaults to 8080
+	Port int `yaml:"port"`
+	// TLS serves https when a cert or acme domains are set
+	TLS TLSConfig `yaml:"tls"`
+	// Admins are usernames given the admin role when the user app loads or they sign up
+	Admins []string `yaml:"admins"`
+	// Apps enabled or disabled by name e.g watch: false, all are enabled by default
+	Apps map[string]bool `yaml:"apps"`
+	// Keys are API keys by name e.g openai, youtube
+	Keys map[string]string `yaml:"keys"`
+	// Sections are app specific settings keyed by app name e.g news, pray
+	Sections map[string]yaml.Node `yaml:",inline"`
+}
+
+// Init sets up the data dir, key and store. It must be called before any app is registered.
+func Init(c Config) error {
+	if len(c.DataDir) == 0 {
+		user, err := os.UserHomeDir()
+		if err != nil {
+			return err
+		}
+		c.DataDir = filepath.Join(user, "mu")
+	}
+
+	if len(c.CacheDir) == 0 {
+		c.CacheDir = filepath.Join(c.DataDir, "cache")
 	}
 
-	home := filepath.Join(user, "mu")
-	if err := os.MkdirAll(home, 0700); err != nil {
-		panic(err.Error())
+	if len(c.Store) == 0 {
+		c.Store = os.Getenv("MU_STORE")
+	}
+	if err := checkStore(c.Store); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(c.DataDir, 0700); err != nil {
+		return err
 	}
 
 	// set home
-	Home = home
+	Home = c.DataDir
 
-	cache := filepath.Join(home, "cache")
-	if err := os.MkdirAll(cache, 0700); err != nil {
-		panic(err.Error())
+	if err := os.MkdirAll(c.CacheDir, 0700); err != nil {
+		return err
 	}
 
 	// set cache
-	Cache = cache
+	Cache = c.CacheDir
 
-	path := filepath.Join(home, "key")
-	b, _ := os.ReadFile(path)
+	// keep the config for the apps
+	config = c
 
-	if len(b) == 0 {
-		// generate a new key
-		bytes := make([]byte, 32) //generate a random 32 byte key for AES-256
-		if _, err := rand.Read(bytes); err != nil {
-			panic(err.Error())
-		}
+	// set the key
+	key, source, err := loadKey(c.KeySource)
+	if err != nil {
+		return err
+	}
+	fmt.Println("using key from", source)
 
-		key := hex.EncodeToString(bytes) //encode key in bytes to string and keep as secret, put in a vault
-		fmt.Println("generating new key", path)
+	Key = key
+	KeySource = source
 
-		// write the file
-		if err := os.WriteFile(path, []byte(key), 0600); err != nil {
-			panic(err.Error())
-		}
+	// load every key we can decrypt with
+	loadKeys()
 
-		Key = key
-	} else {
-		fmt.Println("loading key", path)
-		Key = string(b)
+	// close any previous store
+	if Storage != nil {
+		Storage.Close()
 	}
+
+	// set the store
+	switch c.Store {
+	case "bolt":
+		s, err := NewBoltStore(filepath.Join(Home, "mu.db"))
+		if err != nil {
+			return err
+		}
+		Storage = s
+	default:
+		Storage = NewFileStore(Cache)
+	}
+
+	return nil
 }
 
-func encrypt(stringToEncrypt string, keyString string) (encryptedString string) {
+// ErrCorrupt is returned when encrypted data is malformed or has been tampered with
+var ErrCorrupt = errors.New("corrupt data")
+
+// ErrWrongKey is returned when no known key can decrypt the data
+var ErrWrongKey = errors.New("wrong key")
+
+func encrypt(plaintext []byte, keyString string) ([]byte, error) {
 	//Since the key is in string, we need to convert decode it to bytes
-	key, _ := hex.DecodeString(keyString)
-	plaintext := []byte(stringToEncrypt)
+	key, err := hex.DecodeString(keyString)
+	if err != nil {
+		return nil, err
+	}
 
 	//Create a new Cipher Block from the key
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		panic(err.Error())
+		return nil, err
 	}
 
 	//Create a new GCM - https://en.wikipedia.org/wiki/Galois/Counter_Mode
 	//https://golang.org/pkg/crypto/cipher/#NewGCM
 	aesGCM, err := cipher.NewGCM(block)
 	if err != nil {
-		panic(err.Error())
+		return nil, err
 	}
 
 	//Create a nonce. Nonce should be from GCM
 	nonce := make([]byte, aesGCM.NonceSize())
 	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
-		panic(err.Error())
+		return nil, err
+	}
+
+	//Prefix the envelope version and key id so the key can be found on decrypt
+	envelope := append([]byte{version}, keyID(key)...)
+	envelope = append(envelope, nonce...)
+
+	//Encrypt the data using aesGCM.Seal, appending the ciphertext to the envelope
+	ciphertext := aesGCM.Seal(envelope, nonce, plaintext, nil)
+	return []byte(hex.EncodeToString(ciphertext)), nil
+}
+
+func decrypt(data []byte, keyString string) ([]byte, error) {
+	enc, err := hex.DecodeString(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
 	}
 
-	//Encrypt the data using aesGCM.Seal
-	//Since we don't want to save the nonce somewhere else in this case, we add it as a prefix to the encrypted data. The first nonce argument in Seal is the prefix.
-	ciphertext := aesGCM.Seal(nonce, nonce, plaintext, nil)
-	return fmt.Sprintf("%x", ciphertext)
+	return open(enc, keyString)
 }
 
-func decrypt(encryptedString string, keyString string) (decryptedString string) {
+// open decrypts a versioned envelope, or the legacy nonce+ciphertext format
+func open(enc []byte, keyString string) ([]byte, error) {
+	// shorter than the header of either format so it was cut short, not
+	// encrypted with another key
+	if len(enc) < 1+keyIDSize+nonceSize {
+		return nil, fmt.Errorf("%w: %d bytes is too short", ErrCorrupt, len(enc))
+	}
+
+	// version, key id, nonce, ciphertext
+	if enc[0] == version {
+		if key, ok := keyring[string(enc[1:1+keyIDSize])]; ok {
+			plaintext, err := openGCM(key, enc[1+keyIDSize:])
+			if err == nil {
+				return plaintext, nil
+			}
+			// the key matched so the data itself is bad
+			return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+		}
+	}
+
+	// legacy data has no key id so try the given key then every older one
 	key, _ := hex.DecodeString(keyString)
-	enc, _ := hex.DecodeString(encryptedString)
+	plaintext, err := openGCM(key, enc)
+	if err == nil {
+		return plaintext, nil
+	}
+	for _, k := range keyring {
+		if p, kerr := openGCM(k, enc); kerr == nil {
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %v", ErrWrongKey, err)
+}
 
+func openGCM(key, enc []byte) ([]byte, error) {
 	//Create a new Cipher Block from the key
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		panic(err.Error())
+		return nil, err
 	}
 
 	//Create a new GCM
 	aesGCM, err := cipher.NewGCM(block)
 	if err != nil {
-		panic(err.Error())
+		return nil, err
 	}
 
 	//Get the nonce size
 	nonceSize := aesGCM.NonceSize()
+	if len(enc) < nonceSize {
+		return nil, errors.New("ciphertext too short")
+	}
 
 	//Extract the nonce from the encrypted data
 	nonce, ciphertext := enc[:nonceSize], enc[nonceSize:]
 
 	//Decrypt the data
-	plaintext, err := aesGCM.Open(nil, nonce, ciphertext, nil)
-	if err != nil {
-		panic(err.Error())
-	}
-
-	return fmt.Sprintf("%s", plaintext)
+	return aesGCM.Open(nil, nonce, ciphertext, nil)
 }
 
-func save(val interface{}, file, key string, encrypted bool) error {
-	cache := filepath.Join(Cache, file)
-
+func marshal(val interface{}, key string, encrypted bool) ([]byte, error) {
 	// encode data
 	data, err := json.Marshal(val)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// encrypt it
 	if encrypted {
-		enc := encrypt(string(data), Key)
-		data = []byte(enc)
+		return encrypt(data, key)
 	}
 
-	// write the data
-	return os.WriteFile(cache, data, 0644)
+	return data, nil
 }
 
-func load(v interface{}, file, key string, encrypted bool) error {
-	cache := filepath.Join(Cache, file)
+func unmarshal(data []byte, v interface{}, key string, encrypted bool) error {
+	// a value is never saved empty so it was cut short
+	if len(data) == 0 {
+		return fmt.Errorf("%w: empty", ErrCorrupt)
+	}
 
-	_, err := os.Stat(cache)
-	if err != nil {
-		return err
+	if encrypted {
+		var err error
+		data, err = decrypt(data, key)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%w: %v", ErrCorrupt, err)
 	}
+	return nil
+}
 
-	// file exists
-	data, err := os.ReadFile(cache)
+func save(val interface{}, file, key string, encrypted bool) error {
+	data, err := marshal(val, key, encrypted)
 	if err != nil {
 		return err
 	}
 
-	if len(data) == 0 {
-		return nil
+	// write the data
+	return Storage.Write(file, data)
+}
+
+func load(v interface{}, file, key string, encrypted bool) error {
+	data, err := Storage.Read(file)
+	if err == nil {
+		err = unmarshal(data, v, key, encrypted)
+	}
+	if err == nil || errors.Is(err, os.ErrNotExist) {
+		return err
 	}
 
-	if encrypted {
-		val := decrypt(string(data), Key)
-		data = []byte(val)
+	// fall back to the last good copy
+	bak, berr := Storage.ReadBackup(file)
+	if berr != nil || unmarshal(bak, v, key, encrypted) != nil {
+		return fmt.Errorf("%s: %w", file, err)
 	}
 
-	return json.Unmarshal(data, v)
+	fmt.Println("restored", file, "from backup after", err)
+	return Storage.Write(file, bak)
 }
 
 // Backoff is for exponential backoff
@@ -198,14 +329,27 @@ func ID() string {
 	return uuid.New().String()
 }
 
-// Encrypt text using AES-256 and secret key
+// Encrypt text using AES-256 and secret key, returns an empty string on error
 func Encrypt(text string) string {
-	return encrypt(text, Key)
+	b, _ := EncryptBytes([]byte(text))
+	return string(b)
 }
 
-// Decrypt text using AES-256 and secret key
+// Decrypt text using AES-256 and secret key, returns an empty string on error
 func Decrypt(text string) string {
-	return decrypt(text, Key)
+	b, _ := DecryptBytes([]byte(text))
+	return string(b)
+}
+
+// EncryptBytes encrypts data using AES-256 and secret key returning the hex encoded envelope
+func EncryptBytes(data []byte) ([]byte, error) {
+	return encrypt(data, Key)
+}
+
+// DecryptBytes decrypts data produced by EncryptBytes.
+// It returns ErrCorrupt for malformed or tampered data and ErrWrongKey if no key matches.
+func DecryptBytes(data []byte) ([]byte, error) {
+	return decrypt(data, Key)
 }
 
 // Save data to the cache
@@ -213,26 +357,116 @@ func Save(data interface{}, file string, encrypt bool) error {
 	return save(data, file, Key, encrypt)
 }
 
-// Load data from cache
+// Load data from cache. Decryption failures are returned as ErrCorrupt or ErrWrongKey.
 func Load(data interface{}, file string, decrypt bool) error {
 	return load(data, file, Key, decrypt)
 }
 
-// Render the template
-func Render(w http.ResponseWriter, tmpl string) error {
-	_, err := w.Write([]byte(tmpl))
-	return err
+// Put a single value into a bucket
+func Put(bucket, key string, val interface{}, encrypt bool) error {
+	data, err := marshal(val, Key, encrypt)
+	if err != nil {
+		return err
+	}
+	return Storage.Put(bucket, key, data)
 }
 
-// The standard HTML template
-func Template(name, desc, nav, content string) string {
-	return fmt.Sprintf(`<!DOCTYPE html>
-<html lang="en">
+// Get a single value from a bucket
+func Get(bucket, key string, val interface{}, decrypt bool) error {
+	data, err := Storage.Get(bucket, key)
+	if err == nil {
+		err = unmarshal(data, val, Key, decrypt)
+	}
+	if err == nil || errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	// fall back to the last good copy
+	bak, berr := Storage.GetBackup(bucket, key)
+	if berr != nil || unmarshal(bak, val, Key, decrypt) != nil {
+		return fmt.Errorf("%s/%s: %w", bucket, key, err)
+	}
+
+	fmt.Println("restored", bucket, key, "from backup after", err)
+	return Storage.Put(bucket, key, bak)
+}
+
+// Delete a value and its backup from a bucket
+func Delete(bucket, key string) error {
+	return Storage.Delete(bucket, key)
+}
+
+// Purge deletes the backup of a value so data erased by putting it again
+// isn't kept in the last good copy
+func Purge(bucket, key string) error {
+	return Storage.DeleteBackup(bucket, key)
+}
+
+// Size of a stored value in bytes, 0 if there isn't one
+func Size(bucket, key string) int64 {
+	data, err := Storage.Get(bucket, key)
+	if err != nil {
+		return 0
+	}
+	return int64(len(data))
+}
+
+// List the keys in a bucket
+func List(bucket string) ([]string, error) {
+	return Storage.List(bucket)
+}
+
+// Migrate moves a legacy cache file holding a map into a bucket
+func Migrate(file, bucket string, encrypted bool) error {
+	// emptied by an earlier run, a backup would mean it was cut short instead
+	if data, err := Storage.Read(file); err == nil && len(data) == 0 {
+		if _, err := Storage.ReadBackup(file); errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+	}
+
+	var vals map[string]json.RawMessage
+	if err := Load(&vals, file, encrypted); err != nil {
+		return err
+	}
+
+	for k, v := range vals {
+		if string(v) == "null" {
+			continue
+		}
+		if err := Put(bucket, k, v, encrypted); err != nil {
+			return err
+		}
+	}
+
+	// empty the old file so it's not migrated again, the backup would
+	// still hold everything including data erased from the bucket since
+	if err := Storage.Write(file, nil); err != nil {
+		return err
+	}
+	return Storage.RemoveBackup(file)
+}
+
+// layoutFuncs are filled in for each request by Render, these are the
+// defaults when there's no token or theme
+var layoutFuncs = template.FuncMap{
+	// csrfToken is the token for scripts to send as the X-CSRF-Token header
+	"csrfToken": func() string { return "" },
+	// csrfField is the hidden input every post form includes
+	"csrfField": func() template.HTML { return "" },
+	// theme is the user's theme e.g dark
+	"theme": func() string { return "" },
+}
+
+// the base layout, apps fill in the title, description, nav and content blocks
+var layout = template.Must(template.New("layout").Funcs(layoutFuncs).Parse(`<!DOCTYPE html>
+<html lang="en"{{with theme}} data-theme="{{.}}"{{end}}>
 <head>
-  <title>Mu %s | %s</title>
-  <meta name="description" content="%s">
+  <title>Mu {{block "title" .}}{{end}} | {{block "description" .}}{{end}}</title>
+  <meta name="description" content="{{template "description" .}}">
   <meta name="viewport" content="width=device-width, initial-scale=1.0">
   <link rel="stylesheet" href="/mu.css">
+  {{with csrfToken}}<meta name="csrf-token" content="{{.}}">{{end}}
   <style>
   body {
 	  font-family: arial;
@@ -263,14 +497,14 @@ func Template(name, desc, nav, content string) string {
   #nav {
     position: fixed; background: white;
     padding: 25px;
-    width: 20%%;
+    width: 20%;
     margin-right: 50px;
     padding-top: 100px;
     vertical-align: top;
     display: inline-block;
     z-index: 100;
   }
-  #content { display: block; height: 100%%; width: 70%%; margin-left: 30%%; display: inline-block; }
+  #content { display: block; height: 100%; width: 70%; margin-left: 30%; display: inline-block; }
   #logo { margin-bottom: 25px; }
   .head { margin-right: 10px; font-weight: bold; }
   a.head { display: block; margin-bottom: 20px; }
@@ -278,6 +512,10 @@ func Template(name, desc, nav, content string) string {
   .section img { display: none; }
   .section h3 { margin-bottom: 5px; }
   .ticker { display: inline-block; margin-right: 10px; }
+  html[data-theme=dark], html[data-theme=dark] body, html[data-theme=dark] #nav { background: #1e1e1e; color: #ddd; }
+  html[data-theme=dark] a { color: #eee; }
+  html[data-theme=dark] .category { background: #333; }
+  html[data-theme=dark] input, html[data-theme=dark] select, html[data-theme=dark] button { background: #2a2a2a; color: #ddd; border: 1px solid #555; }
   @media only screen and (max-width: 600px) {
     .section { margin-right: 0px; }
     #nav {
@@ -311,18 +549,99 @@ func Template(name, desc, nav, content string) string {
 <body>
   <div id="nav">
     <div id="logo"><a href="/"><img height=40px width=auto src="/assets/mu.png"></a></div>
-    %s
+    {{block "nav" .}}{{end}}
   </div>
-  <div id="content">%s</div>
+  <div id="content">{{block "content" .}}{{end}}</div>
 </body>
 </html>
-`, name, desc, desc, nav, content)
+`))
+
+// templates holds an unexecuted copy of each template for Render to clone,
+// html/template can't be cloned once it's run
+var templates = map[*template.Template]*template.Template{}
+var templatesMu sync.RWMutex
+
+// Template parses text into a copy of the base layout.
+// The text should define the "title", "description", "nav" and "content" blocks.
+// Post forms include {{csrfField}}.
+func Template(name, text string) *template.Template {
+	t := template.Must(layout.Clone())
+	template.Must(t.New(name).Parse(text))
+
+	templatesMu.Lock()
+	templates[t] = template.Must(t.Clone())
+	templatesMu.Unlock()
+
+	return t
+}
+
+// csrfWriter is a response writer carrying the CSRF token for the page, see user.CSRF
+type csrfWriter interface {
+	CSRFToken() string
+}
+
+// themeWriter is a response writer carrying the user's theme e.g dark
+type themeWriter interface {
+	Theme() string
+}
+
+// Render the template with data, everything is escaped unless it's a template.HTML.
+// The layout funcs get the CSRF token and theme if the writer carries them.
+func Render(w http.ResponseWriter, t *template.Template, data interface{}) error {
+	var token, theme string
+	if cw, ok := w.(csrfWriter); ok {
+		token = cw.CSRFToken()
+	}
+	if tw, ok := w.(themeWriter); ok {
+		theme = tw.Theme()
+	}
+
+	if len(token) > 0 || len(theme) > 0 {
+		templatesMu.RLock()
+		base, ok := templates[t]
+		templatesMu.RUnlock()
+		if !ok {
+			base = t
+		}
+
+		c, err := base.Clone()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return err
+		}
+		t = c.Funcs(template.FuncMap{
+			"csrfToken": func() string { return token },
+			"csrfField": func() template.HTML {
+				if len(token) == 0 {
+					return ""
+				}
+				return template.HTML(`<input type="hidden" name="csrf" value="` + template.HTMLEscapeString(token) + `">`)
+			},
+			"theme": func() string { return theme },
+		})
+	}
 
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		http.Error(w, err.Error(), 500)
+		return err
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, err := w.Write(buf.Bytes())
+	return err
 }
 
+// Serve starts the registered apps and serves them on port
 func Serve(port int) error {
 	sub, _ := fs.Sub(html, "html")
 
+	if err := start(http.DefaultServeMux); err != nil {
+		return err
+	}
+
+	http.HandleFunc("/manifest.webmanifest", manifest)
+
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path == "/" {
 			// logged in
@@ -342,5 +661,81 @@ func Serve(port int) error {
 
 	addr := fmt.Sprintf(":%d", port)
 
-	return http.ListenAndServe(addr, nil)
+	srv := &http.Server{Addr: addr}
+
+	// the http listener when serving https
+	var redirect *http.Server
+
+	if Secure() {
+		tc, h, err := tlsConfig(config.TLS, port)
+		if err != nil {
+			shutdown()
+			return err
+		}
+		srv.TLSConfig = tc
+
+		if config.TLS.HTTPPort > 0 {
+			redirect = &http.Server{
+				Addr:    fmt.Sprintf(":%d", config.TLS.HTTPPort),
+				Handler: h,
+			}
+		}
+	}
+
+	// shutdown on interrupt
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errCh := make(chan error, 2)
+	go func() {
+		if srv.TLSConfig != nil {
+			errCh <- srv.ListenAndServeTLS("", "")
+			return
+		}
+		errCh <- srv.ListenAndServe()
+	}()
+
+	if redirect != nil {
+		go func() {
+			errCh <- redirect.ListenAndServe()
+		}()
+	}
+
+	select {
+	case err := <-errCh:
+		srv.Close()
+		if redirect != nil {
+			redirect.Close()
+		}
+		shutdown()
+		return err
+	case <-ctx.Done():
+	}
+
+	fmt.Println("shutting down")
+
+	// give in flight requests time to finish
+	sctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	err := srv.Shutdown(sctx)
+
+	if redirect != nil {
+		redirect.Shutdown(sctx)
+	}
+
+	if serr := shutdown(); err == nil {
+		err = serr
+	}
+
+	return err
+}
+
+// shutdown stops the apps and closes the store
+func shutdown() error {
+	err := Stop()
+	if cerr := Storage.Close(); err == nil {
+		err = cerr
+	}
+	return err
 }
@@ -0,0 +1,147 @@
+package mu
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDecrypt(t *testing.T) {
+	testInit(t, "file")
+
+	good, _ := EncryptBytes([]byte(`"secret"`))
+
+	tampered := append([]byte{}, good...)
+	if tampered[len(tampered)-1] == '0' {
+		tampered[len(tampered)-1] = '1'
+	} else {
+		tampered[len(tampered)-1] = '0'
+	}
+
+	other := make([]byte, 32)
+	rand.Read(other)
+	otherKey, _ := encrypt([]byte(`"secret"`), hex.EncodeToString(other))
+
+	notJSON, _ := EncryptBytes([]byte("{"))
+
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"good", good, nil},
+		{"not hex", []byte("zz"), ErrCorrupt},
+		{"tampered", tampered, ErrCorrupt},
+		{"truncated", good[:2*(1+keyIDSize+4)], ErrCorrupt},
+		{"truncated header", good[:2*(1+keyIDSize)], ErrCorrupt},
+		{"version only", good[:2], ErrCorrupt},
+		{"other key", otherKey, ErrWrongKey},
+		{"random", []byte(hex.EncodeToString(other)), ErrWrongKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := DecryptBytes(tt.data)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if err == nil && string(b) != `"secret"` {
+				t.Errorf("got %q", b)
+			}
+
+			// the errors come through Load and Get the same, a new name
+			// each time so there's no backup to fall back to
+			Storage.Write(tt.name, tt.data)
+			Storage.Put("bucket", tt.name, tt.data)
+			var v string
+			if err := Load(&v, tt.name, true); !errors.Is(err, tt.err) {
+				t.Errorf("load got %v, want %v", err, tt.err)
+			}
+			if err := Get("bucket", tt.name, &v, true); !errors.Is(err, tt.err) {
+				t.Errorf("get got %v, want %v", err, tt.err)
+			}
+		})
+	}
+
+	t.Run("not json", func(t *testing.T) {
+		var v string
+		Storage.Put("bucket", "json", notJSON)
+		if err := Get("bucket", "json", &v, true); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("got %v, want %v", err, ErrCorrupt)
+		}
+	})
+}
+
+// pageWriter carries a token and theme like the user app's writer
+type pageWriter struct {
+	*httptest.ResponseRecorder
+	token, theme string
+}
+
+func (p pageWriter) CSRFToken() string { return p.token }
+func (p pageWriter) Theme() string     { return p.theme }
+
+func TestRender(t *testing.T) {
+	tmpl := Template("test", `
+{{define "title"}}Test{{end}}
+{{define "content"}}<form method="post">{{csrfField}}<input name="q" value="{{.}}"></form>{{end}}
+`)
+
+	tests := []struct {
+		name         string
+		token, theme string
+		want, not    []string
+	}{
+		{
+			name: "plain",
+			want: []string{`<html lang="en">`, `value="&lt;b&gt;"`},
+			not:  []string{`name="csrf"`, "csrf-token", `data-theme="`},
+		},
+		{
+			name:  "token and theme",
+			token: `a"b`,
+			theme: "dark",
+			want: []string{
+				`<html lang="en" data-theme="dark">`,
+				`<meta name="csrf-token" content="a&#34;b">`,
+				`<form method="post"><input type="hidden" name="csrf" value="a&#34;b">`,
+			},
+		},
+		{
+			name:  "escaped theme",
+			theme: `"><script>`,
+			not:   []string{"<script>"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := pageWriter{httptest.NewRecorder(), tt.token, tt.theme}
+			if err := Render(w, tmpl, "<b>"); err != nil {
+				t.Fatal(err)
+			}
+			body := w.Body.String()
+			for _, s := range tt.want {
+				if !strings.Contains(body, s) {
+					t.Errorf("missing %s in\n%s", s, body)
+				}
+			}
+			for _, s := range tt.not {
+				if strings.Contains(body, s) {
+					t.Errorf("unexpected %s in\n%s", s, body)
+				}
+			}
+		})
+	}
+
+	// the token from one render doesn't leak into the next
+	Render(pageWriter{httptest.NewRecorder(), "first", ""}, tmpl, nil)
+	w := pageWriter{httptest.NewRecorder(), "", ""}
+	Render(w, tmpl, nil)
+	if strings.Contains(w.Body.String(), "first") {
+		t.Error("token leaked between renders")
+	}
+}
@@ -3,10 +3,12 @@ package news
 import (
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -16,8 +18,10 @@ import (
 	"time"
 
 	"mu.dev"
+	"mu.dev/user"
 
 	"github.com/mmcdole/gofeed"
+	"golang.org/x/net/html"
 )
 
 //go:embed feeds.json
@@ -27,11 +31,17 @@ var feeds = map[string]string{}
 
 var status = map[string]*Feed{}
 
-// yes I know its hardcoded
-var key = os.Getenv("CRYPTO_API_KEY")
+// crypto compare api key
+var key string
 
 // sunnah api key
-var sunnah_key = os.Getenv("SUNNAH_API_KEY")
+var sunnah_key string
+
+// Config is the news section of mu.yaml
+type Config struct {
+	// Feeds by name replace the default feeds
+	Feeds map[string]string `yaml:"feeds"`
+}
 
 type Feed struct {
 	Name     string
@@ -81,9 +91,110 @@ var replace = []func(string) string{
 	},
 }
 
-var news = []byte{}
+// Section of articles from a feed
+type Section struct {
+	Name     string
+	Articles []*Article
+}
+
+// Hadith of the day
+type Hadith struct {
+	Title  string
+	Text   string
+	Book   string
+	Number int
+}
+
+// Ticker price
+type Ticker struct {
+	Symbol string
+	Price  string
+}
+
+// Page of news
+type Page struct {
+	Hadith    []*Hadith
+	Markets   []*Ticker
+	Headlines []*Article
+	Sections  []*Section
+	// Updated is when the feeds were parsed
+	Updated time.Time
+}
+
+var tmpl = mu.Template("news", `
+{{define "title"}}News{{end}}
+{{define "description"}}Read the news{{end}}
+{{define "nav"}}{{range .Sections}}<a href="#{{.Name}}" class="head">{{.Name}}</a>{{end}}{{end}}
+{{define "content"}}
+<div class=section><hr id="headlines" class="anchor">
+{{if .Hadith}}<div id="hadith"><h1>Hadith</h1>{{range $i, $h := .Hadith}}{{if $i}}<br>{{end}}<div><b>{{.Title}}</b><br>{{.Text}}<a href="https://sunnah.com/{{.Book}}:{{.Number}}">{{.Book}}:{{.Number}}</a></div>{{end}}</div>{{end}}
+{{if .Markets}}<div id="info"><h1>Markets</h1>{{range .Markets}}<span class="ticker">{{.Symbol}} ${{.Price}}</span>{{end}}</div>{{end}}
+<h1>Headlines</h1>
+{{range .Headlines}}
+<div class="headline"><a href="#{{.Category}}" class="category">{{.Category}}</a><h3><a href="{{.URL}}" rel="noopener noreferrer" target="_blank">{{.Title}}</a></h3><span class="description">{{.Description}}</span></div>
+{{end}}
+</div>
+{{range .Sections}}
+<div class=section>
+<hr id="{{.Name}}" class="anchor">
+<h1>{{.Name}}</h1>
+{{range .Articles}}
+<h3><a href="{{.URL}}" rel="noopener noreferrer" target="_blank">{{.Title}}</a></h3>
+<span class="description">{{.Description}}</span>
+{{end}}
+</div>
+{{end}}
+{{end}}
+`)
+
+var feedsTmpl = mu.Template("feeds", `
+{{define "title"}}Feeds{{end}}
+{{define "description"}}News RSS feeds{{end}}
+{{define "content"}}
+<h1>Feeds</h1>
+{{range $name, $url := .Feeds}}<a href="{{$url}}">{{$name}}</a><br>{{end}}
+{{if .Add}}<p><a href="/news/add">Add a feed</a></p>{{end}}
+{{end}}
+`)
+
+var addTmpl = mu.Template("add", `
+{{define "title"}}Add Feed{{end}}
+{{define "description"}}Add a news feed{{end}}
+{{define "content"}}
+<h1>Add Feed</h1>
+<form id="add" action="/news/add" method="post">{{csrfField}}
+<input id="name" name="name" placeholder="feed name" required>
+<br><br>
+<input id="feed" name="feed" placeholder="feed url" required>
+<br><br>
+<button>Submit</button>
+<p><small>Feed will be parsed in 1 minute</small></p>
+</form>
+{{end}}
+`)
+
+// the last page parsed, rendered for each user to show their categories
+var current *Page
 var mutex sync.RWMutex
 
+// closed to stop parsing feeds
+var done = make(chan bool)
+var wg sync.WaitGroup
+
+// text strips html from feed content leaving the text
+func text(v string) string {
+	z := html.NewTokenizer(strings.NewReader(v))
+	var b strings.Builder
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return strings.TrimSpace(b.String())
+		case html.TextToken:
+			b.Write(z.Text())
+		}
+	}
+}
+
 func addHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "POST" {
 		r.ParseForm()
@@ -93,6 +204,10 @@ func addHandler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "missing name or feed", 500)
 			return
 		}
+		if u, err := url.Parse(feed); err != nil || len(u.Host) == 0 {
+			http.Error(w, "invalid feed url", 400)
+			return
+		}
 
 		mutex.Lock()
 		_, ok := feeds[name]
@@ -109,50 +224,67 @@ func addHandler(w http.ResponseWriter, r *http.Request) {
 		saveFeed()
 
 		// redirect
-		http.Redirect(w, r, "/", 302)
+		http.Redirect(w, r, "/news/feeds", 302)
+		return
 	}
 
-	form := `
-<h1>Add Feed</h1>
-<form id="add" action="/add" method="post">
-<input id="name" name="name" placeholder="feed name" required>
-<br><br>
-<input id="feed" name="feed" placeholder="feed url" required>
-<br><br>
-<button>Submit</button>
-<p><small>Feed will be parsed in 1 minute</small></p>
-</form>
-`
-
-	html := mu.Template("Add Feed", "Add a news feed", "", form)
-
-	mu.Render(w, html)
+	mu.Render(w, addTmpl, nil)
 }
 
 func saveFeed() {
 	mutex.Lock()
 	defer mutex.Unlock()
-	file := filepath.Join(mu.Cache, "feeds.json")
-	feed, _ := json.Marshal(feeds)
-	os.WriteFile(file, feed, 0644)
+	mu.Save(feeds, "feeds.json", false)
 }
 
-func saveHtml(head, data []byte) {
-	if len(data) == 0 {
-		return
-	}
-	html := mu.Template("News", "Read the news", string(head), string(data))
+// savePage shows the page and caches it for a restart, it's rendered
+// through the template like a fresh one so it's escaped
+func savePage(page *Page) {
 	mutex.Lock()
-	news = []byte(html)
+	current = page
 	mutex.Unlock()
-	cache := filepath.Join(mu.Cache, "news.html")
-	os.WriteFile(cache, news, 0644)
+
+	if err := mu.Save(page, "news.json", false); err != nil {
+		fmt.Println("Error saving news", err)
+	}
 }
 
 func IndexHandler(w http.ResponseWriter, r *http.Request) {
 	mutex.RLock()
-	defer mutex.RUnlock()
-	w.Write(news)
+	page := current
+	mutex.RUnlock()
+
+	// nothing until the feeds are parsed
+	if page == nil {
+		page = new(Page)
+	}
+
+	if c := user.PreferencesFromContext(r.Context()).Categories; len(c) > 0 {
+		page = filter(page, c)
+	}
+
+	mu.Render(w, tmpl, page)
+}
+
+// filter the page down to the categories
+func filter(page *Page, categories []string) *Page {
+	show := map[string]bool{}
+	for _, c := range categories {
+		show[c] = true
+	}
+
+	p := &Page{Hadith: page.Hadith, Markets: page.Markets}
+	for _, a := range page.Headlines {
+		if show[a.Category] {
+			p.Headlines = append(p.Headlines, a)
+		}
+	}
+	for _, s := range page.Sections {
+		if show[s.Name] {
+			p.Sections = append(p.Sections, s)
+		}
+	}
+	return p
 }
 
 func StatusHandler(w http.ResponseWriter, r *http.Request) {
@@ -164,58 +296,86 @@ func StatusHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func loadFeed() {
-	// load the feeds file
-	data, _ := f.ReadFile("feeds.json")
-	// unpack into feeds
+	var c Config
+	if err := mu.Section("news", &c); err != nil {
+		fmt.Println("Error reading news config", err)
+	}
+
 	mutex.Lock()
-	if err := json.Unmarshal(data, &feeds); err != nil {
-		fmt.Println("Error parsing feeds.json", err)
+	if len(c.Feeds) > 0 {
+		// use the configured feeds
+		for name, feed := range c.Feeds {
+			feeds[name] = feed
+		}
+	} else {
+		// load the feeds file
+		data, _ := f.ReadFile("feeds.json")
+		// unpack into feeds
+		if err := json.Unmarshal(data, &feeds); err != nil {
+			fmt.Println("Error parsing feeds.json", err)
+		}
 	}
 	mutex.Unlock()
 
 	// load from cache
-	file := filepath.Join(mu.Cache, "feeds.json")
-
-	_, err := os.Stat(file)
-	if err == nil {
-		// file exists
-		b, err := ioutil.ReadFile(file)
-		if err == nil && len(b) > 0 {
-			var res map[string]string
-			json.Unmarshal(b, &res)
-			mutex.Lock()
-			for name, feed := range res {
-				_, ok := feeds[name]
-				if ok {
-					continue
-				}
-				fmt.Println("Loading", name, feed)
-				feeds[name] = feed
+	var res map[string]string
+	if err := mu.Load(&res, "feeds.json", false); err != nil && !errors.Is(err, os.ErrNotExist) {
+		fmt.Println("Error loading feeds:", err)
+	} else if err == nil {
+		mutex.Lock()
+		for name, feed := range res {
+			_, ok := feeds[name]
+			if ok {
+				continue
 			}
-			mutex.Unlock()
+			fmt.Println("Loading", name, feed)
+			feeds[name] = feed
 		}
+		mutex.Unlock()
 	}
 }
 
-func parseFeed() {
-	cache := filepath.Join(mu.Cache, "news.html")
+// parse the feeds every 10 minutes until stopped
+func run() {
+	defer wg.Done()
+
+	// older versions cached the rendered page, which may predate escaping
+	os.Remove(filepath.Join(mu.Cache, "news.html"))
 
-	f, err := os.Stat(cache)
-	if err == nil && len(news) == 0 {
+	var page *Page
+	if err := mu.Load(&page, "news.json", false); err == nil && page != nil {
 		fmt.Println("Reading cache")
 		mutex.Lock()
-		news, _ = os.ReadFile(cache)
+		if current == nil {
+			current = page
+		}
 		mutex.Unlock()
 
-		if time.Since(f.ModTime()) < time.Minute {
-			time.Sleep(time.Minute)
+		if time.Since(page.Updated) < time.Minute {
+			select {
+			case <-time.After(time.Minute):
+			case <-done:
+				return
+			}
 		}
 	}
 
+	for {
+		parseFeed()
+
+		// wait 10 minutes
+		select {
+		case <-time.After(time.Minute * 10):
+		case <-done:
+			return
+		}
+	}
+}
+
+func parseFeed() {
 	p := gofeed.NewParser()
 
-	data := []byte{}
-	head := []byte{}
+	page := new(Page)
 	urls := map[string]string{}
 	stats := map[string]Feed{}
 
@@ -237,6 +397,13 @@ func parseFeed() {
 	var headlines []*Article
 
 	for _, name := range sorted {
+		// stop early on shutdown
+		select {
+		case <-done:
+			return
+		default:
+		}
+
 		feed := urls[name]
 
 		// check last attempt
@@ -294,11 +461,7 @@ func parseFeed() {
 		status[name] = &stat
 		mutex.Unlock()
 
-		head = append(head, []byte(`<a href="#`+name+`" class="head">`+name+`</a>`)...)
-
-		data = append(data, []byte(`<div class=section>`)...)
-		data = append(data, []byte(`<hr id="`+name+`" class="anchor">`)...)
-		data = append(data, []byte(`<h1>`+name+`</h1>`)...)
+		section := &Section{Name: name}
 
 		for i, item := range f.Items {
 			// only 10 items
@@ -310,11 +473,15 @@ func parseFeed() {
 				item.Description = fn(item.Description)
 			}
 
-			val := fmt.Sprintf(`
-<h3><a href="%s" rel="noopener noreferrer" target="_blank">%s</a></h3>
-<span class="description">%s</span>
-			`, item.Link, item.Title, item.Description)
-			data = append(data, []byte(val)...)
+			// feeds are untrusted so only keep the text
+			item.Title = text(item.Title)
+			item.Description = text(item.Description)
+
+			section.Articles = append(section.Articles, &Article{
+				Title:       item.Title,
+				Description: item.Description,
+				URL:         item.Link,
+			})
 
 			if i > 0 {
 				continue
@@ -330,70 +497,39 @@ func parseFeed() {
 			})
 		}
 
-		data = append(data, []byte(`</div>`)...)
+		page.Sections = append(page.Sections, section)
 	}
 
-	// head = append(head, []byte(`<a href="/add" class="head"><button>Add</button></a>`)...)
-
-	headline := []byte(`<div class=section><hr id="headlines" class="anchor">`)
-
 	// get hadith
-	hadith := getSunnah()
-	if len(hadith) > 0 {
-		headline = append(headline, []byte(fmt.Sprintf(`<div id="hadith"><h1>Hadith</h1>%s</div>`, hadith))...)
-	}
+	page.Hadith = getSunnah()
 
 	// get crypto prices
 	prices := getPrice(tickers...)
 
 	if prices != nil {
-		btc := prices["BTC"]
-		eth := prices["ETH"]
-		bnb := prices["BNB"]
-		sol := prices["SOL"]
-
-		var info []byte
-		info = append(info, []byte(`<div id="info"><h1>Markets</h1>`)...)
-		info = append(info, []byte(`<span class="ticker">btc $`+btc+`</span>`)...)
-		info = append(info, []byte(`<span class="ticker">eth $`+eth+`</span>`)...)
-		info = append(info, []byte(`<span class="ticker">bnb $`+bnb+`</span>`)...)
-		info = append(info, []byte(`<span class="ticker">sol $`+sol+`</span>`)...)
-		info = append(info, []byte(`</div>`)...)
-		headline = append(headline, info...)
+		for _, t := range []string{"BTC", "ETH", "BNB", "SOL"} {
+			page.Markets = append(page.Markets, &Ticker{
+				Symbol: strings.ToLower(t),
+				Price:  prices[t],
+			})
+		}
 	}
 
-	headline = append(headline, []byte(`<h1>Headlines</h1>`)...)
-
 	// create the headlines
 	sort.Slice(headlines, func(i, j int) bool {
 		return headlines[i].PostedAt.After(headlines[j].PostedAt)
 	})
 
-	for _, h := range headlines {
-		val := fmt.Sprintf(`
-			<div class="headline"><a href="#%s" class="category">%s</a><h3><a href="%s" rel="noopener noreferrer" target="_blank">%s</a></h3><span class="description">%s</span></div>`,
-			h.Category, h.Category, h.URL, h.Title, h.Description)
-		headline = append(headline, []byte(val)...)
-	}
-
-	headline = append(headline, []byte(`</div>`)...)
-
-	// set the headline
-	data = append(headline, data...)
+	page.Headlines = headlines
+	page.Updated = time.Now()
 
 	// save it
-	saveHtml(head, data)
-
-	// wait 10 minutes
-	time.Sleep(time.Minute * 10)
-
-	// go again
-	parseFeed()
+	savePage(page)
 }
 
-func getSunnah() string {
+func getSunnah() []*Hadith {
 	if len(sunnah_key) == 0 {
-		return ""
+		return nil
 	}
 
 	r := rand.New(rand.NewSource(time.Now().UnixNano()))
@@ -402,7 +538,7 @@ func getSunnah() string {
 		"muslim":  3033,
 	}
 
-	var hadiths []string
+	var hadiths []*Hadith
 
 	for book, limit := range books {
 		for i := 0; i < 3; i++ {
@@ -416,7 +552,7 @@ func getSunnah() string {
 			uri := fmt.Sprintf("https://api.sunnah.com/v1/collections/%s/hadiths/%d", book, hadith)
 			req, err := http.NewRequest("GET", uri, nil)
 			if err != nil {
-				return ""
+				return nil
 			}
 
 			req.Header.Set("X-API-Key", sunnah_key)
@@ -442,33 +578,108 @@ func getSunnah() string {
 			}
 			had := h[0].(map[string]interface{})
 			title := had["chapterTitle"].(string)
-			text := had["body"].(string)
+			body := had["body"].(string)
 
-			hadiths = append(hadiths, fmt.Sprintf(`<div><b>%s</b><br>%s<a href="https://sunnah.com/%s:%d">%s:%d</a></div>`, title, text, book, hadith, book, hadith))
+			hadiths = append(hadiths, &Hadith{
+				Title:  text(title),
+				Text:   text(body),
+				Book:   book,
+				Number: hadith,
+			})
 			break
 		}
 	}
 
-	return strings.Join(hadiths, "<br>")
+	return hadiths
 }
 
 func FeedsHandler(w http.ResponseWriter, r *http.Request) {
 	mutex.RLock()
 	defer mutex.RUnlock()
 
-	data := `<h1>Feeds</h1>`
+	mu.Render(w, feedsTmpl, map[string]interface{}{
+		"Feeds": feeds,
+		"Add":   user.Has(r, user.RoleModerator),
+	})
+}
 
-	for name, feed := range feeds {
-		data += fmt.Sprintf(`<a href="%s">%s</a><br>`, feed, name)
+// App is the news app
+type App struct{}
+
+func (a *App) Name() string        { return "News" }
+func (a *App) Description() string { return "Hadiths, headlines and crypto markets" }
+func (a *App) Icon() string        { return "" }
+
+func (a *App) Routes() []mu.Route {
+	return []mu.Route{
+		{Path: "/news", Handler: IndexHandler, Nav: true},
+		{Path: "/news/feeds", Handler: FeedsHandler, Auth: true},
+		{Path: "/news/add", Handler: user.Require(user.RoleModerator, addHandler), Auth: true},
+		{Path: "/news/status", Handler: StatusHandler, Auth: true},
+	}
+}
+
+// Options offers the feeds for the news categories preference
+func (a *App) Options() map[string][]string {
+	mutex.RLock()
+	var names []string
+	for name := range feeds {
+		names = append(names, name)
 	}
+	mutex.RUnlock()
 
-	html := mu.Template("Feeds", "News RSS feeds", "", data)
-	mu.Render(w, html)
+	sort.Strings(names)
+	return map[string][]string{"categories": names}
 }
 
-func Register() {
+// Check the configured feeds are valid urls
+func (a *App) Check() error {
+	var c Config
+	if err := mu.Section("news", &c); err != nil {
+		return err
+	}
+	for name, feed := range c.Feeds {
+		u, err := url.Parse(feed)
+		if err != nil || len(u.Host) == 0 {
+			return fmt.Errorf("invalid feed %s: %s", name, feed)
+		}
+	}
+	return nil
+}
+
+func (a *App) Start() error {
+	key = mu.APIKey("crypto", "CRYPTO_API_KEY")
+	sunnah_key = mu.APIKey("sunnah", "SUNNAH_API_KEY")
+
 	// load the feeds
 	loadFeed()
 
-	go parseFeed()
+	wg.Add(1)
+	go run()
+
+	return nil
+}
+
+func (a *App) Stop() error {
+	close(done)
+	wg.Wait()
+	return nil
+}
+
+// Feeds returns the feeds by name
+func Feeds() map[string]string {
+	loadFeed()
+
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	res := map[string]string{}
+	for name, feed := range feeds {
+		res[name] = feed
+	}
+	return res
+}
+
+func Register() {
+	mu.Register(new(App))
 }
@@ -0,0 +1,61 @@
+package news
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"mu.dev"
+)
+
+func TestCachedPage(t *testing.T) {
+	for _, env := range []string{"MU_KEY", "MU_KEY_FILE", "MU_PASSPHRASE", "MU_STORE"} {
+		t.Setenv(env, "")
+	}
+	if err := mu.Init(mu.Config{DataDir: t.TempDir()}); err != nil {
+		t.Fatal(err)
+	}
+	defer mu.Storage.Close()
+	defer func() { current = nil }()
+
+	// nothing parsed yet
+	w := httptest.NewRecorder()
+	IndexHandler(w, httptest.NewRequest("GET", "/news", nil))
+	if w.Code != 200 || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+		t.Errorf("empty page got %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	// a page rendered before escaping and the parsed one
+	stale := filepath.Join(mu.Cache, "news.html")
+	os.WriteFile(stale, []byte("<script>stale</script>"), 0644)
+	if err := mu.Save(&Page{
+		Headlines: []*Article{{Title: "<script>alert(1)</script>", Category: "Tech"}},
+		Updated:   time.Now(),
+	}, "news.json", false); err != nil {
+		t.Fatal(err)
+	}
+
+	// a restart reads the cache without parsing the feeds
+	wg.Add(1)
+	go run()
+	close(done)
+	wg.Wait()
+	done = make(chan bool)
+
+	if _, err := os.Stat(stale); err == nil {
+		t.Error("stale page left")
+	}
+
+	w = httptest.NewRecorder()
+	IndexHandler(w, httptest.NewRequest("GET", "/news", nil))
+	body := w.Body.String()
+	if !strings.Contains(body, "&lt;script&gt;alert(1)&lt;/script&gt;") || strings.Contains(body, "<script>alert") {
+		t.Errorf("cached page not escaped")
+	}
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+		t.Errorf("content type %s", w.Header().Get("Content-Type"))
+	}
+}
@@ -2,16 +2,21 @@ package pray
 
 import (
 	"fmt"
+	"html/template"
 	"net/http"
 	"strings"
 	"time"
 
 	"github.com/hablullah/go-prayer"
 	"mu.dev"
+	"mu.dev/user"
 )
 
-var (
-	template = `
+var tmpl = mu.Template("pray", `
+{{define "title"}}Pray{{end}}
+{{define "description"}}Islamic Prayer Times{{end}}
+{{define "nav"}}{{range .}}<a href="#{{.ID}}" class="head">{{.Name}}</a>{{end}}{{end}}
+{{define "content"}}
   <style>
   #name {
     text-align: right;
@@ -33,15 +38,41 @@ var (
   }
   </style>
   <div id="times">
-  %s
+  {{range .}}{{if .Times}}
+  <h2 id="{{.ID}}">{{.Name}}</h2>
+  <div style="font-size: 0.5em; margin-bottom: 20px;"><span id="name">SALAH</span><span id="time">TODAY / TOMORROW</span></div>
+  {{range .Times}}<div><span id="name">{{.Name}}</span><span id="time">{{.Today}} / {{.Tomorrow}}</span></div>
+  {{end}}<br><br>
+  {{end}}{{end}}
   </div>
-`
-)
+{{end}}
+`)
+
+// Time of a prayer today and tomorrow
+type Time struct {
+	Name     template.HTML
+	Today    string
+	Tomorrow string
+}
+
+// Schedule of prayer times for a city
+type Schedule struct {
+	ID    string
+	Name  string
+	Times []Time
+}
 
 type City struct {
-	Name     string
-	Lat, Lon float64
-	Location string
+	Name     string  `yaml:"name"`
+	Lat      float64 `yaml:"lat"`
+	Lon      float64 `yaml:"lon"`
+	Location string  `yaml:"location"`
+}
+
+// Config is the pray section of mu.yaml
+type Config struct {
+	// Cities replace the default cities
+	Cities []City `yaml:"cities"`
 }
 
 var cities = []City{
@@ -59,30 +90,46 @@ func dateFormat(v time.Time) string {
 	return v.Format("15:04")
 }
 
-func printSchedule(city string, t1, t2 prayer.Schedule) string {
-	format := func(k string, v, x time.Time) string {
-		return fmt.Sprintf(`<div><span id="name">%s</span><span id="time">%s / %s</span></div>`, k, dateFormat(v), dateFormat(x))
+func printSchedule(t1, t2 prayer.Schedule) []Time {
+	format := func(k template.HTML, v, x time.Time) Time {
+		return Time{Name: k, Today: dateFormat(v), Tomorrow: dateFormat(x)}
 	}
 
-	str := fmt.Sprintf(`<h2 id="%s">%s</h2>`, strings.ReplaceAll(city, " ", ""), city)
-	str += fmt.Sprintf(`<div style="font-size: 0.5em; margin-bottom: 20px;"><span id="name">%s</span><span id="time">%s / %s</span></div>`, "SALAH", "TODAY", "TOMORROW")
-	str += format("Fajr", t1.Fajr, t2.Fajr)
-	str += format(`<span style="font-style: normal">🌅</span>`, t1.Sunrise, t2.Sunrise)
-	str += format("Zuhr", t1.Zuhr, t2.Zuhr)
-	str += format("Asr", t1.Asr, t2.Asr)
-	str += format("Maghrib", t1.Maghrib, t2.Maghrib)
-	str += format("Isha", t1.Isha, t2.Isha)
-	str += "<br><br>"
-	return str
+	return []Time{
+		format("Fajr", t1.Fajr, t2.Fajr),
+		format(`<span style="font-style: normal">🌅</span>`, t1.Sunrise, t2.Sunrise),
+		format("Zuhr", t1.Zuhr, t2.Zuhr),
+		format("Asr", t1.Asr, t2.Asr),
+		format("Maghrib", t1.Maghrib, t2.Maghrib),
+		format("Isha", t1.Isha, t2.Isha),
+	}
 }
 
 func IndexHandler(w http.ResponseWriter, r *http.Request) {
-	date := time.Now().Format(time.DateOnly)
+	prefs := user.PreferencesFromContext(r.Context())
 
-	nav := ""
-	content := ""
+	// today where the user is
+	now := time.Now().In(prefs.Location())
+	date := now.Format(time.DateOnly)
 
+	asr := prayer.Shafii
+	if prefs.Madhab == "hanafi" {
+		asr = prayer.Hanafi
+	}
+
+	// the home city first
+	var list []City
 	for _, city := range cities {
+		if city.Name == prefs.City {
+			list = append([]City{city}, list...)
+		} else {
+			list = append(list, city)
+		}
+	}
+
+	var content []*Schedule
+
+	for _, city := range list {
 		// Calculate prayer schedule in London for 2023.
 		// Since London in higher latitude, make sure to enable the adapter.
 		tz, _ := time.LoadLocation(city.Location)
@@ -91,25 +138,89 @@ func IndexHandler(w http.ResponseWriter, r *http.Request) {
 			Longitude:           city.Lon,
 			Timezone:            tz,
 			TwilightConvention:  prayer.MWL(),
-			AsrConvention:       prayer.Shafii,
+			AsrConvention:       asr,
 			HighLatitudeAdapter: prayer.NearestLatitude(),
 			PreciseToSeconds:    true,
-		}, 2024)
+		}, now.Year())
 
-		nav += fmt.Sprintf(`<a href="#%s" class="head">%s</a>`, strings.ReplaceAll(city.Name, " ", ""), city.Name)
+		sched := &Schedule{
+			ID:   strings.ReplaceAll(city.Name, " ", ""),
+			Name: city.Name,
+		}
 
-		for i, sched := range schedules {
-			if sched.Date != date {
+		for i, s := range schedules {
+			if s.Date != date {
 				continue
 			}
 
-			content += printSchedule(city.Name, schedules[i], schedules[i+1])
+			// close enough for tomorrow on the last day of the year
+			next := schedules[i]
+			if i+1 < len(schedules) {
+				next = schedules[i+1]
+			}
+
+			sched.Times = printSchedule(schedules[i], next)
 		}
+
+		content = append(content, sched)
 	}
 
-	out := mu.Template("Pray", "Islamic Prayer Times", nav, fmt.Sprintf(template, content))
-	mu.Render(w, out)
+	mu.Render(w, tmpl, content)
 	return
 }
 
-func Register() {}
+// App is the pray app
+type App struct{}
+
+func (a *App) Name() string        { return "Pray" }
+func (a *App) Description() string { return "Islamic prayer times around the globe" }
+func (a *App) Icon() string        { return "" }
+
+func (a *App) Routes() []mu.Route {
+	return []mu.Route{
+		{Path: "/pray", Handler: IndexHandler, Nav: true},
+	}
+}
+
+// Options offers the cities for the home city preference
+func (a *App) Options() map[string][]string {
+	var names []string
+	for _, city := range cities {
+		names = append(names, city.Name)
+	}
+	return map[string][]string{"city": names}
+}
+
+// Check the configured cities have a name and known timezone
+func (a *App) Check() error {
+	var c Config
+	if err := mu.Section("pray", &c); err != nil {
+		return err
+	}
+	for _, city := range c.Cities {
+		if len(city.Name) == 0 {
+			return fmt.Errorf("city missing name")
+		}
+		if _, err := time.LoadLocation(city.Location); err != nil {
+			return fmt.Errorf("%s: %v", city.Name, err)
+		}
+	}
+	return nil
+}
+
+func (a *App) Start() error {
+	var c Config
+	if err := mu.Section("pray", &c); err != nil {
+		return err
+	}
+	if len(c.Cities) > 0 {
+		cities = c.Cities
+	}
+	return nil
+}
+
+func (a *App) Stop() error { return nil }
+
+func Register() {
+	mu.Register(new(App))
+}
@@ -1,11 +1,18 @@
 package reminder
 
 import (
+	"context"
 	"embed"
 	"encoding/json"
 	"fmt"
+	"html/template"
 	"mu.dev"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"mu.dev/user"
 )
 
 //go:embed quran/*
@@ -13,18 +20,35 @@ var quran embed.FS
 
 var Quran map[string]string
 
-var Source = "https://api.alquran.cloud/v1/quran/en.sahih"
+// Source is where translations other than the embedded one are fetched
+// from, the edition is appended
+var Source = "https://api.alquran.cloud/v1/quran/"
+
+// Translations offered for the preference, the first is embedded and the
+// rest are fetched from Source
+var Translations = []string{"en.khattab", "en.sahih"}
 
+// HTML is the embedded translation
 var HTML string
 
+// pages are the fetched translations by edition
+var pages = map[string]string{}
+var mutex sync.RWMutex
+
+// stops fetching translations
+var cancel context.CancelFunc = func() {}
+var wg sync.WaitGroup
+
 func load() {
-	if err := mu.Load(&HTML, "quran.html", false); err == nil {
-		return
+	// older versions cached the rendered page, which may predate escaping,
+	// so it's rendered from the text on every start instead
+	if b, err := mu.Storage.Read("quran.html"); err == nil && len(b) > 0 {
+		mu.Storage.Write("quran.html", nil)
+		mu.Storage.RemoveBackup("quran.html")
 	}
 
 	if err := mu.Load(&Quran, "quran.dev", false); err == nil {
-		HTML = html()
-		mu.Save(HTML, "quran.html", false)
+		HTML = html(Quran)
 		return
 	}
 
@@ -42,9 +66,9 @@ func load() {
 		var data []interface{}
 		json.Unmarshal(f, &data)
 
-		name := data[0].(map[string]interface{})["name"].(map[string]interface{})["transliterated"].(string)
+		name := template.HTMLEscapeString(data[0].(map[string]interface{})["name"].(map[string]interface{})["transliterated"].(string))
 		name += "<br>"
-		name += data[0].(map[string]interface{})["name"].(map[string]interface{})["translated"].(string)
+		name += template.HTMLEscapeString(data[0].(map[string]interface{})["name"].(map[string]interface{})["translated"].(string))
 
 		data = data[1:]
 
@@ -67,15 +91,14 @@ func load() {
 		panic(err.Error())
 	}
 
-	// save html
-	HTML = html()
-	mu.Save(HTML, "quran.html", false)
+	HTML = html(Quran)
 }
 
-var html = func() string {
-	var data string
+var html = func(quran map[string]string) string {
+	// built up as it's rendered on every start
+	var data strings.Builder
 
-	data = `<style>
+	data.WriteString(`<style>
   .ayah {
     padding: 5px 0 5px 0;
     max-width: 600px;
@@ -131,46 +154,169 @@ document.addEventListener('DOMContentLoaded', function() {
   window.scrollTo(0, pos);
 }, false);
 </script>
-`
+`)
 
 	// 114 surahs
 	for i := 0; i < 114; i++ {
-		name := Quran[fmt.Sprintf("%d", i)]
+		name := quran[fmt.Sprintf("%d", i)]
 
-		data += fmt.Sprintf(`<div id="%d" class="surah"><h1>%d</h1><p>%s</p>`, i+1, i+1, name)
+		fmt.Fprintf(&data, `<div id="%d" class="surah"><h1>%d</h1><p>%s</p>`, i+1, i+1, name)
 
 		// max 286 ayahs
 		for j := 0; j < 286; j++ {
 			key := fmt.Sprintf("%d:%d", i, j)
-			text, ok := Quran[key]
+			text, ok := quran[key]
 			if !ok {
 				break
 			}
 			ref := fmt.Sprintf("%d:%d", i+1, j+1)
-			link := fmt.Sprintf(`<a href="https://quran.com/%s">%s</a>`, ref, text)
-			data += fmt.Sprintf(`<div id=%s class="marker"><a href="#%s">%s</a></div>`, ref, ref, ref)
-			data += fmt.Sprintf("<div class=ayah>%s</div>", link)
+			link := fmt.Sprintf(`<a href="https://quran.com/%s">%s</a>`, ref, template.HTMLEscapeString(text))
+			fmt.Fprintf(&data, `<div id=%s class="marker"><a href="#%s">%s</a></div>`, ref, ref, ref)
+			fmt.Fprintf(&data, "<div class=ayah>%s</div>", link)
 		}
 
-		data += "</div>"
+		data.WriteString("</div>")
 	}
 
-	return data
+	return data.String()
 }
 
-func IndexHandler(w http.ResponseWriter, r *http.Request) {
-	nav := `
+// fetch an edition of the quran from Source keyed like the embedded one
+func fetch(ctx context.Context, edition string) (map[string]string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", Source+edition, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: time.Minute}
+	rsp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != 200 {
+		return nil, fmt.Errorf("%s: %s", edition, rsp.Status)
+	}
+
+	var res struct {
+		Data struct {
+			Surahs []struct {
+				Name        string `json:"englishName"`
+				Translation string `json:"englishNameTranslation"`
+				Ayahs       []struct {
+					Text string `json:"text"`
+				} `json:"ayahs"`
+			} `json:"surahs"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(rsp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	if len(res.Data.Surahs) != 114 {
+		return nil, fmt.Errorf("%s: got %d surahs", edition, len(res.Data.Surahs))
+	}
+
+	q := map[string]string{}
+	for i, s := range res.Data.Surahs {
+		q[fmt.Sprintf("%d", i)] = template.HTMLEscapeString(s.Name) + "<br>" + template.HTMLEscapeString(s.Translation)
+		for j, a := range s.Ayahs {
+			q[fmt.Sprintf("%d:%d", i, j)] = a.Text
+		}
+	}
+	return q, nil
+}
+
+// loadTranslation reads the edition from the cache or fetches it
+func loadTranslation(ctx context.Context, edition string) {
+	file := "quran-" + edition + ".json"
+
+	var q map[string]string
+	if err := mu.Load(&q, file, false); err != nil || len(q) == 0 {
+		var err error
+		if q, err = fetch(ctx, edition); err != nil {
+			fmt.Println("Error fetching translation", edition, err)
+			return
+		}
+		mu.Save(q, file, false)
+	}
+
+	page := html(q)
+
+	mutex.Lock()
+	pages[edition] = page
+	mutex.Unlock()
+}
+
+// page for the translation, the embedded one until it's fetched
+func page(translation string) string {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	if p, ok := pages[translation]; ok {
+		return p
+	}
+	return HTML
+}
+
+var tmpl = mu.Template("reminder", `
+{{define "title"}}Reminder{{end}}
+{{define "description"}}Read the Quran{{end}}
+{{define "nav"}}
 	<a href="#1" class=head>The Opening</a>
 	<a href="#2:255" class=head>The Throne</a>
 	<a href="#112" class=head>Sincerity</a>
 	<a href="#113" class=head>The Dawn</a>
 	<a href="#114" class=head>Mankind</a>
-	`
+{{end}}
+{{define "content"}}{{.}}{{end}}
+`)
 
-	html := mu.Template("Reminder", "Read the Quran", nav, HTML)
-	mu.Render(w, html)
+func IndexHandler(w http.ResponseWriter, r *http.Request) {
+	translation := user.PreferencesFromContext(r.Context()).Translation
+
+	// generated from the quran with the text escaped
+	mu.Render(w, tmpl, template.HTML(page(translation)))
 }
 
-func Register() {
+// App is the reminder app
+type App struct{}
+
+func (a *App) Name() string        { return "Reminder" }
+func (a *App) Description() string { return "Read the Quran in English everyday" }
+func (a *App) Icon() string        { return "" }
+
+func (a *App) Routes() []mu.Route {
+	return []mu.Route{
+		{Path: "/reminder", Handler: IndexHandler, Nav: true},
+	}
+}
+
+// Options offers the translations for the preference
+func (a *App) Options() map[string][]string {
+	return map[string][]string{"translation": Translations}
+}
+
+func (a *App) Start() error {
 	load()
+
+	// fetch the other translations in the background
+	var ctx context.Context
+	ctx, cancel = context.WithCancel(context.Background())
+	for _, t := range Translations[1:] {
+		wg.Add(1)
+		go func(t string) {
+			defer wg.Done()
+			loadTranslation(ctx, t)
+		}(t)
+	}
+	return nil
+}
+
+func (a *App) Stop() error {
+	cancel()
+	wg.Wait()
+	return nil
+}
+
+func Register() {
+	mu.Register(new(App))
 }
@@ -0,0 +1,114 @@
+package reminder
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"mu.dev"
+)
+
+// edition in the api's format with a surah of two ayahs
+func edition(surahs int) map[string]interface{} {
+	var list []interface{}
+	for i := 0; i < surahs; i++ {
+		list = append(list, map[string]interface{}{
+			"englishName":            "Al-Test",
+			"englishNameTranslation": "The <Test>",
+			"ayahs": []interface{}{
+				map[string]interface{}{"text": "first"},
+				map[string]interface{}{"text": "second <b>"},
+			},
+		})
+	}
+	return map[string]interface{}{"data": map[string]interface{}{"surahs": list}}
+}
+
+func TestLoadTranslation(t *testing.T) {
+	t.Setenv("MU_KEY", "")
+	t.Setenv("MU_KEY_FILE", "")
+	t.Setenv("MU_PASSPHRASE", "")
+	t.Setenv("MU_STORE", "")
+	if err := mu.Init(mu.Config{DataDir: t.TempDir()}); err != nil {
+		t.Fatal(err)
+	}
+	defer mu.Storage.Close()
+
+	var fetches int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		switch r.URL.Path {
+		case "/en.test":
+			json.NewEncoder(w).Encode(edition(114))
+		case "/en.short":
+			json.NewEncoder(w).Encode(edition(2))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	defer func(s string) { Source = s }(Source)
+	Source = srv.URL + "/"
+	HTML = "embedded"
+	pages = map[string]string{}
+
+	loadTranslation(context.Background(), "en.test")
+
+	p := page("en.test")
+	for _, want := range []string{`id="114"`, "Al-Test<br>The &lt;Test&gt;", "second &lt;b&gt;", `id=114:2`} {
+		if !strings.Contains(p, want) {
+			t.Errorf("page missing %q", want)
+		}
+	}
+
+	// cached so it's not fetched again
+	pages = map[string]string{}
+	loadTranslation(context.Background(), "en.test")
+	if fetches != 1 || page("en.test") != p {
+		t.Errorf("fetched %d times", fetches)
+	}
+
+	// the embedded one until it loads
+	for _, e := range []string{"en.short", "en.missing"} {
+		loadTranslation(context.Background(), e)
+		if got := page(e); got != "embedded" {
+			t.Errorf("%s got %.20q", e, got)
+		}
+	}
+	if page("") != "embedded" {
+		t.Error("default isn't the embedded translation")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	t.Setenv("MU_KEY", "")
+	t.Setenv("MU_KEY_FILE", "")
+	t.Setenv("MU_PASSPHRASE", "")
+	t.Setenv("MU_STORE", "")
+	if err := mu.Init(mu.Config{DataDir: t.TempDir()}); err != nil {
+		t.Fatal(err)
+	}
+	defer mu.Storage.Close()
+
+	// rendered by an older version before escaping
+	mu.Save("<script>stale</script>", "quran.html", false)
+
+	for i := 0; i < 2; i++ {
+		HTML = ""
+		load()
+		if !strings.Contains(HTML, `id="114"`) || strings.Contains(HTML, "stale") {
+			t.Fatalf("load %d got %.40q", i, HTML)
+		}
+	}
+
+	if b, _ := mu.Storage.Read("quran.html"); len(b) > 0 {
+		t.Error("stale page left")
+	}
+	if _, err := mu.Storage.ReadBackup("quran.html"); err == nil {
+		t.Error("stale page left in the backup")
+	}
+}
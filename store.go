@@ -0,0 +1,373 @@
+package mu
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Store is a storage backend for the cache
+type Store interface {
+	// Read a whole file
+	Read(file string) ([]byte, error)
+	// Write a whole file
+	Write(file string, data []byte) error
+	// Get a key from a bucket
+	Get(bucket, key string) ([]byte, error)
+	// Put a key in a bucket
+	Put(bucket, key string, data []byte) error
+	// Delete a key from a bucket
+	Delete(bucket, key string) error
+	// List the keys in a bucket
+	List(bucket string) ([]string, error)
+	// Files lists every file
+	Files() ([]string, error)
+	// Buckets lists every bucket
+	Buckets() ([]string, error)
+	// ReadBackup reads the last good copy of a file
+	ReadBackup(file string) ([]byte, error)
+	// GetBackup gets the last good copy of a key
+	GetBackup(bucket, key string) ([]byte, error)
+	// RemoveBackup removes the last good copy of a file
+	RemoveBackup(file string) error
+	// DeleteBackup deletes the last good copy of a key
+	DeleteBackup(bucket, key string) error
+	// Close the store
+	Close() error
+}
+
+// writeFile atomically replaces path with data and keeps the previous copy as path.bak
+func writeFile(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+
+	// write to a temp file in the same directory
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	// no-op once renamed
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	// flush to disk before it replaces anything
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	// roll the current copy to the backup
+	if _, err := os.Stat(path); err == nil {
+		os.Remove(path + ".bak")
+		if err := os.Link(path, path+".bak"); err != nil {
+			return err
+		}
+	}
+
+	// swap in the new file
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	// persist the rename, best effort since not every platform supports it
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	return nil
+}
+
+// cleanTemp removes temp files left behind by a crash mid write
+func cleanTemp(dir string) {
+	filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !d.IsDir() && isTemp(d.Name()) {
+			fmt.Println("removing incomplete write", path)
+			os.Remove(path)
+		}
+		return nil
+	})
+}
+
+// isTemp reports whether the name is a temp file from writeFile, the name
+// it's for followed by .tmp and the random digits os.CreateTemp adds
+func isTemp(name string) bool {
+	i := strings.LastIndex(name, ".tmp")
+	if i <= 0 || i+len(".tmp") == len(name) {
+		return false
+	}
+	for _, c := range name[i+len(".tmp"):] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// fileStore writes files to a directory and buckets as subdirectories
+type fileStore struct {
+	dir string
+}
+
+// NewFileStore returns a store backed by files in dir
+func NewFileStore(dir string) Store {
+	cleanTemp(dir)
+	return &fileStore{dir: dir}
+}
+
+func (f *fileStore) path(bucket, key string) string {
+	// hex encode the key so it's always a valid file name
+	return filepath.Join(f.dir, bucket, hex.EncodeToString([]byte(key)))
+}
+
+func (f *fileStore) Read(file string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(f.dir, file))
+}
+
+func (f *fileStore) Write(file string, data []byte) error {
+	return writeFile(filepath.Join(f.dir, file), data, 0644)
+}
+
+func (f *fileStore) Get(bucket, key string) ([]byte, error) {
+	return os.ReadFile(f.path(bucket, key))
+}
+
+func (f *fileStore) Put(bucket, key string, data []byte) error {
+	if err := os.MkdirAll(filepath.Join(f.dir, bucket), 0700); err != nil {
+		return err
+	}
+	return writeFile(f.path(bucket, key), data, 0600)
+}
+
+func (f *fileStore) Delete(bucket, key string) error {
+	if err := f.DeleteBackup(bucket, key); err != nil {
+		return err
+	}
+	return remove(f.path(bucket, key))
+}
+
+// remove a file that may not exist
+func remove(path string) error {
+	err := os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (f *fileStore) List(bucket string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(f.dir, bucket))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		k, err := hex.DecodeString(e.Name())
+		if err != nil {
+			continue
+		}
+		keys = append(keys, string(k))
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (f *fileStore) entries(dirs bool) ([]string, error) {
+	entries, err := os.ReadDir(f.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() != dirs {
+			continue
+		}
+		// skip backups
+		if strings.HasSuffix(e.Name(), ".bak") {
+			continue
+		}
+		names = append(names, e.Name())
+	}
+	return names, nil
+}
+
+func (f *fileStore) Files() ([]string, error) {
+	return f.entries(false)
+}
+
+func (f *fileStore) Buckets() ([]string, error) {
+	return f.entries(true)
+}
+
+func (f *fileStore) ReadBackup(file string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(f.dir, file) + ".bak")
+}
+
+func (f *fileStore) GetBackup(bucket, key string) ([]byte, error) {
+	return os.ReadFile(f.path(bucket, key) + ".bak")
+}
+
+func (f *fileStore) RemoveBackup(file string) error {
+	return remove(filepath.Join(f.dir, file) + ".bak")
+}
+
+func (f *fileStore) DeleteBackup(bucket, key string) error {
+	return remove(f.path(bucket, key) + ".bak")
+}
+
+func (f *fileStore) Close() error {
+	return nil
+}
+
+// files written with Write live in their own bucket
+var boltFiles = []byte("_files")
+
+// boltStore is an embedded key-value store
+type boltStore struct {
+	db *bolt.DB
+}
+
+// NewBoltStore opens a bbolt database at path
+func NewBoltStore(path string) (Store, error) {
+	// don't block forever if another process holds the lock
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second * 5})
+	if err != nil {
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+func (b *boltStore) get(bucket, key []byte) ([]byte, error) {
+	var data []byte
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bk := tx.Bucket(bucket)
+		if bk == nil {
+			return os.ErrNotExist
+		}
+		v := bk.Get(key)
+		if v == nil {
+			return os.ErrNotExist
+		}
+		// values are only valid for the life of the transaction
+		data = append([]byte{}, v...)
+		return nil
+	})
+	return data, err
+}
+
+func (b *boltStore) put(bucket, key, data []byte) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bk, err := tx.CreateBucketIfNotExists(bucket)
+		if err != nil {
+			return err
+		}
+		return bk.Put(key, data)
+	})
+}
+
+func (b *boltStore) Read(file string) ([]byte, error) {
+	return b.get(boltFiles, []byte(file))
+}
+
+func (b *boltStore) Write(file string, data []byte) error {
+	return b.put(boltFiles, []byte(file), data)
+}
+
+func (b *boltStore) Get(bucket, key string) ([]byte, error) {
+	return b.get([]byte(bucket), []byte(key))
+}
+
+func (b *boltStore) Put(bucket, key string, data []byte) error {
+	return b.put([]byte(bucket), []byte(key), data)
+}
+
+func (b *boltStore) Delete(bucket, key string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bk := tx.Bucket([]byte(bucket))
+		if bk == nil {
+			return nil
+		}
+		return bk.Delete([]byte(key))
+	})
+}
+
+func (b *boltStore) List(bucket string) ([]string, error) {
+	var keys []string
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bk := tx.Bucket([]byte(bucket))
+		if bk == nil {
+			return nil
+		}
+		return bk.ForEach(func(k, _ []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+	})
+	return keys, err
+}
+
+func (b *boltStore) Files() ([]string, error) {
+	return b.List(string(boltFiles))
+}
+
+func (b *boltStore) Buckets() ([]string, error) {
+	var names []string
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			if string(name) != string(boltFiles) {
+				names = append(names, string(name))
+			}
+			return nil
+		})
+	})
+	return names, err
+}
+
+// bbolt commits are already crash safe so there are no backups
+
+func (b *boltStore) ReadBackup(file string) ([]byte, error) {
+	return nil, os.ErrNotExist
+}
+
+func (b *boltStore) GetBackup(bucket, key string) ([]byte, error) {
+	return nil, os.ErrNotExist
+}
+
+func (b *boltStore) RemoveBackup(file string) error {
+	return nil
+}
+
+func (b *boltStore) DeleteBackup(bucket, key string) error {
+	return nil
+}
+
+func (b *boltStore) Close() error {
+	return b.db.Close()
+}
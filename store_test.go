@@ -0,0 +1,294 @@
+package mu
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testInit sets up mu in a temp dir with a generated key and the given store
+func testInit(t *testing.T, store string) {
+	t.Helper()
+
+	for _, env := range []string{"MU_KEY", "MU_KEY_FILE", "MU_PASSPHRASE", "MU_STORE"} {
+		t.Setenv(env, "")
+	}
+
+	if err := Init(Config{DataDir: t.TempDir(), Store: store}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		Storage.Close()
+		Storage = nil
+	})
+}
+
+func TestWriteFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data")
+
+	for _, v := range []string{"one", "two", "three"} {
+		if err := writeFile(path, []byte(v), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for file, want := range map[string]string{path: "three", path + ".bak": "two"} {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != want {
+			t.Errorf("%s = %q, want %q", filepath.Base(file), b, want)
+		}
+	}
+
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 2 {
+		t.Errorf("got %d files, want the file and its backup", len(entries))
+	}
+}
+
+func TestCleanTemp(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "bucket"), 0700)
+
+	files := map[string]bool{
+		"users.enc":              true,
+		"users.enc.bak":          true,
+		"users.enc.tmp123":       false,
+		"bucket/6b6579":          true,
+		"bucket/6b6579.tmp45678": false,
+		// keys and files which only look like temp files
+		"bucket/2e746d70":    true,
+		"notes.tmp":          true,
+		"notes.tmp.enc":      true,
+		"notes.tmp12.bak":    true,
+		"bucket/6b6579.tmpx": true,
+		".tmp123":            true,
+	}
+	for name := range files {
+		os.WriteFile(filepath.Join(dir, name), []byte("x"), 0600)
+	}
+
+	NewFileStore(dir)
+
+	for name, keep := range files {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if exists := err == nil; exists != keep {
+			t.Errorf("%s exists %v, want %v", name, exists, keep)
+		}
+	}
+}
+
+func TestStores(t *testing.T) {
+	for _, store := range []string{"file", "bolt"} {
+		t.Run(store, func(t *testing.T) {
+			testInit(t, store)
+
+			if err := Save(map[string]int{"a": 1}, "data.enc", true); err != nil {
+				t.Fatal(err)
+			}
+			var m map[string]int
+			if err := Load(&m, "data.enc", true); err != nil || m["a"] != 1 {
+				t.Fatalf("load got %v %v", m, err)
+			}
+
+			for _, k := range []string{"b", "a/../c", "a"} {
+				if err := Put("things", k, k, true); err != nil {
+					t.Fatal(err)
+				}
+			}
+			keys, err := List("things")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []string{"a", "a/../c", "b"}; !reflect.DeepEqual(keys, want) {
+				t.Errorf("list got %v, want %v", keys, want)
+			}
+
+			var v string
+			if err := Get("things", "a/../c", &v, true); err != nil || v != "a/../c" {
+				t.Errorf("get got %q %v", v, err)
+			}
+
+			if err := Delete("things", "a"); err != nil {
+				t.Fatal(err)
+			}
+			if err := Delete("things", "missing"); err != nil {
+				t.Errorf("deleting a missing key got %v", err)
+			}
+			if err := Get("things", "a", &v, true); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("get deleted got %v, want not exist", err)
+			}
+			if err := Load(&m, "missing.enc", true); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("load missing got %v, want not exist", err)
+			}
+
+			files, _ := Storage.Files()
+			buckets, _ := Storage.Buckets()
+			if !reflect.DeepEqual(files, []string{"data.enc"}) || !reflect.DeepEqual(buckets, []string{"things"}) {
+				t.Errorf("got files %v buckets %v", files, buckets)
+			}
+		})
+	}
+}
+
+func TestBackup(t *testing.T) {
+	tests := []struct {
+		name string
+		// overwrite the current copy and the backup with these, nil leaves it
+		current, backup []byte
+		want            string
+		err             error
+	}{
+		{"good", nil, nil, "new", nil},
+		{"corrupt", []byte("garbage"), nil, "old", nil},
+		{"truncated", []byte{}, nil, "old", nil},
+		{"both truncated", []byte{}, []byte{}, "", ErrCorrupt},
+		{"both corrupt", []byte("garbage"), []byte("garbage"), "", ErrCorrupt},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testInit(t, "file")
+
+			for _, v := range []string{"old", "new"} {
+				Save(v, "file.enc", true)
+				Put("bucket", "key", v, true)
+			}
+
+			fs := Storage.(*fileStore)
+			paths := []string{filepath.Join(Cache, "file.enc"), fs.path("bucket", "key")}
+			for _, p := range paths {
+				if tt.current != nil {
+					os.WriteFile(p, tt.current, 0600)
+				}
+				if tt.backup != nil {
+					os.WriteFile(p+".bak", tt.backup, 0600)
+				}
+			}
+
+			var got string
+			err := Load(&got, "file.enc", true)
+			if !errors.Is(err, tt.err) || got != tt.want {
+				t.Errorf("load got %q %v, want %q %v", got, err, tt.want, tt.err)
+			}
+
+			got = ""
+			err = Get("bucket", "key", &got, true)
+			if !errors.Is(err, tt.err) || got != tt.want {
+				t.Errorf("get got %q %v, want %q %v", got, err, tt.want, tt.err)
+			}
+
+			// a restored backup replaces the corrupt copy
+			if tt.err == nil && tt.want == "old" {
+				for _, p := range paths {
+					bak, _ := os.ReadFile(p + ".bak")
+					cur, _ := os.ReadFile(p)
+					if string(cur) == "garbage" || len(cur) == 0 {
+						t.Errorf("%s not restored", p)
+					}
+					// the restore rolls the bad copy into the backup
+					if string(bak) != string(tt.current) {
+						t.Errorf("%s backup is %q", p, bak)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	testInit(t, "file")
+
+	old := map[string]interface{}{"alice": map[string]string{"name": "alice"}, "gone": nil}
+	if err := Save(old, "users.enc", true); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Migrate("users.enc", "users", true); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, _ := List("users")
+	if !reflect.DeepEqual(keys, []string{"alice"}) {
+		t.Errorf("migrated %v, want alice", keys)
+	}
+
+	var v map[string]string
+	if err := Get("users", "alice", &v, true); err != nil || v["name"] != "alice" {
+		t.Errorf("get got %v %v", v, err)
+	}
+
+	// the backup of the legacy file would still have everything
+	if _, err := Storage.ReadBackup("users.enc"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("legacy backup left, got %v", err)
+	}
+
+	// it's emptied so running it again does nothing
+	if err := Migrate("users.enc", "users", true); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := Storage.Read("users.enc"); len(b) != 0 {
+		t.Errorf("legacy file not emptied")
+	}
+}
+
+func TestPurge(t *testing.T) {
+	testInit(t, "file")
+
+	for _, v := range []string{"secret", "erased"} {
+		if err := Put("chat", "general", v, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := Storage.GetBackup("chat", "general"); err != nil {
+		t.Fatalf("no backup to purge, got %v", err)
+	}
+
+	if err := Purge("chat", "general"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Storage.GetBackup("chat", "general"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("backup left, got %v", err)
+	}
+
+	var v string
+	if err := Get("chat", "general", &v, true); err != nil || v != "erased" {
+		t.Errorf("get got %q %v", v, err)
+	}
+
+	// deleting takes the backup too
+	Put("chat", "general", "again", true)
+	if err := Delete("chat", "general"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Storage.GetBackup("chat", "general"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("backup left after delete, got %v", err)
+	}
+
+	// nothing to purge is fine
+	if err := Purge("chat", "general"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMigrateTruncated(t *testing.T) {
+	testInit(t, "file")
+
+	// cut short with the last good copy in the backup
+	Save(map[string]string{"alice": "one"}, "users.enc", true)
+	if err := Storage.Write("users.enc", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Migrate("users.enc", "users", true); err != nil {
+		t.Fatal(err)
+	}
+	var v string
+	if err := Get("users", "alice", &v, true); err != nil || v != "one" {
+		t.Errorf("got %q %v, want one", v, err)
+	}
+}
@@ -0,0 +1,192 @@
+package mu
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// TLSConfig serves https from cert files or certificates issued by ACME
+type TLSConfig struct {
+	// Cert and Key are PEM files, reloaded when they change
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// ACME issues certificates automatically e.g from Let's Encrypt
+	ACME ACMEConfig `yaml:"acme"`
+	// HTTPPort redirects http to https when set, e.g 80
+	HTTPPort int `yaml:"http_port"`
+}
+
+// ACMEConfig for automatic certificates
+type ACMEConfig struct {
+	// Domains to issue certificates for, enables ACME
+	Domains []string `yaml:"domains"`
+	// Email for the account
+	Email string `yaml:"email"`
+	// Directory url, defaults to Let's Encrypt. Set it to test against Pebble
+	Directory string `yaml:"directory"`
+	// CA is a PEM file to trust for the directory e.g Pebble's root
+	CA string `yaml:"ca"`
+}
+
+// Secure is true when serving https, so cookies should only be sent over it
+func Secure() bool {
+	files := len(config.TLS.Cert) > 0 && len(config.TLS.Key) > 0
+	return files || len(config.TLS.ACME.Domains) > 0
+}
+
+// checkTLS validates the tls config
+func checkTLS(c TLSConfig) error {
+	files := len(c.Cert) > 0 || len(c.Key) > 0
+	auto := len(c.ACME.Domains) > 0
+
+	switch {
+	case files && auto:
+		return errors.New("tls: set either cert and key or acme, not both")
+	case files && (len(c.Cert) == 0 || len(c.Key) == 0):
+		return errors.New("tls: set both cert and key")
+	case files:
+		if _, err := tls.LoadX509KeyPair(c.Cert, c.Key); err != nil {
+			return fmt.Errorf("tls: %v", err)
+		}
+	case auto:
+		if len(c.ACME.CA) > 0 {
+			if _, err := certPool(c.ACME.CA); err != nil {
+				return fmt.Errorf("tls: %v", err)
+			}
+		}
+	case len(c.ACME.Directory) > 0 || len(c.ACME.Email) > 0:
+		return errors.New("tls: acme needs domains")
+	}
+
+	if c.HTTPPort < 0 || c.HTTPPort > 65535 {
+		return fmt.Errorf("tls: invalid http_port %d", c.HTTPPort)
+	}
+
+	return nil
+}
+
+// certPool returns the system roots plus the certs in file
+func certPool(file string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificates in %s", file)
+	}
+	return pool, nil
+}
+
+// certLoader reloads a key pair when either file changes
+type certLoader struct {
+	sync.Mutex
+	cert, key string
+	modTime   time.Time
+	current   *tls.Certificate
+}
+
+func (c *certLoader) modified() time.Time {
+	var t time.Time
+	for _, f := range []string{c.cert, c.key} {
+		if fi, err := os.Stat(f); err == nil && fi.ModTime().After(t) {
+			t = fi.ModTime()
+		}
+	}
+	return t
+}
+
+// GetCertificate loads the pair on first use and whenever it's changed on disk
+func (c *certLoader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	mod := c.modified()
+	if c.current != nil && !mod.After(c.modTime) {
+		return c.current, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.cert, c.key)
+	if err != nil {
+		// keep serving the last good cert, e.g mid renewal
+		if c.current != nil {
+			fmt.Println("Error reloading certificate:", err)
+			return c.current, nil
+		}
+		return nil, err
+	}
+	if c.current != nil {
+		fmt.Println("reloaded certificate", c.cert)
+	}
+
+	c.current = &cert
+	c.modTime = mod
+	return c.current, nil
+}
+
+// tlsConfig returns the tls config and the handler for the http listener
+func tlsConfig(c TLSConfig, port int) (*tls.Config, http.Handler, error) {
+	redirect := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			// no port, and no brackets for JoinHostPort to add again
+			host = strings.Trim(r.Host, "[]")
+		}
+		if port != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(port))
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+
+	if len(c.ACME.Domains) == 0 {
+		l := &certLoader{cert: c.Cert, key: c.Key}
+		// fail at startup rather than on the first request
+		if _, err := l.GetCertificate(nil); err != nil {
+			return nil, nil, err
+		}
+		return &tls.Config{GetCertificate: l.GetCertificate}, redirect, nil
+	}
+
+	client := &acme.Client{DirectoryURL: c.ACME.Directory}
+	if len(client.DirectoryURL) == 0 {
+		client.DirectoryURL = autocert.DefaultACMEDirectory
+	}
+	if len(c.ACME.CA) > 0 {
+		pool, err := certPool(c.ACME.CA)
+		if err != nil {
+			return nil, nil, err
+		}
+		client.HTTPClient = &http.Client{
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		}
+	}
+
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(c.ACME.Domains...),
+		Cache:      autocert.DirCache(filepath.Join(Home, "acme")),
+		Client:     client,
+		Email:      c.ACME.Email,
+	}
+
+	// the http listener also answers http-01 challenges
+	return m.TLSConfig(), m.HTTPHandler(redirect), nil
+}
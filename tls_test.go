@@ -0,0 +1,290 @@
+package mu
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed pair for the name to dir returning the files
+func writeCert(t *testing.T, dir, name string) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kb, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return cert, keyFile
+}
+
+// touch moves the files' modification time on so the change is seen
+func touch(t *testing.T, d time.Duration, files ...string) {
+	t.Helper()
+
+	for _, f := range files {
+		if err := os.Chtimes(f, time.Now().Add(d), time.Now().Add(d)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func commonName(t *testing.T, c *tls.Certificate) string {
+	t.Helper()
+
+	x, err := x509.ParseCertificate(c.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return x.Subject.CommonName
+}
+
+func TestCertLoader(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := writeCert(t, dir, "one.example.com")
+
+	l := &certLoader{cert: cert, key: key}
+	c, err := l.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := commonName(t, c); got != "one.example.com" {
+		t.Errorf("got %s", got)
+	}
+
+	// rotated on disk
+	writeCert(t, dir, "two.example.com")
+	touch(t, time.Minute, cert, key)
+	c, err = l.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := commonName(t, c); got != "two.example.com" {
+		t.Errorf("after rotation got %s", got)
+	}
+
+	// half written keeps the last good pair
+	os.WriteFile(key, []byte("not a key"), 0600)
+	touch(t, time.Minute*2, key)
+	c, err = l.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := commonName(t, c); got != "two.example.com" {
+		t.Errorf("after a bad key got %s", got)
+	}
+
+	os.Remove(cert)
+	if c, err = l.GetCertificate(nil); err != nil || commonName(t, c) != "two.example.com" {
+		t.Errorf("after removing the cert got %v", err)
+	}
+
+	// nothing good to start with
+	bad := &certLoader{cert: cert, key: key}
+	if _, err := bad.GetCertificate(nil); err == nil {
+		t.Error("loaded a bad pair")
+	}
+}
+
+func TestRedirect(t *testing.T) {
+	cert, key := writeCert(t, t.TempDir(), "example.com")
+
+	tests := []struct {
+		port int
+		host string
+		want string
+	}{
+		{443, "example.com", "https://example.com/chat?c=general"},
+		{443, "example.com:80", "https://example.com/chat?c=general"},
+		{8443, "example.com", "https://example.com:8443/chat?c=general"},
+		{8443, "example.com:8080", "https://example.com:8443/chat?c=general"},
+		{443, "[::1]:80", "https://[::1]/chat?c=general"},
+		{8443, "[::1]", "https://[::1]:8443/chat?c=general"},
+	}
+
+	for _, tt := range tests {
+		_, h, err := tlsConfig(TLSConfig{Cert: cert, Key: key}, tt.port)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := httptest.NewRequest("GET", "http://example.com/chat?c=general", nil)
+		r.Host = tt.host
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != tt.want {
+			t.Errorf("%s to port %d got %d %s, want %s", tt.host, tt.port, w.Code, w.Header().Get("Location"), tt.want)
+		}
+	}
+}
+
+func TestCheckTLS(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := writeCert(t, dir, "example.com")
+	junk := filepath.Join(dir, "junk.pem")
+	os.WriteFile(junk, []byte("junk"), 0600)
+
+	tests := []struct {
+		name string
+		tls  TLSConfig
+		ok   bool
+	}{
+		{"none", TLSConfig{}, true},
+		{"files", TLSConfig{Cert: cert, Key: key, HTTPPort: 80}, true},
+		{"cert only", TLSConfig{Cert: cert}, false},
+		{"key only", TLSConfig{Key: key}, false},
+		{"bad key", TLSConfig{Cert: cert, Key: junk}, false},
+		{"missing files", TLSConfig{Cert: cert + ".x", Key: key + ".x"}, false},
+		{"acme", TLSConfig{ACME: ACMEConfig{Domains: []string{"example.com"}, Email: "a@example.com"}}, true},
+		{"acme ca", TLSConfig{ACME: ACMEConfig{Domains: []string{"example.com"}, CA: cert}}, true},
+		{"acme bad ca", TLSConfig{ACME: ACMEConfig{Domains: []string{"example.com"}, CA: junk}}, false},
+		{"acme without domains", TLSConfig{ACME: ACMEConfig{Directory: "https://localhost:14000/dir"}}, false},
+		{"files and acme", TLSConfig{Cert: cert, Key: key, ACME: ACMEConfig{Domains: []string{"example.com"}}}, false},
+		{"negative http port", TLSConfig{Cert: cert, Key: key, HTTPPort: -1}, false},
+		{"big http port", TLSConfig{Cert: cert, Key: key, HTTPPort: 70000}, false},
+	}
+
+	for _, tt := range tests {
+		if err := checkTLS(tt.tls); (err == nil) != tt.ok {
+			t.Errorf("%s got %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestSecure(t *testing.T) {
+	defer func(c Config) { config = c }(config)
+
+	tests := []struct {
+		tls  TLSConfig
+		want bool
+	}{
+		{TLSConfig{}, false},
+		{TLSConfig{Cert: "cert.pem"}, false},
+		{TLSConfig{Key: "key.pem"}, false},
+		{TLSConfig{Cert: "cert.pem", Key: "key.pem"}, true},
+		{TLSConfig{ACME: ACMEConfig{Domains: []string{"example.com"}}}, true},
+	}
+
+	for _, tt := range tests {
+		config.TLS = tt.tls
+		if got := Secure(); got != tt.want {
+			t.Errorf("%+v got %v, want %v", tt.tls, got, tt.want)
+		}
+	}
+}
+
+func TestACME(t *testing.T) {
+	testInit(t, "file")
+
+	// a directory which refuses new accounts
+	var mutex sync.Mutex
+	var requests []string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		mutex.Unlock()
+
+		w.Header().Set("Replay-Nonce", "nonce")
+		switch r.URL.Path {
+		case "/dir":
+			json.NewEncoder(w).Encode(map[string]string{
+				"newNonce":   "https://" + r.Host + "/nonce",
+				"newAccount": "https://" + r.Host + "/account",
+				"newOrder":   "https://" + r.Host + "/order",
+			})
+		case "/nonce":
+			w.WriteHeader(200)
+		default:
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(403)
+			w.Write([]byte(`{"type":"urn:ietf:params:acme:error:unauthorized","detail":"not in tests"}`))
+		}
+	}))
+	defer srv.Close()
+
+	// trust the test server through the config
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600)
+
+	tc, h, err := tlsConfig(TLSConfig{ACME: ACMEConfig{
+		Domains:   []string{"example.com"},
+		Email:     "admin@example.com",
+		Directory: srv.URL + "/dir",
+		CA:        ca,
+	}}, 443)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// other names aren't asked for
+	if _, err := tc.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.com"}); err == nil {
+		t.Error("got a certificate for another domain")
+	}
+	if len(requests) != 0 {
+		t.Errorf("asked the directory for another domain %v", requests)
+	}
+
+	// the domain goes to the directory which refuses it
+	if _, err := tc.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"}); err == nil {
+		t.Error("got a certificate from a refusing directory")
+	}
+	mutex.Lock()
+	got := requests
+	mutex.Unlock()
+	var account bool
+	for _, r := range got {
+		account = account || r == "POST /account"
+	}
+	if len(got) == 0 || got[0] != "GET /dir" || !account {
+		t.Errorf("directory got %v", got)
+	}
+
+	// the http listener answers challenges and redirects the rest
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/.well-known/acme-challenge/unknown", nil))
+	if w.Code != 404 {
+		t.Errorf("unknown challenge got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/home", nil))
+	if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "https://example.com/home" {
+		t.Errorf("redirect got %d %s", w.Code, w.Header().Get("Location"))
+	}
+}
@@ -0,0 +1,469 @@
+package user
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"mu.dev"
+)
+
+var ErrDisabled = errors.New("account disabled")
+
+// Data is implemented by apps which store data for users so it can be
+// measured, exported and deleted with the account
+type Data interface {
+	// Usage is roughly how many bytes are stored for the user
+	Usage(username string) int64
+	// Export returns everything stored for the user, encoded as JSON
+	Export(username string) (interface{}, error)
+	// Erase deletes everything stored for the user
+	Erase(username string) error
+}
+
+var adminTmpl = mu.Template("admin", `
+{{define "title"}}Admin{{end}}
+{{define "description"}}User Admin{{end}}
+{{define "content"}}
+<style>
+  #admin table { border-collapse: collapse; }
+  #admin td, #admin th { padding: 5px 10px 5px 0; text-align: left; vertical-align: top; }
+  #admin form { display: inline; }
+</style>
+<div id="admin">
+<h1 style="padding-top: 100px;">Users</h1>
+<p>{{len .Users}} users - <a href="/admin/users.csv">Export CSV</a></p>
+{{$roles := .Roles}}
+<table>
+<tr><th>Username</th><th>Role</th><th>Created</th><th>Last login</th><th>Sessions</th><th>Storage</th><th></th></tr>
+{{range .Users}}
+<tr class="user">
+  <td>{{.Username}}{{if .Disabled}} (disabled){{end}}{{if .InvitedBy}}<br><small>invited by {{.InvitedBy}}</small>{{end}}</td>
+  <td>
+    <form action="/admin" method="post">{{csrfField}}
+      <input type="hidden" name="action" value="role">
+      <input type="hidden" name="username" value="{{.Username}}">
+      <select name="role">
+        {{$role := .Role}}{{range $roles}}<option value="{{.}}"{{if eq . $role}} selected{{end}}>{{.}}</option>{{end}}
+      </select>
+      <button>Save</button>
+    </form>
+  </td>
+  <td>{{if not .Created.IsZero}}{{.Created.Format "2006-01-02"}}{{end}}</td>
+  <td>{{if not .LastLogin.IsZero}}{{.LastLogin.Format "2006-01-02 15:04"}}{{end}}</td>
+  <td>{{.Sessions}}</td>
+  <td>{{.Storage}}</td>
+  <td>
+    <form action="/admin" method="post">{{csrfField}}
+      <input type="hidden" name="action" value="{{if .Disabled}}enable{{else}}disable{{end}}">
+      <input type="hidden" name="username" value="{{.Username}}">
+      <button>{{if .Disabled}}Enable{{else}}Disable{{end}}</button>
+    </form>
+    <form action="/admin" method="post">{{csrfField}}
+      <input type="hidden" name="action" value="logout">
+      <input type="hidden" name="username" value="{{.Username}}">
+      <button>Logout</button>
+    </form>
+    <form action="/admin" method="post" onsubmit="return confirm('Reset the password of {{.Username}}?')">{{csrfField}}
+      <input type="hidden" name="action" value="password">
+      <input type="hidden" name="username" value="{{.Username}}">
+      <button>Reset password</button>
+    </form>
+    <form action="/admin" method="post" onsubmit="return confirm('Delete {{.Username}} and all their data?')">{{csrfField}}
+      <input type="hidden" name="action" value="delete">
+      <input type="hidden" name="username" value="{{.Username}}">
+      <button>Delete</button>
+    </form>
+  </td>
+</tr>
+{{end}}
+</table>
+<h2>Invites</h2>
+<p>Signup is {{.Mode}}.</p>
+<form action="/admin" method="post">{{csrfField}}
+  <input type="hidden" name="action" value="invite">
+  <input name="uses" type="number" min="0" value="1" title="Uses, 0 for no limit" style="width: 60px;"> uses,
+  expires in <input name="days" type="number" min="0" value="7" title="Days, 0 for never" style="width: 60px;"> days
+  <button>Create invite</button>
+</form>
+{{range .Invites}}
+<form action="/admin" method="post" class="invite">{{csrfField}}
+  <code>{{.Code}}</code> - <a href="/signup?invite={{.Code}}">link</a> -
+  used {{len .UsedBy}}{{if .MaxUses}} of {{.MaxUses}}{{end}}{{if .UsedBy}} by {{range $i, $u := .UsedBy}}{{if $i}}, {{end}}{{$u}}{{end}}{{end}} -
+  {{if .Expires.IsZero}}never expires{{else}}expires {{.Expires.Format "2006-01-02 15:04"}}{{end}}
+  {{if not .Valid}}(no longer valid){{end}}
+  <input type="hidden" name="action" value="revoke">
+  <input type="hidden" name="code" value="{{.Code}}">
+  <button>Revoke</button>
+</form>
+{{end}}
+{{if .Locked}}
+<h2>Locked</h2>
+{{range .Locked}}
+<form action="/admin" method="post" class="locked">{{csrfField}}
+  {{.Username}} - {{.FailedLogins}} failed logins, locked until {{.LockedUntil.Format "2006-01-02 15:04"}}
+  <input type="hidden" name="action" value="unlock">
+  <input type="hidden" name="username" value="{{.Username}}">
+  <button>Unlock</button>
+</form>
+{{end}}
+{{end}}
+{{if .TwoFactor}}
+<h2>Two factor</h2>
+{{range .TwoFactor}}
+<form action="/admin" method="post" class="twofactor">{{csrfField}}
+  {{.Username}} - {{len .RecoveryCodes}} recovery codes left
+  <input type="hidden" name="action" value="reset2fa">
+  <input type="hidden" name="username" value="{{.Username}}">
+  <button>Reset</button>
+</form>
+{{end}}
+{{end}}
+</div>
+{{end}}
+`)
+
+var passwordTmpl = mu.Template("admin-password", `
+{{define "title"}}Admin{{end}}
+{{define "description"}}Password reset{{end}}
+{{define "content"}}
+<div style="padding-top: 100px;">
+<h1>Password reset</h1>
+<p>The new password for {{.Username}} is below, it won't be shown again. They've been logged out everywhere.</p>
+<p><code>{{.Password}}</code></p>
+<a href="/admin">Back</a>
+</div>
+{{end}}
+`)
+
+// summary is an account with what the admin sees about it
+type summary struct {
+	Account
+	Sessions int
+	Usage    int64
+	Storage  string
+}
+
+// summaries of every account sorted by username
+func summaries() []summary {
+	var list []summary
+
+	mutex.Lock()
+	active := map[string]int{}
+	for _, sess := range sessions {
+		if !sess.Expired() {
+			active[sess.Username]++
+		}
+	}
+	for _, acc := range users {
+		list = append(list, summary{Account: *acc, Sessions: active[acc.Username]})
+	}
+	mutex.Unlock()
+
+	// apps take their own locks
+	for i := range list {
+		list[i].Usage = Usage(list[i].Username)
+		list[i].Storage = size(list[i].Usage)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Username < list[j].Username })
+	return list
+}
+
+// size in a human readable form
+func size(n int64) string {
+	switch {
+	case n < 1024:
+		return fmt.Sprintf("%d B", n)
+	case n < 1024*1024:
+		return fmt.Sprintf("%.1f KB", float64(n)/1024)
+	default:
+		return fmt.Sprintf("%.1f MB", float64(n)/1024/1024)
+	}
+}
+
+// Usage is roughly how many bytes are stored for the user across apps
+func Usage(username string) int64 {
+	n := mu.Size("users", username)
+	for _, app := range mu.Apps() {
+		if d, ok := app.(Data); ok {
+			n += d.Usage(username)
+		}
+	}
+	return n
+}
+
+// SetDisabled disables or enables an account, disabling logs it out everywhere
+func SetDisabled(username string, disabled bool) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	acc, ok := users[username]
+	if !ok {
+		return errors.New("no such user")
+	}
+
+	acc.Disabled = disabled
+	if err := mu.Put("users", username, acc, true); err != nil {
+		return err
+	}
+
+	if disabled {
+		for id, sess := range sessions {
+			if sess.Username == username {
+				revoke(id)
+			}
+		}
+	}
+
+	return nil
+}
+
+// ResetPassword sets a random password, logging the user out everywhere.
+// The new password is returned to pass on to the user.
+func ResetPassword(username string) (string, error) {
+	b := make([]byte, 10)
+	rand.Read(b)
+	password := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+
+	pw, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	acc, ok := users[username]
+	if !ok {
+		return "", errors.New("no such user")
+	}
+
+	acc.Password = string(pw)
+	if err := mu.Put("users", username, acc, true); err != nil {
+		return "", err
+	}
+
+	for id, sess := range sessions {
+		if sess.Username == username {
+			revoke(id)
+		}
+	}
+
+	return password, nil
+}
+
+// deletedUser replaces a deleted username in an invite's uses so they
+// still count
+const deletedUser = "[deleted]"
+
+// Delete the account and everything the apps store for it
+func Delete(username string) error {
+	mutex.Lock()
+	_, ok := users[username]
+	mutex.Unlock()
+	if !ok {
+		return errors.New("no such user")
+	}
+
+	// erase the data first so a failure can be retried
+	for _, app := range mu.Apps() {
+		d, ok := app.(Data)
+		if !ok {
+			continue
+		}
+		if err := d.Erase(username); err != nil {
+			return fmt.Errorf("%s: %w", app.Name(), err)
+		}
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for id, sess := range sessions {
+		if sess.Username == username {
+			revoke(id)
+		}
+	}
+	accountFailures.reset(username)
+
+	totpMutex.Lock()
+	delete(pending, username)
+	totpMutex.Unlock()
+
+	// scrub the username from the invites and the accounts it invited,
+	// purging the backups which still have it
+	for _, inv := range invites {
+		changed := inv.CreatedBy == username
+		if changed {
+			inv.CreatedBy = ""
+		}
+		for i, u := range inv.UsedBy {
+			if u == username {
+				inv.UsedBy[i] = deletedUser
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+		if err := mu.Put("invites", inv.Code, inv, true); err != nil {
+			return err
+		}
+		if err := mu.Purge("invites", inv.Code); err != nil {
+			return err
+		}
+	}
+	for _, acc := range users {
+		if acc.InvitedBy != username {
+			continue
+		}
+		acc.InvitedBy = ""
+		if err := mu.Put("users", acc.Username, acc, true); err != nil {
+			return err
+		}
+		if err := mu.Purge("users", acc.Username); err != nil {
+			return err
+		}
+	}
+
+	if acc, ok := users[username]; ok {
+		for _, t := range acc.Tokens {
+			delete(tokenOwners, t.Hash)
+		}
+	}
+	delete(users, username)
+	return mu.Delete("users", username)
+}
+
+// Admin is the user admin, it requires the admin role
+func Admin(w http.ResponseWriter, r *http.Request) {
+	acc, _ := FromContext(r.Context())
+
+	if r.Method == "POST" {
+		username := r.PostFormValue("username")
+		action := r.PostFormValue("action")
+
+		// don't let the admin lock themselves out
+		if username == acc.Username && action != "unlock" && action != "reset2fa" &&
+			(action != "role" || Role(r.PostFormValue("role")) != RoleAdmin) {
+			http.Error(w, "can't "+action+" your own account here", 400)
+			return
+		}
+
+		var err error
+		switch action {
+		case "role":
+			err = SetRole(username, Role(r.PostFormValue("role")))
+		case "unlock":
+			err = Unlock(username)
+		case "reset2fa":
+			err = ResetTwoFactor(username)
+		case "disable", "enable":
+			err = SetDisabled(username, action == "disable")
+		case "logout":
+			err = LogoutAll(username)
+		case "password":
+			var password string
+			password, err = ResetPassword(username)
+			if err == nil {
+				mu.Render(w, passwordTmpl, map[string]string{
+					"Username": username,
+					"Password": password,
+				})
+				return
+			}
+		case "delete":
+			err = Delete(username)
+		case "invite":
+			uses, _ := strconv.Atoi(r.PostFormValue("uses"))
+			days, _ := strconv.Atoi(r.PostFormValue("days"))
+			_, err = NewInvite(acc.Username, uses, time.Duration(days)*time.Hour*24)
+		case "revoke":
+			err = RevokeInvite(r.PostFormValue("code"))
+		default:
+			err = errors.New("unknown action")
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		http.Redirect(w, r, "/admin", 302)
+		return
+	}
+
+	list := summaries()
+
+	var locked, twoFactor []summary
+	for _, s := range list {
+		if s.Locked() {
+			locked = append(locked, s)
+		}
+		if len(s.TOTPSecret) > 0 {
+			twoFactor = append(twoFactor, s)
+		}
+	}
+
+	mu.Render(w, adminTmpl, map[string]interface{}{
+		"Users":     list,
+		"Roles":     Roles,
+		"Locked":    locked,
+		"TwoFactor": twoFactor,
+		"Invites":   Invites(),
+		"Mode":      signupMode(),
+	})
+}
+
+// cell keeps a value from being run as a formula when the CSV is opened in
+// a spreadsheet, usernames from before they were checked could be anything
+func cell(v string) string {
+	if len(v) > 0 && strings.ContainsRune("=+-@\t\r", rune(v[0])) {
+		return "'" + v
+	}
+	return v
+}
+
+// ExportHandler downloads the users as CSV
+func ExportHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="users.csv"`)
+
+	date := func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.UTC().Format(time.RFC3339)
+	}
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"username", "role", "created", "last_login", "sessions", "storage_bytes", "disabled", "two_factor", "passkeys", "locked", "invited_by"})
+	for _, s := range summaries() {
+		role := s.Role
+		if len(role) == 0 {
+			role = RoleMember
+		}
+		cw.Write([]string{
+			cell(s.Username),
+			string(role),
+			date(s.Created),
+			date(s.LastLogin),
+			fmt.Sprint(s.Sessions),
+			fmt.Sprint(s.Usage),
+			fmt.Sprint(s.Disabled),
+			fmt.Sprint(len(s.TOTPSecret) > 0),
+			fmt.Sprint(len(s.Credentials)),
+			fmt.Sprint(s.Locked()),
+			cell(s.InvitedBy),
+		})
+	}
+	cw.Flush()
+}
@@ -0,0 +1,244 @@
+package user
+
+import (
+	"encoding/csv"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"mu.dev"
+)
+
+func TestDelete(t *testing.T) {
+	testInit(t)
+	testUser(t, "alice", "correct horse")
+
+	// alice invites bob who invites carol
+	byAlice, err := NewInvite("alice", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SignupInvite("bob", "battery staple", byAlice.Code); err != nil {
+		t.Fatal(err)
+	}
+	byBob, err := NewInvite("bob", 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SignupInvite("carol", "horse battery", byBob.Code); err != nil {
+		t.Fatal(err)
+	}
+	testLogin(t, users["bob"])
+
+	if err := Delete("bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Delete("bob"); err == nil {
+		t.Error("deleted twice")
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if _, ok := users["bob"]; ok {
+		t.Error("account left")
+	}
+	for _, sess := range sessions {
+		if sess.Username == "bob" {
+			t.Error("session left")
+		}
+	}
+
+	// stored without bob, the uses still count
+	var inv Invite
+	if err := mu.Get("invites", byAlice.Code, &inv, true); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(inv.UsedBy, []string{deletedUser}) {
+		t.Errorf("alice's invite used by %v", inv.UsedBy)
+	}
+	if err := mu.Get("invites", byBob.Code, &inv, true); err != nil {
+		t.Fatal(err)
+	}
+	if inv.CreatedBy != "" || !reflect.DeepEqual(inv.UsedBy, []string{"carol"}) {
+		t.Errorf("bob's invite created by %q used by %v", inv.CreatedBy, inv.UsedBy)
+	}
+
+	var carol Account
+	if err := mu.Get("users", "carol", &carol, true); err != nil {
+		t.Fatal(err)
+	}
+	if carol.InvitedBy != "" || users["carol"].InvitedBy != "" {
+		t.Errorf("carol invited by %q", carol.InvitedBy)
+	}
+
+	// and not in the backups
+	for _, k := range [][2]string{
+		{"users", "bob"},
+		{"users", "carol"},
+		{"invites", byAlice.Code},
+		{"invites", byBob.Code},
+	} {
+		if _, err := mu.Storage.GetBackup(k[0], k[1]); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s/%s backup left, got %v", k[0], k[1], err)
+		}
+	}
+}
+
+func TestSetDisabled(t *testing.T) {
+	testInit(t)
+	alice := testUser(t, "alice", "correct horse")
+	bob := testUser(t, "bob", "battery staple")
+	testLogin(t, alice)
+	testLogin(t, alice)
+	kept := testLogin(t, bob)
+
+	if err := SetDisabled("alice", true); err != nil {
+		t.Fatal(err)
+	}
+
+	// logged out everywhere
+	keys, _ := mu.List("sessions")
+	id, _ := mu.Unsign(kept.Value)
+	if len(sessions) != 1 || sessions[id] == nil || !reflect.DeepEqual(keys, []string{id}) {
+		t.Errorf("got %d sessions and stored %v, want bob's", len(sessions), keys)
+	}
+	if _, _, err := Login("alice", "correct horse"); !errors.Is(err, ErrDisabled) {
+		t.Errorf("login got %v, want %v", err, ErrDisabled)
+	}
+	var stored Account
+	if err := mu.Get("users", "alice", &stored, true); err != nil || !stored.Disabled {
+		t.Errorf("not stored disabled %v", err)
+	}
+
+	if err := SetDisabled("alice", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Login("alice", "correct horse"); err != nil {
+		t.Errorf("login after enabling got %v", err)
+	}
+
+	if err := SetDisabled("nobody", true); err == nil {
+		t.Error("disabled an unknown user")
+	}
+}
+
+func TestResetPassword(t *testing.T) {
+	testInit(t)
+	acc := testUser(t, "alice", "correct horse")
+	testLogin(t, acc)
+
+	password, err := ResetPassword("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 0 {
+		t.Errorf("%d sessions left", len(sessions))
+	}
+	if _, _, err := Login("alice", "correct horse"); err == nil {
+		t.Error("logged in with the old password")
+	}
+	if _, _, err := Login("alice", password); err != nil {
+		t.Errorf("new password got %v", err)
+	}
+
+	// stored so it survives a restart
+	var stored Account
+	if err := mu.Get("users", "alice", &stored, true); err != nil || stored.Password != acc.Password {
+		t.Errorf("not stored %v", err)
+	}
+
+	if _, err := ResetPassword("nobody"); err == nil {
+		t.Error("reset an unknown user")
+	}
+}
+
+func TestAdminDenied(t *testing.T) {
+	testInit(t)
+	member := testLogin(t, testUser(t, "alice", "correct horse"))
+	moderator := testUser(t, "bob", "battery staple")
+	SetRole("bob", RoleModerator)
+	admin := testUser(t, "carol", "horse battery")
+	SetRole("carol", RoleAdmin)
+
+	routes := map[string]http.HandlerFunc{}
+	for _, r := range new(App).Routes() {
+		routes[r.Path] = r.Handler
+	}
+
+	tests := []struct {
+		name   string
+		cookie *http.Cookie
+		method string
+		want   int
+	}{
+		{"anonymous", nil, "GET", 302},
+		{"member", member, "GET", 403},
+		{"member post", member, "POST", 403},
+		{"moderator", testLogin(t, moderator), "GET", 403},
+		{"admin", testLogin(t, admin), "GET", 200},
+	}
+
+	for _, path := range []string{"/admin", "/admin/users.csv"} {
+		for _, tt := range tests {
+			form := url.Values{"username": {"bob"}, "action": {"delete"}}
+			r := httptest.NewRequest(tt.method, path, strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tt.cookie != nil {
+				r.AddCookie(tt.cookie)
+			}
+			w := httptest.NewRecorder()
+			routes[path](w, r)
+
+			if w.Code != tt.want {
+				t.Errorf("%s %s got %d, want %d", tt.name, path, w.Code, tt.want)
+			}
+		}
+	}
+
+	if _, ok := users["bob"]; !ok {
+		t.Error("deleted by a member")
+	}
+}
+
+func TestExportHandler(t *testing.T) {
+	testInit(t)
+	testUser(t, "alice", "correct horse")
+
+	// names from before they were checked
+	for _, name := range []string{"comma,name", `quote"name`, "new\nline", "=HYPERLINK(\"x\")", "@sum"} {
+		users[name] = &Account{Username: name, InvitedBy: name}
+	}
+
+	w := httptest.NewRecorder()
+	ExportHandler(w, httptest.NewRequest("GET", "/admin/users.csv", nil))
+
+	if ct := w.Header().Get("Content-Type"); ct != "text/csv" {
+		t.Errorf("content type %s", ct)
+	}
+	rows, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, row := range rows[1:] {
+		if len(row) != len(rows[0]) {
+			t.Fatalf("row %q has %d columns, want %d", row, len(row), len(rows[0]))
+		}
+		got = append(got, row[0])
+		if row[0] != "alice" && row[len(row)-1] != row[0] {
+			t.Errorf("invited by %q, want %q", row[len(row)-1], row[0])
+		}
+	}
+
+	want := []string{"'=HYPERLINK(\"x\")", "'@sum", "alice", "comma,name", "new\nline", `quote"name`}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
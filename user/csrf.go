@@ -0,0 +1,81 @@
+package user
+
+import (
+	"crypto/hmac"
+	"net/http"
+	"strings"
+
+	"mu.dev"
+)
+
+// pageWriter carries the token so mu.Render can add it to forms, and the user's theme
+type pageWriter struct {
+	http.ResponseWriter
+	token string
+	theme string
+}
+
+func (p *pageWriter) CSRFToken() string {
+	return p.token
+}
+
+func (p *pageWriter) Theme() string {
+	return p.theme
+}
+
+// csrfToken is derived from the session, or a random cookie before login
+func csrfToken(w http.ResponseWriter, r *http.Request) string {
+	var key string
+
+	if _, ok := FromContext(r.Context()); ok {
+		key, _ = sessionID(r)
+	} else if c, err := r.Cookie("csrf"); err == nil {
+		key, _ = mu.Unsign(c.Value)
+	}
+
+	if len(key) == 0 {
+		key = mu.ID()
+		http.SetCookie(w, &http.Cookie{
+			Name:     "csrf",
+			Value:    mu.Sign(key),
+			Path:     "/",
+			Secure:   mu.Secure(),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+
+	s := mu.Sign("csrf " + key)
+	return s[strings.LastIndex(s, ".")+1:]
+}
+
+// CSRF checks state changing requests carry the token for the session, either
+// as the csrf form field or the X-CSRF-Token header. Templates rendered with
+// mu.Render add the field with {{csrfField}}. Requests with a bearer token are
+// skipped, they don't use the cookies and browsers can't send the header
+// cross site without CORS.
+func CSRF(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := bearer(r); ok {
+			h(w, r)
+			return
+		}
+
+		token := csrfToken(w, r)
+
+		switch r.Method {
+		case "GET", "HEAD", "OPTIONS":
+		default:
+			sent := r.Header.Get("X-CSRF-Token")
+			if len(sent) == 0 {
+				sent = r.PostFormValue("csrf")
+			}
+			if !hmac.Equal([]byte(sent), []byte(token)) {
+				http.Error(w, "invalid csrf token", 403)
+				return
+			}
+		}
+
+		h(&pageWriter{w, token, PreferencesFromContext(r.Context()).Theme}, r)
+	}
+}
@@ -0,0 +1,105 @@
+package user
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// csrfGet requests a page through the middleware returning the token it
+// was rendered with and any cookies set
+func csrfGet(t *testing.T, cookies ...*http.Cookie) (string, []*http.Cookie) {
+	t.Helper()
+
+	var token string
+	h := Identify(CSRF(func(w http.ResponseWriter, r *http.Request) {
+		if cw, ok := w.(interface{ CSRFToken() string }); ok {
+			token = cw.CSRFToken()
+		}
+	}))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	h(w, r)
+
+	if len(token) == 0 {
+		t.Fatal("no token for the page")
+	}
+	return token, w.Result().Cookies()
+}
+
+func TestCSRF(t *testing.T) {
+	testInit(t)
+
+	acc := testUser(t, "alice", "correct horse")
+	sess := testLogin(t, acc)
+
+	anonToken, anonCookies := csrfGet(t)
+	if len(anonCookies) != 1 || anonCookies[0].Name != "csrf" {
+		t.Fatalf("got cookies %v, want a csrf cookie", anonCookies)
+	}
+	anon := anonCookies[0]
+
+	// the same token while the cookie is kept
+	if again, _ := csrfGet(t, anon); again != anonToken {
+		t.Error("token changed between requests")
+	}
+
+	sessToken, _ := csrfGet(t, sess)
+	_, otherCookies := csrfGet(t)
+
+	tests := []struct {
+		name    string
+		method  string
+		cookies []*http.Cookie
+		form    string
+		header  string
+		bearer  bool
+		want    int
+	}{
+		{name: "get", method: "GET", want: 200},
+		{name: "no token", method: "POST", cookies: []*http.Cookie{anon}, want: 403},
+		{name: "form", method: "POST", cookies: []*http.Cookie{anon}, form: anonToken, want: 200},
+		{name: "header", method: "POST", cookies: []*http.Cookie{anon}, header: anonToken, want: 200},
+		{name: "delete", method: "DELETE", cookies: []*http.Cookie{anon}, header: anonToken, want: 200},
+		{name: "other cookie", method: "POST", cookies: otherCookies, form: anonToken, want: 403},
+		{name: "no cookie", method: "POST", form: anonToken, want: 403},
+		{name: "session", method: "POST", cookies: []*http.Cookie{sess}, form: sessToken, want: 200},
+		{name: "pre login token", method: "POST", cookies: []*http.Cookie{sess, anon}, form: anonToken, want: 403},
+		{name: "session token without session", method: "POST", cookies: []*http.Cookie{anon}, form: sessToken, want: 403},
+		{name: "bearer", method: "POST", bearer: true, want: 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var called bool
+			h := Identify(CSRF(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+			}))
+
+			r := httptest.NewRequest(tt.method, "/chat", strings.NewReader(url.Values{"csrf": {tt.form}}.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			for _, c := range tt.cookies {
+				r.AddCookie(c)
+			}
+			if len(tt.header) > 0 {
+				r.Header.Set("X-CSRF-Token", tt.header)
+			}
+			if tt.bearer {
+				r.Header.Set("Authorization", "Bearer mu_invalid")
+			}
+
+			w := httptest.NewRecorder()
+			h(w, r)
+
+			if w.Code != tt.want || called != (tt.want == 200) {
+				t.Errorf("got %d called %v, want %d", w.Code, called, tt.want)
+			}
+		})
+	}
+}
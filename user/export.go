@@ -0,0 +1,200 @@
+package user
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"mu.dev"
+)
+
+var deleteTmpl = mu.Template("account-delete", `
+{{define "title"}}Delete account{{end}}
+{{define "description"}}Delete your account{{end}}
+{{define "content"}}
+<div style="padding-top: 100px;">
+<h1>Delete account</h1>
+<p>This deletes your account and everything Mu stores about you, including your chat messages and searches. It can't be undone. <a href="/account/export">Export your data</a> first to keep a copy.</p>
+<form action="/account/delete" method="post">{{csrfField}}
+  {{if .Password}}
+  <input name="password" type="password" placeholder="Password" required>
+  {{else}}
+  <input name="confirm" placeholder="Type {{.Username}} to confirm" required>
+  {{end}}
+  <br><br>
+  <button>Delete my account</button>
+</form>
+</div>
+{{end}}
+`)
+
+// accountExport is the account without the secrets
+type accountExport struct {
+	Username    string
+	Role        Role
+	Created     time.Time
+	LastLogin   time.Time
+	InvitedBy   string
+	TwoFactor   bool
+	Preferences Preferences
+	Passkeys    []passkeyExport
+	Identities  []*Identity
+	Tokens      []tokenExport
+	Sessions    []sessionExport
+	Invites     []Invite
+}
+
+type passkeyExport struct {
+	Name    string
+	Created time.Time
+}
+
+type tokenExport struct {
+	Name     string
+	Scopes   []string
+	Created  time.Time
+	LastUsed time.Time
+}
+
+type sessionExport struct {
+	Created   time.Time
+	LastSeen  time.Time
+	ExpiresAt time.Time
+}
+
+// exportAccount is what the user package stores about the user
+func exportAccount(username string) (*accountExport, bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	acc, ok := users[username]
+	if !ok {
+		return nil, false
+	}
+
+	e := &accountExport{
+		Username:    acc.Username,
+		Role:        acc.Role,
+		Created:     acc.Created,
+		LastLogin:   acc.LastLogin,
+		InvitedBy:   acc.InvitedBy,
+		TwoFactor:   len(acc.TOTPSecret) > 0,
+		Preferences: acc.Preferences,
+		Identities:  acc.Identities,
+	}
+	for _, c := range acc.Credentials {
+		e.Passkeys = append(e.Passkeys, passkeyExport{c.Name, c.Created})
+	}
+	for _, t := range acc.Tokens {
+		e.Tokens = append(e.Tokens, tokenExport{t.Name, t.Scopes, t.Created, t.LastUsed})
+	}
+	for _, s := range sessions {
+		if s.Username == username {
+			e.Sessions = append(e.Sessions, sessionExport{s.Created, s.LastSeen, s.ExpiresAt})
+		}
+	}
+	for _, inv := range invites {
+		if inv.CreatedBy == username {
+			e.Invites = append(e.Invites, *inv)
+		}
+	}
+
+	return e, true
+}
+
+// Export writes a zip of everything stored about the user, the account and
+// a file for each app which implements Data
+func Export(w io.Writer, username string) error {
+	acc, ok := exportAccount(username)
+	if !ok {
+		return fmt.Errorf("no such user %s", username)
+	}
+
+	files := map[string]interface{}{"account.json": acc}
+	for _, app := range mu.Apps() {
+		d, ok := app.(Data)
+		if !ok {
+			continue
+		}
+		v, err := d.Export(username)
+		if err != nil {
+			return fmt.Errorf("%s: %w", app.Name(), err)
+		}
+		files[strings.ToLower(app.Name())+".json"] = v
+	}
+
+	zw := zip.NewWriter(w)
+	for name, v := range files {
+		f, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// AccountExportHandler downloads the logged in user's data
+func AccountExportHandler(w http.ResponseWriter, r *http.Request) {
+	acc, _ := FromContext(r.Context())
+
+	// build it first so a failure isn't sent as a truncated zip
+	var buf bytes.Buffer
+	if err := Export(&buf, acc.Username); err != nil {
+		fmt.Println("Error exporting", acc.Username, err)
+		http.Error(w, "export failed", 500)
+		return
+	}
+
+	name := fmt.Sprintf("mu-%s-%s.zip", acc.Username, time.Now().Format("2006-01-02"))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	w.Write(buf.Bytes())
+}
+
+// AccountDeleteHandler deletes the logged in user after they confirm
+func AccountDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	acc, _ := FromContext(r.Context())
+
+	mutex.Lock()
+	hash := acc.Password
+	mutex.Unlock()
+
+	if r.Method != "POST" {
+		mu.Render(w, deleteTmpl, map[string]interface{}{
+			"Username": acc.Username,
+			"Password": len(hash) > 0,
+		})
+		return
+	}
+
+	// accounts created with a provider confirm with the username instead
+	if len(hash) > 0 {
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(r.PostFormValue("password"))) != nil {
+			http.Error(w, "wrong password", 403)
+			return
+		}
+	} else if r.PostFormValue("confirm") != acc.Username {
+		http.Error(w, "type your username to confirm", 400)
+		return
+	}
+
+	if err := Delete(acc.Username); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	clearCookies(w)
+	http.Redirect(w, r, "/", 302)
+}
@@ -0,0 +1,91 @@
+package user
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"mu.dev"
+)
+
+// dataApp is an app storing data for users, its export fails with err
+type dataApp struct {
+	err error
+}
+
+func (d *dataApp) Name() string        { return "Test" }
+func (d *dataApp) Description() string { return "" }
+func (d *dataApp) Icon() string        { return "" }
+func (d *dataApp) Routes() []mu.Route  { return nil }
+func (d *dataApp) Start() error        { return nil }
+func (d *dataApp) Stop() error         { return nil }
+func (d *dataApp) Usage(string) int64  { return 0 }
+func (d *dataApp) Erase(string) error  { return nil }
+func (d *dataApp) Export(username string) (interface{}, error) {
+	return []string{"data for " + username}, d.err
+}
+
+var testData = new(dataApp)
+
+func init() {
+	mu.Register(testData)
+}
+
+func TestAccountExport(t *testing.T) {
+	testInit(t)
+	acc := testUser(t, "alice", "correct horse")
+
+	export := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/account/export", nil)
+		r = r.WithContext(context.WithValue(r.Context(), contextKey{}, acc))
+		w := httptest.NewRecorder()
+		AccountExportHandler(w, r)
+		return w
+	}
+
+	w := export()
+	if w.Code != 200 || w.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("got %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	if strings.Contains(w.Body.String(), acc.Password) {
+		t.Error("password hash exported")
+	}
+
+	z, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	for _, f := range z.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var b bytes.Buffer
+		b.ReadFrom(rc)
+		rc.Close()
+		files[f.Name] = b.String()
+	}
+
+	var e accountExport
+	if err := json.Unmarshal([]byte(files["account.json"]), &e); err != nil || e.Username != "alice" {
+		t.Errorf("account.json got %+v %v", e, err)
+	}
+	if !strings.Contains(files["test.json"], "data for alice") {
+		t.Errorf("test.json got %q", files["test.json"])
+	}
+
+	// an app failing is an error, not a truncated zip
+	testData.err = errors.New("failed")
+	defer func() { testData.err = nil }()
+
+	w = export()
+	if w.Code != 500 || w.Header().Get("Content-Disposition") != "" {
+		t.Errorf("failed export got %d %v", w.Code, w.Header())
+	}
+}
@@ -0,0 +1,147 @@
+package user
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"mu.dev"
+)
+
+// signup modes set with signup in the user section of mu.yaml
+const (
+	// ModeOpen lets anyone signup, an invite code is optional
+	ModeOpen = "open"
+	// ModeInvite requires an invite code
+	ModeInvite = "invite"
+	// ModeClosed only lets admins add users from the command line
+	ModeClosed = "closed"
+)
+
+var (
+	ErrSignupClosed  = errors.New("signup is closed")
+	ErrInviteInvalid = errors.New("invalid or expired invite code")
+)
+
+// invites by code, stored in the invites bucket
+var invites = map[string]*Invite{}
+
+// Invite lets someone signup when signup is invite only
+type Invite struct {
+	Code      string
+	CreatedBy string
+	Created   time.Time
+	// Expires is zero if it never expires
+	Expires time.Time
+	// MaxUses is 0 for no limit
+	MaxUses int
+	// UsedBy the usernames which signed up with it
+	UsedBy []string
+}
+
+// Valid reports whether the invite can still be used
+func (i *Invite) Valid() bool {
+	if !i.Expires.IsZero() && time.Now().After(i.Expires) {
+		return false
+	}
+	return i.MaxUses == 0 || len(i.UsedBy) < i.MaxUses
+}
+
+// signupMode is the configured mode, open by default
+func signupMode() string {
+	switch config.Signup {
+	case "":
+		return ModeOpen
+	case ModeOpen, ModeInvite, ModeClosed:
+		return config.Signup
+	}
+	// a typo shouldn't open signup, config check reports it
+	return ModeClosed
+}
+
+// loadInvites reads the invites, the caller holds the mutex
+func loadInvites() {
+	keys, _ := mu.List("invites")
+	for _, k := range keys {
+		inv := new(Invite)
+		if err := mu.Get("invites", k, inv, true); err != nil {
+			fmt.Println("Error loading invite", k, err)
+			continue
+		}
+		invites[k] = inv
+	}
+}
+
+// NewInvite creates an invite code for maxUses signups, 0 for no limit,
+// which expires after ttl, 0 for never
+func NewInvite(createdBy string, maxUses int, ttl time.Duration) (*Invite, error) {
+	if maxUses < 0 || ttl < 0 {
+		return nil, errors.New("invalid invite")
+	}
+
+	b := make([]byte, 10)
+	rand.Read(b)
+
+	inv := &Invite{
+		Code:      strings.ToLower(base32.StdEncoding.EncodeToString(b)),
+		CreatedBy: createdBy,
+		Created:   time.Now(),
+		MaxUses:   maxUses,
+	}
+	if ttl > 0 {
+		inv.Expires = inv.Created.Add(ttl)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if err := mu.Put("invites", inv.Code, inv, true); err != nil {
+		return nil, err
+	}
+	invites[inv.Code] = inv
+
+	return inv, nil
+}
+
+// RevokeInvite deletes an invite code
+func RevokeInvite(code string) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	delete(invites, code)
+	return mu.Delete("invites", code)
+}
+
+// Invites lists the invite codes, newest first
+func Invites() []Invite {
+	mutex.Lock()
+	var list []Invite
+	for _, inv := range invites {
+		list = append(list, *inv)
+	}
+	mutex.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.After(list[j].Created) })
+	return list
+}
+
+// useInvite records the signup against a valid invite and returns who
+// created it, the caller holds the mutex
+func useInvite(code, username string) (string, error) {
+	inv, ok := invites[strings.ToLower(strings.TrimSpace(code))]
+	if !ok || !inv.Valid() {
+		return "", ErrInviteInvalid
+	}
+
+	inv.UsedBy = append(inv.UsedBy, username)
+	if err := mu.Put("invites", inv.Code, inv, true); err != nil {
+		inv.UsedBy = inv.UsedBy[:len(inv.UsedBy)-1]
+		return "", err
+	}
+
+	return inv.CreatedBy, nil
+}
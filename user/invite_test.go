@@ -0,0 +1,149 @@
+package user
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"mu.dev"
+)
+
+func TestInviteValid(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name string
+		inv  Invite
+		want bool
+	}{
+		{"unlimited", Invite{}, true},
+		{"not expired", Invite{Expires: now.Add(time.Hour)}, true},
+		{"expired", Invite{Expires: now.Add(-time.Second)}, false},
+		{"uses left", Invite{MaxUses: 2, UsedBy: []string{"bob"}}, true},
+		{"used up", Invite{MaxUses: 1, UsedBy: []string{"bob"}}, false},
+		{"used up and expired", Invite{MaxUses: 1, UsedBy: []string{"bob"}, Expires: now.Add(-time.Second)}, false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.inv.Valid(); got != tt.want {
+			t.Errorf("%s got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestInvites(t *testing.T) {
+	testInit(t)
+	testUser(t, "alice", "correct horse")
+
+	for _, bad := range [][2]int{{-1, 0}, {0, -1}} {
+		if _, err := NewInvite("alice", bad[0], time.Duration(bad[1])); err == nil {
+			t.Errorf("created with %v", bad)
+		}
+	}
+
+	once, err := NewInvite("alice", 1, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// codes are typed in so case and spaces don't matter
+	if err := SignupInvite("bob", "battery staple", " "+strings.ToUpper(once.Code)+" "); err != nil {
+		t.Fatal(err)
+	}
+	if users["bob"].InvitedBy != "alice" {
+		t.Errorf("bob invited by %q", users["bob"].InvitedBy)
+	}
+	if err := SignupInvite("carol", "horse battery", once.Code); !errors.Is(err, ErrInviteInvalid) {
+		t.Errorf("used up got %v", err)
+	}
+	if _, ok := users["carol"]; ok {
+		t.Error("signed up with a used up invite")
+	}
+
+	expired, _ := NewInvite("alice", 0, time.Hour)
+	mutex.Lock()
+	expired.Expires = time.Now().Add(-time.Second)
+	mutex.Unlock()
+	if err := SignupInvite("carol", "horse battery", expired.Code); !errors.Is(err, ErrInviteInvalid) {
+		t.Errorf("expired got %v", err)
+	}
+
+	revoked, _ := NewInvite("alice", 0, 0)
+	if err := RevokeInvite(revoked.Code); err != nil {
+		t.Fatal(err)
+	}
+	if err := SignupInvite("carol", "horse battery", revoked.Code); !errors.Is(err, ErrInviteInvalid) {
+		t.Errorf("revoked got %v", err)
+	}
+	if err := SignupInvite("carol", "horse battery", "unknown"); !errors.Is(err, ErrInviteInvalid) {
+		t.Errorf("unknown got %v", err)
+	}
+
+	// the uses are kept after a restart, the revoked one is gone
+	mutex.Lock()
+	invites = map[string]*Invite{}
+	loadInvites()
+	mutex.Unlock()
+
+	var codes []string
+	for _, inv := range Invites() {
+		codes = append(codes, inv.Code)
+	}
+	if want := []string{expired.Code, once.Code}; !reflect.DeepEqual(codes, want) {
+		t.Errorf("got %v, want %v", codes, want)
+	}
+	if !reflect.DeepEqual(invites[once.Code].UsedBy, []string{"bob"}) {
+		t.Errorf("used by %v", invites[once.Code].UsedBy)
+	}
+	var stored Invite
+	if err := mu.Get("invites", revoked.Code, &stored, true); err == nil {
+		t.Error("revoked invite still stored")
+	}
+}
+
+func TestSignupMode(t *testing.T) {
+	tests := []struct {
+		mode string
+		// errors without a code and with one
+		none, code error
+	}{
+		{"", nil, nil},
+		{ModeOpen, nil, nil},
+		{ModeInvite, ErrInviteInvalid, nil},
+		{ModeClosed, ErrSignupClosed, ErrSignupClosed},
+		// a typo doesn't open signup
+		{"opne", ErrSignupClosed, ErrSignupClosed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			testInit(t)
+			testUser(t, "alice", "correct horse")
+			inv, err := NewInvite("alice", 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			config.Signup = tt.mode
+
+			if err := SignupInvite("bob", "battery staple", ""); !errors.Is(err, tt.none) {
+				t.Errorf("without a code got %v, want %v", err, tt.none)
+			}
+			if err := SignupInvite("carol", "horse battery", inv.Code); !errors.Is(err, tt.code) {
+				t.Errorf("with a code got %v, want %v", err, tt.code)
+			}
+			// a bad code is refused even when it's optional
+			if tt.none == nil {
+				if err := SignupInvite("dave", "staple horse", "unknown"); !errors.Is(err, ErrInviteInvalid) {
+					t.Errorf("bad code got %v", err)
+				}
+			}
+
+			// the command line adds users whatever the mode
+			if err := Signup("erin", "battery horse"); err != nil {
+				t.Errorf("signup got %v", err)
+			}
+		})
+	}
+}
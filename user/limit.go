@@ -0,0 +1,139 @@
+package user
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"mu.dev"
+)
+
+// limits on login attempts
+var (
+	// attempts from an address in ipWindow
+	ipLimit  = 20
+	ipWindow = time.Minute * 10
+	// failures for a username in accountWindow, known or not
+	accountLimit  = 5
+	accountWindow = time.Minute * 15
+	// an account is locked after accountLimit failures in a row,
+	// doubling from lockoutBase every time up to lockoutMax
+	lockoutBase = time.Minute * 15
+	lockoutMax  = time.Hour * 24
+)
+
+// the same errors whether or not the account exists
+var (
+	ErrInvalidLogin    = errors.New("invalid username or password")
+	ErrTooManyAttempts = errors.New("too many attempts, try again later")
+)
+
+var ipAttempts = &window{size: ipWindow, events: map[string][]time.Time{}}
+var accountFailures = &window{size: accountWindow, events: map[string][]time.Time{}}
+
+// compared against for unknown users so they take as long as known ones
+var dummyHash []byte
+var dummyOnce sync.Once
+
+func dummy() []byte {
+	dummyOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte(mu.ID()), bcrypt.DefaultCost)
+	})
+	return dummyHash
+}
+
+// window counts events by key over a sliding window
+type window struct {
+	sync.Mutex
+	size   time.Duration
+	events map[string][]time.Time
+}
+
+// prune drops events outside the window, the caller holds the lock
+func (w *window) prune(key string) []time.Time {
+	since := time.Now().Add(-w.size)
+	events := w.events[key]
+	for len(events) > 0 && events[0].Before(since) {
+		events = events[1:]
+	}
+	if len(events) == 0 {
+		delete(w.events, key)
+		return nil
+	}
+	w.events[key] = events
+	return events
+}
+
+func (w *window) count(key string) int {
+	w.Lock()
+	defer w.Unlock()
+	return len(w.prune(key))
+}
+
+func (w *window) add(key string) {
+	w.Lock()
+	defer w.Unlock()
+	w.events[key] = append(w.prune(key), time.Now())
+}
+
+func (w *window) reset(key string) {
+	w.Lock()
+	defer w.Unlock()
+	delete(w.events, key)
+}
+
+// clean drops keys with no recent events
+func (w *window) clean() {
+	w.Lock()
+	defer w.Unlock()
+	for key := range w.events {
+		w.prune(key)
+	}
+}
+
+// allowIP records an attempt from the address and reports if it's under the limit
+func allowIP(r *http.Request) bool {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if ipAttempts.count(ip) >= ipLimit {
+		return false
+	}
+	ipAttempts.add(ip)
+	return true
+}
+
+// Locked reports whether the account is locked out
+func (a *Account) Locked() bool {
+	return time.Now().Before(a.LockedUntil)
+}
+
+// failed records a failed login, locking the account every accountLimit failures.
+// The caller holds the mutex.
+func failed(username string, acc *Account) {
+	accountFailures.add(username)
+
+	if acc == nil {
+		return
+	}
+
+	acc.FailedLogins++
+
+	if acc.FailedLogins%accountLimit == 0 {
+		lock := lockoutBase
+		for i := acc.FailedLogins / accountLimit; i > 1 && lock < lockoutMax; i-- {
+			lock *= 2
+		}
+		if lock > lockoutMax {
+			lock = lockoutMax
+		}
+		acc.LockedUntil = time.Now().Add(lock)
+	}
+
+	saveAccount(acc)
+}
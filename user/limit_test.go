@@ -0,0 +1,179 @@
+package user
+
+import (
+	"errors"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"mu.dev"
+)
+
+func TestWindow(t *testing.T) {
+	size := time.Minute
+
+	tests := []struct {
+		name string
+		// ages of the events, oldest first
+		ages []time.Duration
+		want int
+	}{
+		{"empty", nil, 0},
+		{"recent", []time.Duration{time.Second * 30, time.Second}, 2},
+		{"expired", []time.Duration{time.Minute * 5, time.Minute * 2}, 0},
+		{"sliding", []time.Duration{time.Minute * 2, time.Second * 59, time.Second}, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &window{size: size, events: map[string][]time.Time{}}
+			for _, age := range tt.ages {
+				w.events["key"] = append(w.events["key"], time.Now().Add(-age))
+			}
+
+			if got := w.count("key"); got != tt.want {
+				t.Errorf("count got %d, want %d", got, tt.want)
+			}
+
+			w.add("key")
+			if got := w.count("key"); got != tt.want+1 {
+				t.Errorf("count after add got %d, want %d", got, tt.want+1)
+			}
+
+			w.reset("key")
+			w.clean()
+			if len(w.events) != 0 {
+				t.Errorf("events left after reset %v", w.events)
+			}
+		})
+	}
+}
+
+func TestLockout(t *testing.T) {
+	testInit(t)
+	acc := testUser(t, "alice", "correct horse")
+
+	// the lock from the last failure in tests, each accountLimit doubles it
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{accountLimit - 1, 0},
+		{accountLimit, lockoutBase},
+		{accountLimit * 2, lockoutBase * 2},
+		{accountLimit * 3, lockoutBase * 4},
+		{accountLimit * 10, lockoutMax},
+		{accountLimit * 100, lockoutMax},
+	}
+
+	for _, tt := range tests {
+		acc.FailedLogins = tt.failures - 1
+		acc.LockedUntil = time.Time{}
+		failed(acc.Username, acc)
+
+		got := time.Until(acc.LockedUntil).Round(time.Minute)
+		if tt.want == 0 && acc.Locked() || tt.want > 0 && got != tt.want {
+			t.Errorf("%d failures locked for %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestLoginLimit(t *testing.T) {
+	testInit(t)
+	testUser(t, "alice", "correct horse")
+
+	for i := 0; i < accountLimit; i++ {
+		if _, _, err := Login("alice", "wrong"); !errors.Is(err, ErrInvalidLogin) {
+			t.Fatalf("attempt %d got %v", i, err)
+		}
+	}
+
+	// locked even with the right password
+	if _, _, err := Login("alice", "correct horse"); !errors.Is(err, ErrTooManyAttempts) {
+		t.Errorf("got %v, want %v", err, ErrTooManyAttempts)
+	}
+
+	// unknown users are limited the same
+	for i := 0; i < accountLimit; i++ {
+		Login("nobody", "wrong")
+	}
+	if _, _, err := Login("nobody", "wrong"); !errors.Is(err, ErrTooManyAttempts) {
+		t.Errorf("unknown user got %v, want %v", err, ErrTooManyAttempts)
+	}
+
+	if err := Unlock("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, sess, err := Login("alice", "correct horse"); err != nil || sess == nil {
+		t.Errorf("after unlock got %v", err)
+	}
+}
+
+func TestAllowIP(t *testing.T) {
+	testInit(t)
+
+	r := httptest.NewRequest("POST", "/login", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+
+	for i := 0; i < ipLimit; i++ {
+		if !allowIP(r) {
+			t.Fatalf("attempt %d blocked", i)
+		}
+	}
+	// the port doesn't matter
+	r.RemoteAddr = "192.0.2.1:5678"
+	if allowIP(r) {
+		t.Error("allowed over the limit")
+	}
+
+	r.RemoteAddr = "192.0.2.2:1234"
+	if !allowIP(r) {
+		t.Error("another address blocked")
+	}
+}
+
+func TestLoginWithoutMutex(t *testing.T) {
+	testInit(t)
+	acc := testUser(t, "alice", "correct horse")
+
+	// slow enough to be comparing while the test takes the mutex
+	hash, err := bcrypt.GenerateFromPassword([]byte("correct horse"), 11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acc.Password = string(hash)
+
+	start := time.Now()
+	res := make(chan error)
+	go func() {
+		_, _, err := Login("alice", "correct horse")
+		res <- err
+	}()
+
+	time.Sleep(time.Millisecond * 20)
+	mutex.Lock()
+	waited := time.Since(start)
+	// deleted while it's comparing
+	delete(users, "alice")
+	mu.Delete("users", "alice")
+	mutex.Unlock()
+
+	if err := <-res; !errors.Is(err, ErrInvalidLogin) {
+		t.Errorf("got %v, want %v", err, ErrInvalidLogin)
+	}
+	if total := time.Since(start); waited > total/2 {
+		t.Errorf("waited %v for the mutex of %v", waited, total)
+	}
+
+	// not written back
+	var stored Account
+	if err := mu.Get("users", "alice", &stored, true); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("account saved after delete, got %v", err)
+	}
+	if len(sessions) != 0 {
+		t.Errorf("got %d sessions", len(sessions))
+	}
+}
@@ -0,0 +1,735 @@
+package user
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"mu.dev"
+)
+
+// ProviderConfig is an OpenID Connect provider in the user section of mu.yaml
+type ProviderConfig struct {
+	// Name is used in the login urls e.g google
+	Name string `yaml:"name"`
+	// Label is shown on the login button, defaults to the name
+	Label string `yaml:"label"`
+	// Issuer e.g https://accounts.google.com, the endpoints are discovered from it
+	Issuer       string `yaml:"issuer"`
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	// RedirectURL defaults to /login/oidc/<name>/callback on the request host
+	RedirectURL string `yaml:"redirect_url"`
+	// Scopes default to openid, profile and email
+	Scopes []string `yaml:"scopes"`
+}
+
+// Identity is a user at an external provider
+type Identity struct {
+	Provider string
+	// Subject is the provider's id for the user, it never changes
+	Subject  string
+	Email    string
+	Username string
+	Name     string
+	Linked   time.Time
+}
+
+// Provider is an external identity provider using the authorization code flow with PKCE
+type Provider interface {
+	// Name used in the login urls
+	Name() string
+	// Label shown on the login button
+	Label() string
+	// AuthCodeURL to send the user to
+	AuthCodeURL(ctx context.Context, state, verifier, nonce, redirectURL string) (string, error)
+	// Exchange the code for the user's identity, checking it was issued with the nonce
+	Exchange(ctx context.Context, code, verifier, nonce, redirectURL string) (*Identity, error)
+}
+
+// a login with a provider waiting on the callback
+type flow struct {
+	Provider string
+	Verifier string
+	Nonce    string
+	Redirect string
+	// Link is the user linking the identity to their account, empty to login
+	Link    string
+	Expires time.Time
+}
+
+// providers by name and flows by state
+var providers = map[string]Provider{}
+var flows = map[string]*flow{}
+
+var oidcMutex sync.Mutex
+
+var providerName = regexp.MustCompile(`^[a-z0-9-]+$`)
+
+// RegisterProvider adds a provider to login with
+func RegisterProvider(p Provider) {
+	oidcMutex.Lock()
+	defer oidcMutex.Unlock()
+	providers[p.Name()] = p
+}
+
+// Providers sorted by name
+func Providers() []Provider {
+	oidcMutex.Lock()
+	defer oidcMutex.Unlock()
+
+	var list []Provider
+	for _, p := range providers {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+	return list
+}
+
+func provider(name string) (Provider, bool) {
+	oidcMutex.Lock()
+	defer oidcMutex.Unlock()
+	p, ok := providers[name]
+	return p, ok
+}
+
+// OIDC is an OpenID Connect provider
+type OIDC struct {
+	Config ProviderConfig
+	// Client makes the requests to the provider, http.DefaultClient if nil
+	Client *http.Client
+
+	mutex     sync.Mutex
+	discovery *discovery
+	keys      map[string]crypto.PublicKey
+}
+
+// the parts of the provider metadata used
+type discovery struct {
+	Issuer        string `json:"issuer"`
+	AuthEndpoint  string `json:"authorization_endpoint"`
+	TokenEndpoint string `json:"token_endpoint"`
+	JWKSURI       string `json:"jwks_uri"`
+}
+
+// claims in the id token
+type claims struct {
+	Issuer   string          `json:"iss"`
+	Subject  string          `json:"sub"`
+	Audience json.RawMessage `json:"aud"`
+	Expiry   int64           `json:"exp"`
+	Nonce    string          `json:"nonce"`
+	Email    string          `json:"email"`
+	Verified bool            `json:"email_verified"`
+	Username string          `json:"preferred_username"`
+	Name     string          `json:"name"`
+}
+
+// a key in the provider's key set
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// NewOIDC returns a provider for the config, the endpoints are discovered on first use
+func NewOIDC(c ProviderConfig) *OIDC {
+	return &OIDC{Config: c}
+}
+
+func (o *OIDC) Name() string { return o.Config.Name }
+
+func (o *OIDC) Label() string {
+	if len(o.Config.Label) > 0 {
+		return o.Config.Label
+	}
+	return o.Config.Name
+}
+
+func (o *OIDC) client() *http.Client {
+	if o.Client != nil {
+		return o.Client
+	}
+	return http.DefaultClient
+}
+
+func (o *OIDC) getJSON(ctx context.Context, u string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return err
+	}
+	rsp, err := o.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != 200 {
+		return fmt.Errorf("%s: %s", u, rsp.Status)
+	}
+	return json.NewDecoder(rsp.Body).Decode(v)
+}
+
+// discover fetches the provider metadata once it succeeds
+func (o *OIDC) discover(ctx context.Context) (*discovery, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if o.discovery != nil {
+		return o.discovery, nil
+	}
+
+	d := new(discovery)
+	if err := o.getJSON(ctx, strings.TrimSuffix(o.Config.Issuer, "/")+"/.well-known/openid-configuration", d); err != nil {
+		return nil, err
+	}
+	if d.Issuer != o.Config.Issuer {
+		return nil, fmt.Errorf("issuer is %s not %s", d.Issuer, o.Config.Issuer)
+	}
+
+	o.discovery = d
+	return d, nil
+}
+
+func (o *OIDC) oauth2(d *discovery, redirectURL string) *oauth2.Config {
+	if len(o.Config.RedirectURL) > 0 {
+		redirectURL = o.Config.RedirectURL
+	}
+	scopes := o.Config.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "profile", "email"}
+	}
+	return &oauth2.Config{
+		ClientID:     o.Config.ClientID,
+		ClientSecret: o.Config.ClientSecret,
+		Endpoint:     oauth2.Endpoint{AuthURL: d.AuthEndpoint, TokenURL: d.TokenEndpoint},
+		RedirectURL:  redirectURL,
+		Scopes:       scopes,
+	}
+}
+
+func (o *OIDC) AuthCodeURL(ctx context.Context, state, verifier, nonce, redirectURL string) (string, error) {
+	d, err := o.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	return o.oauth2(d, redirectURL).AuthCodeURL(state,
+		oauth2.S256ChallengeOption(verifier),
+		oauth2.SetAuthURLParam("nonce", nonce),
+	), nil
+}
+
+func (o *OIDC) Exchange(ctx context.Context, code, verifier, nonce, redirectURL string) (*Identity, error) {
+	d, err := o.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, o.client())
+	tok, err := o.oauth2(d, redirectURL).Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return nil, err
+	}
+
+	raw, ok := tok.Extra("id_token").(string)
+	if !ok {
+		return nil, errors.New("no id token")
+	}
+
+	c, err := o.verify(ctx, d, raw)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal([]byte(c.Nonce), []byte(nonce)) {
+		return nil, errors.New("invalid nonce")
+	}
+
+	id := &Identity{
+		Provider: o.Name(),
+		Subject:  c.Subject,
+		Username: c.Username,
+		Name:     c.Name,
+	}
+	// unverified addresses could be anyone's
+	if c.Verified {
+		id.Email = c.Email
+	}
+	return id, nil
+}
+
+// verify checks the id token signature and claims
+func (o *OIDC) verify(ctx context.Context, d *discovery, raw string) (*claims, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("invalid id token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	b, err := b64.DecodeString(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &header); err != nil {
+		return nil, err
+	}
+	sig, err := b64.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := o.key(ctx, d, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(k, crypto.SHA256, sum[:], sig) != nil {
+			return nil, errors.New("invalid id token signature")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 ||
+			!ecdsa.Verify(k, sum[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return nil, errors.New("invalid id token signature")
+		}
+	default:
+		return nil, errors.New("unsupported id token key")
+	}
+
+	c := new(claims)
+	b, err = b64.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, err
+	}
+
+	if c.Issuer != d.Issuer {
+		return nil, errors.New("invalid id token issuer")
+	}
+	// the audience is a string or a list
+	var aud []string
+	if json.Unmarshal(c.Audience, &aud) != nil {
+		aud = make([]string, 1)
+		json.Unmarshal(c.Audience, &aud[0])
+	}
+	var found bool
+	for _, a := range aud {
+		found = found || a == o.Config.ClientID
+	}
+	if !found {
+		return nil, errors.New("invalid id token audience")
+	}
+	// allow a minute of clock drift
+	if time.Now().Add(-time.Minute).Unix() > c.Expiry {
+		return nil, errors.New("expired id token")
+	}
+	if len(c.Subject) == 0 {
+		return nil, errors.New("no subject in id token")
+	}
+
+	return c, nil
+}
+
+// key returns the signing key, fetching the key set again for a key it hasn't seen
+func (o *OIDC) key(ctx context.Context, d *discovery, kid string) (crypto.PublicKey, error) {
+	o.mutex.Lock()
+	k, ok := o.keys[kid]
+	o.mutex.Unlock()
+	if ok {
+		return k, nil
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := o.getJSON(ctx, d.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, j := range set.Keys {
+		if k, err := j.publicKey(); err == nil {
+			keys[j.Kid] = k
+		}
+	}
+
+	o.mutex.Lock()
+	o.keys = keys
+	o.mutex.Unlock()
+
+	if k, ok := keys[kid]; ok {
+		return k, nil
+	}
+	return nil, errors.New("unknown id token key")
+}
+
+func (j jwk) publicKey() (crypto.PublicKey, error) {
+	switch j.Kty {
+	case "RSA":
+		n, err := b64.DecodeString(j.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64.DecodeString(j.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if j.Crv != "P-256" {
+			return nil, errors.New("unsupported curve")
+		}
+		x, err := b64.DecodeString(j.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := b64.DecodeString(j.Y)
+		if err != nil {
+			return nil, err
+		}
+		k := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !k.Curve.IsOnCurve(k.X, k.Y) {
+			return nil, errors.New("invalid key")
+		}
+		return k, nil
+	}
+	return nil, errors.New("unsupported key type")
+}
+
+// checkProviders validates the configured providers
+func checkProviders(list []ProviderConfig) error {
+	names := map[string]bool{}
+	for _, p := range list {
+		if !providerName.MatchString(p.Name) {
+			return fmt.Errorf("invalid provider name %q", p.Name)
+		}
+		if names[p.Name] {
+			return fmt.Errorf("duplicate provider %s", p.Name)
+		}
+		names[p.Name] = true
+
+		u, err := url.Parse(p.Issuer)
+		if err != nil || len(u.Host) == 0 {
+			return fmt.Errorf("provider %s: invalid issuer %s", p.Name, p.Issuer)
+		}
+		if len(p.ClientID) == 0 {
+			return fmt.Errorf("provider %s: client_id required", p.Name)
+		}
+	}
+	return nil
+}
+
+// findIdentity returns the account linked to the identity, the caller holds the mutex
+func findIdentity(id *Identity) *Account {
+	for _, acc := range users {
+		for _, i := range acc.Identities {
+			if i.Provider == id.Provider && i.Subject == id.Subject {
+				return acc
+			}
+		}
+	}
+	return nil
+}
+
+// newUsername picks a free username from the identity, the caller holds the mutex
+func newUsername(id *Identity) string {
+	base := id.Username
+	if len(base) == 0 {
+		base, _, _ = strings.Cut(id.Email, "@")
+	}
+	base = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + 'a' - 'A'
+		}
+		return '-'
+	}, base)
+	base = strings.TrimLeft(base, "-_")
+	if len(base) > 24 {
+		base = base[:24]
+	}
+
+	if validUsername(base) != nil {
+		base = "user"
+	}
+
+	name := base
+	for i := 2; users[name] != nil; i++ {
+		name = fmt.Sprintf("%s%d", base, i)
+	}
+	return name
+}
+
+// LoginIdentity logs in the account linked to the identity, creating one if
+// signup is open. It returns ErrTwoFactor when the account has two factor on.
+func LoginIdentity(id *Identity) (*Account, *Session, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	acc := findIdentity(id)
+	if acc == nil {
+		// accounts aren't linked by email, the provider might not own the address
+		if signupMode() != ModeOpen {
+			return nil, nil, errors.New("no account is linked to this login, login another way and link it from your account page")
+		}
+
+		id.Linked = time.Now()
+		acc = &Account{
+			ID:         mu.ID(),
+			Username:   newUsername(id),
+			Created:    time.Now(),
+			Identities: []*Identity{id},
+		}
+		if err := mu.Put("users", acc.Username, acc, true); err != nil {
+			return nil, nil, err
+		}
+		users[acc.Username] = acc
+	}
+
+	if acc.Locked() {
+		return nil, nil, ErrTooManyAttempts
+	}
+	if acc.Disabled {
+		return nil, nil, ErrDisabled
+	}
+	if len(acc.TOTPSecret) > 0 {
+		return acc, nil, ErrTwoFactor
+	}
+
+	return acc, login(acc), nil
+}
+
+// LinkIdentity adds the identity to the account so it can be used to login
+func LinkIdentity(username string, id *Identity) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	acc, ok := users[username]
+	if !ok {
+		return errors.New("no such user")
+	}
+	if other := findIdentity(id); other != nil {
+		if other == acc {
+			return nil
+		}
+		return errors.New("already linked to another account")
+	}
+
+	id.Linked = time.Now()
+	acc.Identities = append(acc.Identities, id)
+	return mu.Put("users", username, acc, true)
+}
+
+// UnlinkIdentity removes the provider's identity from the account as long as
+// there's another way to login
+func UnlinkIdentity(username, provider string) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	acc, ok := users[username]
+	if !ok {
+		return errors.New("no such user")
+	}
+
+	var ids []*Identity
+	for _, i := range acc.Identities {
+		if i.Provider != provider {
+			ids = append(ids, i)
+		}
+	}
+	if len(acc.Password) == 0 && len(acc.Credentials) == 0 && len(ids) == 0 {
+		return errors.New("set a password or add a passkey first")
+	}
+
+	acc.Identities = ids
+	return mu.Put("users", username, acc, true)
+}
+
+// redirectURL is the callback on this host
+func redirectURL(r *http.Request, name string) string {
+	_, origin := relyingParty(r)
+	return origin + "/login/oidc/" + name + "/callback"
+}
+
+// OIDCHandler starts a login at /login/oidc/<name> and finishes it at
+// /login/oidc/<name>/callback. Add ?link=true to link the provider to the
+// logged in account instead.
+func OIDCHandler(w http.ResponseWriter, r *http.Request) {
+	name, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/login/oidc/"), "/")
+
+	p, ok := provider(name)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch action {
+	case "":
+		oidcBegin(w, r, p)
+	case "callback":
+		oidcCallback(w, r, p)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func oidcBegin(w http.ResponseWriter, r *http.Request, p Provider) {
+	f := &flow{
+		Provider: p.Name(),
+		Verifier: oauth2.GenerateVerifier(),
+		Nonce:    mu.ID(),
+		Redirect: redirectURL(r, p.Name()),
+		Expires:  time.Now().Add(ceremonyTimeout),
+	}
+
+	if len(r.URL.Query().Get("link")) > 0 {
+		acc, ok := FromContext(r.Context())
+		if !ok {
+			http.Redirect(w, r, "/login", 302)
+			return
+		}
+		f.Link = acc.Username
+	}
+
+	state := oauth2.GenerateVerifier()
+	u, err := p.AuthCodeURL(r.Context(), state, f.Verifier, f.Nonce, f.Redirect)
+	if err != nil {
+		fmt.Println("Error starting login with", p.Name(), err)
+		http.Error(w, "login with "+p.Label()+" unavailable", 502)
+		return
+	}
+
+	oidcMutex.Lock()
+	for k, v := range flows {
+		if time.Now().After(v.Expires) {
+			delete(flows, k)
+		}
+	}
+	flows[state] = f
+	oidcMutex.Unlock()
+
+	// lax so it comes back with the redirect from the provider
+	http.SetCookie(w, &http.Cookie{
+		Name:     "oidc",
+		Value:    mu.Sign(state),
+		Path:     "/login/oidc",
+		MaxAge:   int(ceremonyTimeout.Seconds()),
+		Secure:   mu.Secure(),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.Redirect(w, r, u, 302)
+}
+
+func oidcCallback(w http.ResponseWriter, r *http.Request, p Provider) {
+	// the state must be the one this browser started with
+	var state string
+	if c, err := r.Cookie("oidc"); err == nil {
+		state, _ = mu.Unsign(c.Value)
+	}
+	http.SetCookie(w, &http.Cookie{Name: "oidc", Path: "/login/oidc", MaxAge: -1})
+
+	q := r.URL.Query()
+	if len(state) == 0 || !hmac.Equal([]byte(state), []byte(q.Get("state"))) {
+		http.Error(w, "login expired", 400)
+		return
+	}
+
+	oidcMutex.Lock()
+	f, ok := flows[state]
+	delete(flows, state)
+	oidcMutex.Unlock()
+
+	if !ok || time.Now().After(f.Expires) || f.Provider != p.Name() {
+		http.Error(w, "login expired", 400)
+		return
+	}
+
+	if e := q.Get("error"); len(e) > 0 {
+		http.Error(w, "login failed: "+e, 401)
+		return
+	}
+
+	id, err := p.Exchange(r.Context(), q.Get("code"), f.Verifier, f.Nonce, f.Redirect)
+	if err != nil {
+		fmt.Println("Error logging in with", p.Name(), err)
+		http.Error(w, "login failed", 401)
+		return
+	}
+
+	if len(f.Link) > 0 {
+		acc, ok := FromContext(r.Context())
+		if !ok || acc.Username != f.Link {
+			http.Error(w, "login expired", 400)
+			return
+		}
+		if err := LinkIdentity(acc.Username, id); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		http.Redirect(w, r, "/account", 302)
+		return
+	}
+
+	acc, sess, err := LoginIdentity(id)
+	switch {
+	case err == ErrTwoFactor:
+		newChallenge(w, acc.Username)
+		http.Redirect(w, r, "/login/2fa", 302)
+		return
+	case err == ErrTooManyAttempts:
+		http.Error(w, err.Error(), 429)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), 403)
+		return
+	}
+
+	setCookies(w, r, sess)
+	http.Redirect(w, r, "/home", 302)
+}
+
+// UnlinkHandler removes a linked login from the account
+func UnlinkHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+
+	acc, _ := FromContext(r.Context())
+	if err := UnlinkIdentity(acc.Username, r.PostFormValue("provider")); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	http.Redirect(w, r, "/account", 302)
+}
@@ -0,0 +1,337 @@
+package user
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// issuer is a mock OpenID Connect provider
+type issuer struct {
+	srv *httptest.Server
+
+	mutex sync.Mutex
+	// signing keys by kid, served in the key set unless hidden
+	keys   map[string]crypto.Signer
+	hidden map[string]bool
+	// key set requests served
+	fetches int
+	// from the last auth url
+	challenge string
+	method    string
+	nonce     string
+	// from the last token request
+	verifier string
+	// the next id token, changed by the test case
+	header map[string]interface{}
+	claims map[string]interface{}
+	// forge signs with a key not in the key set
+	forge bool
+}
+
+func newIssuer(t *testing.T) *issuer {
+	t.Helper()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i := &issuer{
+		keys:   map[string]crypto.Signer{"rsa": rsaKey, "ec": ecKey},
+		hidden: map[string]bool{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(discovery{
+			Issuer:        i.srv.URL,
+			AuthEndpoint:  i.srv.URL + "/auth",
+			TokenEndpoint: i.srv.URL + "/token",
+			JWKSURI:       i.srv.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", i.jwks)
+	mux.HandleFunc("/token", i.token)
+
+	i.srv = httptest.NewServer(mux)
+	t.Cleanup(i.srv.Close)
+	return i
+}
+
+func (i *issuer) jwks(w http.ResponseWriter, r *http.Request) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.fetches++
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	for kid, k := range i.keys {
+		if i.hidden[kid] {
+			continue
+		}
+		switch k := k.Public().(type) {
+		case *rsa.PublicKey:
+			set.Keys = append(set.Keys, jwk{
+				Kty: "RSA",
+				Kid: kid,
+				N:   b64.EncodeToString(k.N.Bytes()),
+				E:   b64.EncodeToString(big.NewInt(int64(k.E)).Bytes()),
+			})
+		case *ecdsa.PublicKey:
+			x := make([]byte, 32)
+			y := make([]byte, 32)
+			k.X.FillBytes(x)
+			k.Y.FillBytes(y)
+			set.Keys = append(set.Keys, jwk{
+				Kty: "EC",
+				Kid: kid,
+				Crv: "P-256",
+				X:   b64.EncodeToString(x),
+				Y:   b64.EncodeToString(y),
+			})
+		}
+	}
+	json.NewEncoder(w).Encode(set)
+}
+
+func (i *issuer) token(w http.ResponseWriter, r *http.Request) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	r.ParseForm()
+	i.verifier = r.PostForm.Get("code_verifier")
+
+	// the verifier must be the one the challenge was made from
+	sum := sha256.Sum256([]byte(i.verifier))
+	if r.PostForm.Get("code") != "code" || b64.EncodeToString(sum[:]) != i.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(400)
+		w.Write([]byte(`{"error":"invalid_grant"}`))
+		return
+	}
+
+	h, _ := json.Marshal(i.header)
+	c, _ := json.Marshal(i.claims)
+	signed := b64.EncodeToString(h) + "." + b64.EncodeToString(c)
+
+	key := i.keys[i.header["kid"].(string)]
+	if i.forge {
+		switch key.(type) {
+		case *rsa.PrivateKey:
+			key, _ = rsa.GenerateKey(rand.Reader, 2048)
+		case *ecdsa.PrivateKey:
+			key, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		}
+	}
+
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sig, _ = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		r, s, _ := ecdsa.Sign(rand.Reader, k, digest[:])
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": "token",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     signed + "." + b64.EncodeToString(sig),
+	})
+}
+
+// login goes through the begin and callback handlers, change alters the
+// id token and state the callback is called with
+func (i *issuer) login(t *testing.T, change func(i *issuer), state func(string) string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	OIDCHandler(w, httptest.NewRequest("GET", "http://example.com/login/oidc/mock", nil))
+	if w.Code != 302 {
+		t.Fatalf("begin got %d %s", w.Code, w.Body)
+	}
+	var cookie *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == "oidc" {
+			cookie = c
+		}
+	}
+	if cookie == nil {
+		t.Fatal("no oidc cookie")
+	}
+
+	u, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+
+	i.mutex.Lock()
+	i.challenge = q.Get("code_challenge")
+	i.method = q.Get("code_challenge_method")
+	i.nonce = q.Get("nonce")
+	i.verifier = ""
+	i.forge = false
+	i.header = map[string]interface{}{"alg": "RS256", "kid": "rsa", "typ": "JWT"}
+	i.claims = map[string]interface{}{
+		"iss":                i.srv.URL,
+		"sub":                "1234",
+		"aud":                "client",
+		"exp":                time.Now().Add(time.Hour).Unix(),
+		"iat":                time.Now().Unix(),
+		"nonce":              i.nonce,
+		"email":              "alice@example.com",
+		"email_verified":     true,
+		"preferred_username": "Alice",
+	}
+	if change != nil {
+		change(i)
+	}
+	i.mutex.Unlock()
+
+	s := q.Get("state")
+	if state != nil {
+		s = state(s)
+	}
+
+	r := httptest.NewRequest("GET", "http://example.com/login/oidc/mock/callback?code=code&state="+url.QueryEscape(s), nil)
+	r.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	OIDCHandler(w, r)
+	return w
+}
+
+func TestOIDCLogin(t *testing.T) {
+	testInit(t)
+	i := newIssuer(t)
+	RegisterProvider(NewOIDC(ProviderConfig{Name: "mock", Issuer: i.srv.URL, ClientID: "client"}))
+
+	w := i.login(t, nil, nil)
+	if w.Code != 302 || w.Header().Get("Location") != "/home" {
+		t.Fatalf("login got %d %s", w.Code, w.Body)
+	}
+	var sess bool
+	for _, c := range w.Result().Cookies() {
+		sess = sess || c.Name == "sess" && len(c.Value) > 0
+	}
+	if !sess {
+		t.Error("no session cookie")
+	}
+
+	// pkce with the verifier sent to the token endpoint
+	if i.method != "S256" || len(i.verifier) == 0 {
+		t.Errorf("got challenge method %q verifier %q", i.method, i.verifier)
+	}
+
+	mutex.Lock()
+	acc := users["alice"]
+	mutex.Unlock()
+	if acc == nil || len(acc.Identities) != 1 || acc.Identities[0].Subject != "1234" || acc.Identities[0].Email != "alice@example.com" {
+		t.Fatalf("got account %+v", acc)
+	}
+
+	tests := []struct {
+		name   string
+		change func(i *issuer)
+		state  func(string) string
+		want   int
+	}{
+		{"again", nil, nil, 302},
+		{"ec key", func(i *issuer) { i.header["alg"], i.header["kid"] = "ES256", "ec" }, nil, 302},
+		{"audience list", func(i *issuer) { i.claims["aud"] = []string{"other", "client"} }, nil, 302},
+		{"wrong state", nil, func(s string) string { return s + "x" }, 400},
+		{"no state", nil, func(string) string { return "" }, 400},
+		{"wrong verifier", func(i *issuer) { i.challenge = "other" }, nil, 401},
+		{"wrong nonce", func(i *issuer) { i.claims["nonce"] = "other" }, nil, 401},
+		{"no nonce", func(i *issuer) { delete(i.claims, "nonce") }, nil, 401},
+		{"wrong audience", func(i *issuer) { i.claims["aud"] = "other" }, nil, 401},
+		{"audience list without client", func(i *issuer) { i.claims["aud"] = []string{"other"} }, nil, 401},
+		{"wrong issuer", func(i *issuer) { i.claims["iss"] = "https://evil.com" }, nil, 401},
+		{"expired", func(i *issuer) { i.claims["exp"] = time.Now().Add(-time.Hour).Unix() }, nil, 401},
+		{"no subject", func(i *issuer) { delete(i.claims, "sub") }, nil, 401},
+		{"es256 with rsa key", func(i *issuer) { i.header["alg"] = "ES256" }, nil, 401},
+		{"rs256 with ec key", func(i *issuer) { i.header["kid"] = "ec" }, nil, 401},
+		{"alg none", func(i *issuer) { i.header["alg"] = "none" }, nil, 401},
+		{"forged", func(i *issuer) { i.forge = true }, nil, 401},
+		{"forged ec", func(i *issuer) { i.header["alg"], i.header["kid"], i.forge = "ES256", "ec", true }, nil, 401},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := i.login(t, tt.change, tt.state); w.Code != tt.want {
+				t.Errorf("got %d %s, want %d", w.Code, w.Body, tt.want)
+			}
+		})
+	}
+
+	// the same identity each time
+	mutex.Lock()
+	n := len(users)
+	mutex.Unlock()
+	if n != 1 {
+		t.Errorf("got %d accounts, want 1", n)
+	}
+}
+
+func TestOIDCKeyRotation(t *testing.T) {
+	testInit(t)
+	i := newIssuer(t)
+	RegisterProvider(NewOIDC(ProviderConfig{Name: "mock", Issuer: i.srv.URL, ClientID: "client"}))
+
+	if w := i.login(t, nil, nil); w.Code != 302 {
+		t.Fatalf("login got %d %s", w.Code, w.Body)
+	}
+
+	// a key published after the set was fetched
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.mutex.Lock()
+	i.keys["new"] = key
+	i.mutex.Unlock()
+
+	w := i.login(t, func(i *issuer) { i.header["alg"], i.header["kid"] = "ES256", "new" }, nil)
+	if w.Code != 302 {
+		t.Fatalf("new key got %d %s", w.Code, w.Body)
+	}
+	if i.fetches != 2 {
+		t.Errorf("key set fetched %d times, want 2", i.fetches)
+	}
+
+	// unknown keys are still rejected after fetching again
+	i.mutex.Lock()
+	i.keys["unknown"] = key
+	i.hidden["unknown"] = true
+	i.mutex.Unlock()
+
+	w = i.login(t, func(i *issuer) { i.header["alg"], i.header["kid"] = "ES256", "unknown" }, nil)
+	if w.Code != 401 {
+		t.Errorf("unknown key got %d, want 401", w.Code)
+	}
+	if i.fetches != 3 {
+		t.Errorf("key set fetched %d times, want 3", i.fetches)
+	}
+}
@@ -0,0 +1,611 @@
+package user
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+
+	"mu.dev"
+)
+
+// COSE algorithms we accept, ES256 covers phones and most keys, RS256 Windows Hello
+const (
+	algES256 = -7
+	algRS256 = -257
+)
+
+// authenticator data flags
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttested     = 0x40
+)
+
+// how long a ceremony can take
+var ceremonyTimeout = time.Minute * 5
+
+// a passkey challenge waiting on the browser
+type ceremony struct {
+	Challenge []byte
+	Username  string
+	Expires   time.Time
+}
+
+// registrations keyed by username and logins keyed by cookie id
+var registrations = map[string]*ceremony{}
+var assertions = map[string]*ceremony{}
+
+var passkeyMutex sync.Mutex
+
+// Credential is a passkey registered to an account
+type Credential struct {
+	ID []byte
+	// PublicKey is the COSE encoded key
+	PublicKey []byte
+	SignCount uint32
+	Name      string
+	Created   time.Time
+}
+
+var b64 = base64.RawURLEncoding
+
+// EncodedID is the id as the browser sends it
+func (c *Credential) EncodedID() string {
+	return b64.EncodeToString(c.ID)
+}
+
+// passkeyJS converts between the base64url json we send and the buffers the browser wants
+const passkeyJS = `
+function b64ToBuf(s) {
+  s = s.replace(/-/g, "+").replace(/_/g, "/");
+  return Uint8Array.from(atob(s), c => c.charCodeAt(0)).buffer;
+}
+function bufToB64(b) {
+  return btoa(String.fromCharCode(...new Uint8Array(b))).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+}
+function post(url, body) {
+  return fetch(url, {
+    method: "POST",
+    body: JSON.stringify(body || {}),
+    headers: {
+      "Content-Type": "application/json",
+      "X-CSRF-Token": document.querySelector("meta[name=csrf-token]").content,
+    },
+  }).then(res => res.ok ? res.json() : res.text().then(t => { throw new Error(t) }));
+}
+`
+
+// clientData is what the browser signed over
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// attestation is the attestationObject from registration. The statement
+// isn't verified, we only need the key, as with "none" attestation.
+type attestation struct {
+	Fmt      string          `cbor:"fmt"`
+	AttStmt  cbor.RawMessage `cbor:"attStmt"`
+	AuthData []byte          `cbor:"authData"`
+}
+
+// credentialJSON is the PublicKeyCredential sent back by the page, base64url encoded
+type credentialJSON struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+		UserHandle        string `json:"userHandle"`
+	} `json:"response"`
+}
+
+// relyingParty returns the rp id and origin from the config or the request
+func relyingParty(r *http.Request) (string, string) {
+	id, origin := config.RPID, config.Origin
+
+	if len(id) == 0 {
+		id = r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			id = h
+		}
+	}
+
+	if len(origin) == 0 {
+		scheme := "http"
+		if r.TLS != nil || mu.Secure() {
+			scheme = "https"
+		}
+		origin = scheme + "://" + r.Host
+	}
+
+	return id, origin
+}
+
+func randomChallenge() []byte {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return b
+}
+
+// checkClientData verifies the type, challenge and origin the browser signed
+func checkClientData(raw []byte, typ string, challenge []byte, origin string) error {
+	var c clientData
+	if err := json.Unmarshal(raw, &c); err != nil {
+		return err
+	}
+	if c.Type != typ {
+		return errors.New("wrong type")
+	}
+	got, err := b64.DecodeString(c.Challenge)
+	if err != nil || !bytes.Equal(got, challenge) {
+		return errors.New("wrong challenge")
+	}
+	if c.Origin != origin {
+		return fmt.Errorf("wrong origin %s", c.Origin)
+	}
+	return nil
+}
+
+// checkAuthData verifies the rp id hash and user presence, returning the flags and count
+func checkAuthData(data []byte, rpID string) (byte, uint32, error) {
+	if len(data) < 37 {
+		return 0, 0, errors.New("short authenticator data")
+	}
+	hash := sha256.Sum256([]byte(rpID))
+	if !bytes.Equal(data[:32], hash[:]) {
+		return 0, 0, errors.New("wrong rp id")
+	}
+	flags := data[32]
+	if flags&flagUserPresent == 0 {
+		return 0, 0, errors.New("user not present")
+	}
+	return flags, binary.BigEndian.Uint32(data[33:37]), nil
+}
+
+// publicKey decodes a COSE key
+func publicKey(cose []byte) (crypto.PublicKey, int, error) {
+	var k map[int]interface{}
+	if err := cbor.Unmarshal(cose, &k); err != nil {
+		return nil, 0, err
+	}
+
+	alg, _ := k[3].(int64)
+	b := func(i int) []byte {
+		v, _ := k[i].([]byte)
+		return v
+	}
+
+	switch alg {
+	case algES256:
+		x, y := b(-2), b(-3)
+		if len(x) != 32 || len(y) != 32 {
+			return nil, 0, errors.New("invalid key")
+		}
+		// check the point is on the curve
+		if _, err := ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+			return nil, 0, err
+		}
+		return &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, algES256, nil
+	case algRS256:
+		n, e := b(-1), b(-2)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, 0, errors.New("invalid key")
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, algRS256, nil
+	}
+
+	return nil, 0, fmt.Errorf("unsupported algorithm %d", alg)
+}
+
+// verifySignature checks sig over authData and the client data hash
+func verifySignature(cose, authData, clientDataJSON, sig []byte) error {
+	key, alg, err := publicKey(cose)
+	if err != nil {
+		return err
+	}
+
+	cdh := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), cdh[:]...))
+
+	switch alg {
+	case algES256:
+		if !ecdsa.VerifyASN1(key.(*ecdsa.PublicKey), digest[:], sig) {
+			return errors.New("invalid signature")
+		}
+	case algRS256:
+		if err := rsa.VerifyPKCS1v15(key.(*rsa.PublicKey), crypto.SHA256, digest[:], sig); err != nil {
+			return errors.New("invalid signature")
+		}
+	}
+	return nil
+}
+
+// addCeremony stores a challenge, dropping expired ones
+func addCeremony(m map[string]*ceremony, key, username string) *ceremony {
+	passkeyMutex.Lock()
+	defer passkeyMutex.Unlock()
+
+	for k, c := range m {
+		if time.Now().After(c.Expires) {
+			delete(m, k)
+		}
+	}
+
+	c := &ceremony{
+		Challenge: randomChallenge(),
+		Username:  username,
+		Expires:   time.Now().Add(ceremonyTimeout),
+	}
+	m[key] = c
+	return c
+}
+
+// takeCeremony removes and returns a challenge so it's only used once
+func takeCeremony(m map[string]*ceremony, key string) (*ceremony, bool) {
+	passkeyMutex.Lock()
+	defer passkeyMutex.Unlock()
+
+	c, ok := m[key]
+	delete(m, key)
+	if !ok || time.Now().After(c.Expires) {
+		return nil, false
+	}
+	return c, true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	b, _ := json.Marshal(v)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// RegisterBeginHandler returns the options for navigator.credentials.create
+func RegisterBeginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+
+	acc, _ := FromContext(r.Context())
+	rpID, _ := relyingParty(r)
+	c := addCeremony(registrations, acc.Username, acc.Username)
+
+	// don't register the same authenticator twice
+	exclude := []map[string]string{}
+	mutex.Lock()
+	for _, cred := range acc.Credentials {
+		exclude = append(exclude, map[string]string{"type": "public-key", "id": b64.EncodeToString(cred.ID)})
+	}
+	mutex.Unlock()
+
+	writeJSON(w, map[string]interface{}{
+		"challenge": b64.EncodeToString(c.Challenge),
+		"rp":        map[string]string{"id": rpID, "name": "Mu"},
+		"user": map[string]string{
+			"id":          b64.EncodeToString([]byte(acc.ID)),
+			"name":        acc.Username,
+			"displayName": acc.Username,
+		},
+		"pubKeyCredParams": []map[string]interface{}{
+			{"type": "public-key", "alg": algES256},
+			{"type": "public-key", "alg": algRS256},
+		},
+		"authenticatorSelection": map[string]string{
+			"residentKey":      "required",
+			"userVerification": "preferred",
+		},
+		"attestation":        "none",
+		"excludeCredentials": exclude,
+		"timeout":            ceremonyTimeout.Milliseconds(),
+	})
+}
+
+// RegisterFinishHandler verifies the new credential and adds it to the account
+func RegisterFinishHandler(w http.ResponseWriter, r *http.Request) {
+	acc, _ := FromContext(r.Context())
+
+	var cred credentialJSON
+	if err := json.NewDecoder(r.Body).Decode(&cred); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	c, ok := takeCeremony(registrations, acc.Username)
+	if !ok {
+		http.Error(w, "registration expired", 400)
+		return
+	}
+
+	rpID, origin := relyingParty(r)
+
+	nc, err := registerCredential(cred, c.Challenge, rpID, origin)
+	if err != nil {
+		http.Error(w, "invalid passkey: "+err.Error(), 400)
+		return
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	// credential ids are unique across accounts
+	for _, u := range users {
+		for _, existing := range u.Credentials {
+			if bytes.Equal(existing.ID, nc.ID) {
+				http.Error(w, "passkey already registered", 400)
+				return
+			}
+		}
+	}
+
+	nc.Name = cred.Name
+	if len(nc.Name) == 0 {
+		nc.Name = "Passkey"
+	}
+	acc.Credentials = append(acc.Credentials, nc)
+
+	if err := mu.Put("users", acc.Username, acc, true); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	writeJSON(w, map[string]string{"status": "ok"})
+}
+
+// registerCredential verifies a registration response
+func registerCredential(cred credentialJSON, challenge []byte, rpID, origin string) (*Credential, error) {
+	clientDataJSON, err := b64.DecodeString(cred.Response.ClientDataJSON)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkClientData(clientDataJSON, "webauthn.create", challenge, origin); err != nil {
+		return nil, err
+	}
+
+	raw, err := b64.DecodeString(cred.Response.AttestationObject)
+	if err != nil {
+		return nil, err
+	}
+	var att attestation
+	if err := cbor.Unmarshal(raw, &att); err != nil {
+		return nil, err
+	}
+
+	flags, count, err := checkAuthData(att.AuthData, rpID)
+	if err != nil {
+		return nil, err
+	}
+	if flags&flagAttested == 0 {
+		return nil, errors.New("no credential")
+	}
+
+	// aaguid, then the credential id and its public key
+	data := att.AuthData[37:]
+	if len(data) < 18 {
+		return nil, errors.New("short credential data")
+	}
+	n := int(binary.BigEndian.Uint16(data[16:18]))
+	data = data[18:]
+	if len(data) < n {
+		return nil, errors.New("short credential id")
+	}
+	id := data[:n]
+
+	// the key is followed by any extensions
+	var key cbor.RawMessage
+	if err := cbor.NewDecoder(bytes.NewReader(data[n:])).Decode(&key); err != nil {
+		return nil, err
+	}
+	if _, _, err := publicKey(key); err != nil {
+		return nil, err
+	}
+
+	return &Credential{
+		ID:        append([]byte{}, id...),
+		PublicKey: append([]byte{}, key...),
+		SignCount: count,
+		Created:   time.Now(),
+	}, nil
+}
+
+// PasskeyBeginHandler returns the options for navigator.credentials.get
+func PasskeyBeginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+
+	rpID, _ := relyingParty(r)
+	key := mu.ID()
+	c := addCeremony(assertions, key, "")
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "passkey",
+		Value:    mu.Sign(key),
+		Path:     "/login/passkey",
+		MaxAge:   int(ceremonyTimeout.Seconds()),
+		Secure:   mu.Secure(),
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	// no allowed credentials so the browser offers any passkey for the site
+	writeJSON(w, map[string]interface{}{
+		"challenge":        b64.EncodeToString(c.Challenge),
+		"rpId":             rpID,
+		"userVerification": "preferred",
+		"timeout":          ceremonyTimeout.Milliseconds(),
+	})
+}
+
+// loginPasskey verifies an assertion and starts a session. It returns ErrTwoFactor
+// when the account has two factor on and the user wasn't verified by the authenticator.
+func loginPasskey(cred credentialJSON, challenge []byte, rpID, origin string) (*Account, *Session, error) {
+	id, err := b64.DecodeString(cred.ID)
+	if err != nil {
+		return nil, nil, ErrInvalidLogin
+	}
+	clientDataJSON, err := b64.DecodeString(cred.Response.ClientDataJSON)
+	if err != nil {
+		return nil, nil, ErrInvalidLogin
+	}
+	authData, err := b64.DecodeString(cred.Response.AuthenticatorData)
+	if err != nil {
+		return nil, nil, ErrInvalidLogin
+	}
+	sig, err := b64.DecodeString(cred.Response.Signature)
+	if err != nil {
+		return nil, nil, ErrInvalidLogin
+	}
+
+	if err := checkClientData(clientDataJSON, "webauthn.get", challenge, origin); err != nil {
+		return nil, nil, err
+	}
+	flags, count, err := checkAuthData(authData, rpID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	var acc *Account
+	var stored *Credential
+	for _, u := range users {
+		for _, c := range u.Credentials {
+			if bytes.Equal(c.ID, id) {
+				acc, stored = u, c
+			}
+		}
+	}
+	if acc == nil {
+		return nil, nil, ErrInvalidLogin
+	}
+	if acc.Locked() {
+		return nil, nil, ErrTooManyAttempts
+	}
+
+	if err := verifySignature(stored.PublicKey, authData, clientDataJSON, sig); err != nil {
+		return nil, nil, err
+	}
+	if acc.Disabled {
+		return nil, nil, ErrDisabled
+	}
+
+	// a counter going backwards suggests a cloned authenticator
+	if count != 0 || stored.SignCount != 0 {
+		if count <= stored.SignCount {
+			return nil, nil, errors.New("invalid sign count")
+		}
+		stored.SignCount = count
+		saveAccount(acc)
+	}
+
+	if len(acc.TOTPSecret) > 0 && flags&flagUserVerified == 0 {
+		return acc, nil, ErrTwoFactor
+	}
+
+	return acc, login(acc), nil
+}
+
+// PasskeyFinishHandler logs in with a passkey
+func PasskeyFinishHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowIP(r) {
+		http.Error(w, ErrTooManyAttempts.Error(), 429)
+		return
+	}
+
+	var key string
+	if c, err := r.Cookie("passkey"); err == nil {
+		key, _ = mu.Unsign(c.Value)
+	}
+	c, ok := takeCeremony(assertions, key)
+	if !ok {
+		http.Error(w, "login expired", 400)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: "passkey", Path: "/login/passkey", MaxAge: -1})
+
+	var cred credentialJSON
+	if err := json.NewDecoder(r.Body).Decode(&cred); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	rpID, origin := relyingParty(r)
+
+	acc, sess, err := loginPasskey(cred, c.Challenge, rpID, origin)
+	switch {
+	case err == ErrTwoFactor:
+		newChallenge(w, acc.Username)
+		writeJSON(w, map[string]string{"redirect": "/login/2fa"})
+		return
+	case err == ErrTooManyAttempts:
+		http.Error(w, err.Error(), 429)
+		return
+	case err == ErrDisabled:
+		http.Error(w, err.Error(), 403)
+		return
+	case err != nil:
+		http.Error(w, ErrInvalidLogin.Error(), 401)
+		return
+	}
+
+	setCookies(w, r, sess)
+	writeJSON(w, map[string]string{"redirect": "/home"})
+}
+
+// RemovePasskeyHandler deletes a passkey from the account
+func RemovePasskeyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+
+	acc, _ := FromContext(r.Context())
+	id, _ := b64.DecodeString(r.PostFormValue("id"))
+
+	mutex.Lock()
+	var creds []*Credential
+	for _, c := range acc.Credentials {
+		if !bytes.Equal(c.ID, id) {
+			creds = append(creds, c)
+		}
+	}
+	acc.Credentials = creds
+	err := mu.Put("users", acc.Username, acc, true)
+	mutex.Unlock()
+
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	http.Redirect(w, r, "/account", 302)
+}
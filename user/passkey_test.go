@@ -0,0 +1,287 @@
+package user
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// authenticator is a software ES256 passkey
+type authenticator struct {
+	key   *ecdsa.PrivateKey
+	id    []byte
+	count uint32
+	// what it signs over, the test's relying party unless changed
+	rpID   string
+	origin string
+	// challenge overrides the one sent by the server
+	challenge []byte
+}
+
+func newAuthenticator(t *testing.T) *authenticator {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &authenticator{
+		key:    key,
+		id:     randomChallenge()[:16],
+		rpID:   config.RPID,
+		origin: config.Origin,
+	}
+}
+
+func (a *authenticator) coseKey() []byte {
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	a.key.X.FillBytes(x)
+	a.key.Y.FillBytes(y)
+	b, _ := cbor.Marshal(map[int]interface{}{1: 2, 3: algES256, -1: 1, -2: x, -3: y})
+	return b
+}
+
+// authData for the rp, with the credential when registering
+func (a *authenticator) authData(attested bool) []byte {
+	hash := sha256.Sum256([]byte(a.rpID))
+	data := append([]byte{}, hash[:]...)
+
+	flags := byte(flagUserPresent | flagUserVerified)
+	if attested {
+		flags |= flagAttested
+	}
+	data = append(data, flags)
+	data = binary.BigEndian.AppendUint32(data, a.count)
+
+	if attested {
+		// zero aaguid, the id length, the id and the key
+		data = append(data, make([]byte, 16)...)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(a.id)))
+		data = append(data, a.id...)
+		data = append(data, a.coseKey()...)
+	}
+	return data
+}
+
+func (a *authenticator) clientData(typ, challenge string) []byte {
+	if a.challenge != nil {
+		challenge = b64.EncodeToString(a.challenge)
+	}
+	b, _ := json.Marshal(clientData{Type: typ, Challenge: challenge, Origin: a.origin})
+	return b
+}
+
+// create is navigator.credentials.create
+func (a *authenticator) create(challenge string) credentialJSON {
+	att, _ := cbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": a.authData(true),
+	})
+
+	var c credentialJSON
+	c.ID = b64.EncodeToString(a.id)
+	c.Name = "Test key"
+	c.Response.ClientDataJSON = b64.EncodeToString(a.clientData("webauthn.create", challenge))
+	c.Response.AttestationObject = b64.EncodeToString(att)
+	return c
+}
+
+// get is navigator.credentials.get
+func (a *authenticator) get(challenge string) credentialJSON {
+	a.count++
+	authData := a.authData(false)
+	cd := a.clientData("webauthn.get", challenge)
+
+	cdh := sha256.Sum256(cd)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), cdh[:]...))
+	sig, _ := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+
+	var c credentialJSON
+	c.ID = b64.EncodeToString(a.id)
+	c.Response.ClientDataJSON = b64.EncodeToString(cd)
+	c.Response.AuthenticatorData = b64.EncodeToString(authData)
+	c.Response.Signature = b64.EncodeToString(sig)
+	return c
+}
+
+// call a passkey handler, as the account if there is one
+func callPasskey(h http.HandlerFunc, acc *Account, body interface{}, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	b, _ := json.Marshal(body)
+	r := httptest.NewRequest("POST", "https://example.com/", strings.NewReader(string(b)))
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	if acc != nil {
+		r = r.WithContext(context.WithValue(r.Context(), contextKey{}, acc))
+	}
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+func challengeOf(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+
+	var opts struct {
+		Challenge string `json:"challenge"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &opts); err != nil || len(opts.Challenge) == 0 {
+		t.Fatalf("no challenge in %d %s", w.Code, w.Body)
+	}
+	return opts.Challenge
+}
+
+// register the authenticator to the account returning the finish response
+func registerPasskey(t *testing.T, acc *Account, a *authenticator) *httptest.ResponseRecorder {
+	t.Helper()
+
+	challenge := challengeOf(t, callPasskey(RegisterBeginHandler, acc, nil))
+	return callPasskey(RegisterFinishHandler, acc, a.create(challenge))
+}
+
+// beginLogin starts a login returning the challenge and its cookie
+func beginLogin(t *testing.T) (string, *http.Cookie) {
+	t.Helper()
+
+	w := callPasskey(PasskeyBeginHandler, nil, nil)
+	for _, c := range w.Result().Cookies() {
+		if c.Name == "passkey" {
+			return challengeOf(t, w), c
+		}
+	}
+	t.Fatal("no passkey cookie")
+	return "", nil
+}
+
+func TestPasskeyRegister(t *testing.T) {
+	testInit(t)
+	config.RPID = "example.com"
+	config.Origin = "https://example.com"
+
+	alice := testUser(t, "alice", "correct horse")
+	bob := testUser(t, "bob", "battery staple")
+
+	registered := newAuthenticator(t)
+	if w := registerPasskey(t, alice, registered); w.Code != 200 {
+		t.Fatalf("register got %d %s", w.Code, w.Body)
+	}
+	if len(alice.Credentials) != 1 || alice.Credentials[0].Name != "Test key" {
+		t.Fatalf("got credentials %v", alice.Credentials)
+	}
+
+	tests := []struct {
+		name   string
+		acc    *Account
+		change func(a *authenticator)
+	}{
+		{"wrong origin", bob, func(a *authenticator) { a.origin = "https://evil.com" }},
+		{"wrong rp id", bob, func(a *authenticator) { a.rpID = "evil.com" }},
+		{"wrong challenge", bob, func(a *authenticator) { a.challenge = randomChallenge() }},
+		{"registered to another account", bob, func(a *authenticator) { *a = *registered }},
+		{"registered twice", alice, func(a *authenticator) { *a = *registered }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newAuthenticator(t)
+			tt.change(a)
+
+			if w := registerPasskey(t, tt.acc, a); w.Code != 400 {
+				t.Errorf("got %d %s, want 400", w.Code, w.Body)
+			}
+		})
+	}
+
+	if len(bob.Credentials) != 0 || len(alice.Credentials) != 1 {
+		t.Errorf("got %d and %d credentials", len(alice.Credentials), len(bob.Credentials))
+	}
+
+	// a challenge is only good for one registration
+	a := newAuthenticator(t)
+	challenge := challengeOf(t, callPasskey(RegisterBeginHandler, bob, nil))
+	if w := callPasskey(RegisterFinishHandler, bob, a.create(challenge)); w.Code != 200 {
+		t.Fatalf("register got %d %s", w.Code, w.Body)
+	}
+	a = newAuthenticator(t)
+	if w := callPasskey(RegisterFinishHandler, bob, a.create(challenge)); w.Code != 400 {
+		t.Errorf("reused challenge got %d, want 400", w.Code)
+	}
+}
+
+func TestPasskeyLogin(t *testing.T) {
+	testInit(t)
+	config.RPID = "example.com"
+	config.Origin = "https://example.com"
+
+	alice := testUser(t, "alice", "correct horse")
+	a := newAuthenticator(t)
+	a.count = 10
+	if w := registerPasskey(t, alice, a); w.Code != 200 {
+		t.Fatalf("register got %d %s", w.Code, w.Body)
+	}
+
+	challenge, cookie := beginLogin(t)
+	resp := a.get(challenge)
+	w := callPasskey(PasskeyFinishHandler, nil, resp, cookie)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "/home") {
+		t.Fatalf("login got %d %s", w.Code, w.Body)
+	}
+	var sess bool
+	for _, c := range w.Result().Cookies() {
+		sess = sess || c.Name == "sess" && len(c.Value) > 0
+	}
+	if !sess {
+		t.Error("no session cookie")
+	}
+
+	// the same response again
+	if w := callPasskey(PasskeyFinishHandler, nil, resp, cookie); w.Code != 400 {
+		t.Errorf("replayed got %d, want 400", w.Code)
+	}
+
+	tests := []struct {
+		name   string
+		change func(a *authenticator)
+	}{
+		{"wrong origin", func(a *authenticator) { a.origin = "https://evil.com" }},
+		{"wrong rp id", func(a *authenticator) { a.rpID = "evil.com" }},
+		{"wrong challenge", func(a *authenticator) { a.challenge = randomChallenge() }},
+		{"sign count backwards", func(a *authenticator) { a.count = 3 }},
+		{"sign count repeated", func(a *authenticator) { a.count-- }},
+		{"unknown credential", func(a *authenticator) { a.id = randomChallenge()[:16] }},
+		{"other key", func(a *authenticator) { a.key, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader) }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bad := *a
+			tt.change(&bad)
+
+			challenge, cookie := beginLogin(t)
+			if w := callPasskey(PasskeyFinishHandler, nil, bad.get(challenge), cookie); w.Code != 401 {
+				t.Errorf("got %d %s, want 401", w.Code, w.Body)
+			}
+		})
+	}
+
+	// still works after the failures
+	challenge, cookie = beginLogin(t)
+	if w := callPasskey(PasskeyFinishHandler, nil, a.get(challenge), cookie); w.Code != 200 {
+		t.Errorf("login got %d %s", w.Code, w.Body)
+	}
+	if got := alice.Credentials[0].SignCount; got != a.count {
+		t.Errorf("stored sign count %d, want %d", got, a.count)
+	}
+}
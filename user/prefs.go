@@ -0,0 +1,209 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"mu.dev"
+)
+
+// Preferences the user sets on /account/settings, empty values are the defaults
+type Preferences struct {
+	// City for prayer times, one of the pray app's cities
+	City string
+	// Madhab for the Asr time, shafii or hanafi
+	Madhab string
+	// Translation of the Quran, one of the reminder app's translations
+	Translation string
+	// Categories of news to show, all if empty
+	Categories []string
+	// Theme is light or dark
+	Theme string
+	// Timezone e.g Europe/London
+	Timezone string
+}
+
+// Options is implemented by apps which offer the choices for a preference,
+// keyed by city, translation or categories
+type Options interface {
+	Options() map[string][]string
+}
+
+var (
+	Madhabs = []string{"shafii", "hanafi"}
+	Themes  = []string{"light", "dark"}
+)
+
+var settingsTmpl = mu.Template("settings", `
+{{define "title"}}Settings{{end}}
+{{define "description"}}Your preferences{{end}}
+{{define "content"}}
+<div style="padding-top: 100px;">
+<h1>Settings</h1>
+{{if .Saved}}<p>Saved.</p>{{end}}
+{{$p := .Preferences}}
+<form action="/account/settings" method="post">{{csrfField}}
+  {{if .Options.city}}
+  <p><label>Home city<br>
+  <select name="city">
+    <option value="">None</option>
+    {{range .Options.city}}<option{{if eq . $p.City}} selected{{end}}>{{.}}</option>{{end}}
+  </select></label></p>
+  {{end}}
+  <p><label>Asr time<br>
+  <select name="madhab">
+    {{range .Madhabs}}<option{{if eq . $p.Madhab}} selected{{end}}>{{.}}</option>{{end}}
+  </select></label></p>
+  {{if .Options.translation}}
+  <p><label>Quran translation<br>
+  <select name="translation">
+    {{range .Options.translation}}<option{{if eq . $p.Translation}} selected{{end}}>{{.}}</option>{{end}}
+  </select></label></p>
+  {{end}}
+  {{if .Options.categories}}
+  <p>News categories, none for all<br>
+  {{range .Options.categories}}<label><input type="checkbox" name="categories" value="{{.}}"{{if index $.Selected .}} checked{{end}}> {{.}}</label> {{end}}
+  </p>
+  {{end}}
+  <p><label>Theme<br>
+  <select name="theme">
+    {{range .Themes}}<option{{if eq . $p.Theme}} selected{{end}}>{{.}}</option>{{end}}
+  </select></label></p>
+  <p><label>Timezone<br>
+  <input name="timezone" value="{{$p.Timezone}}" placeholder="e.g Europe/London">
+  </label></p>
+  <button>Save</button>
+</form>
+<p><a href="/account">Back</a></p>
+</div>
+{{end}}
+`)
+
+// PreferencesFromContext returns the logged in user's preferences, the
+// defaults if there's no user
+func PreferencesFromContext(ctx context.Context) Preferences {
+	acc, ok := FromContext(ctx)
+	if !ok {
+		return Preferences{}
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	p := acc.Preferences
+	p.Categories = append([]string{}, p.Categories...)
+	return p
+}
+
+// Location is the user's timezone, or local time if it's not set
+func (p Preferences) Location() *time.Location {
+	if loc, err := time.LoadLocation(p.Timezone); err == nil && len(p.Timezone) > 0 {
+		return loc
+	}
+	return time.Local
+}
+
+// options collects the choices offered by the apps
+func options() map[string][]string {
+	opts := map[string][]string{}
+	for _, app := range mu.Apps() {
+		if o, ok := app.(Options); ok {
+			for k, v := range o.Options() {
+				opts[k] = append(opts[k], v...)
+			}
+		}
+	}
+	return opts
+}
+
+func oneOf(v string, list []string) bool {
+	for _, s := range list {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// check the preferences against the choices
+func (p Preferences) check(opts map[string][]string) error {
+	if len(p.City) > 0 && !oneOf(p.City, opts["city"]) {
+		return errors.New("unknown city " + p.City)
+	}
+	if len(p.Madhab) > 0 && !oneOf(p.Madhab, Madhabs) {
+		return errors.New("unknown madhab " + p.Madhab)
+	}
+	if len(p.Translation) > 0 && !oneOf(p.Translation, opts["translation"]) {
+		return errors.New("unknown translation " + p.Translation)
+	}
+	for _, c := range p.Categories {
+		if !oneOf(c, opts["categories"]) {
+			return errors.New("unknown category " + c)
+		}
+	}
+	if len(p.Theme) > 0 && !oneOf(p.Theme, Themes) {
+		return errors.New("unknown theme " + p.Theme)
+	}
+	if _, err := time.LoadLocation(p.Timezone); err != nil {
+		return errors.New("unknown timezone " + p.Timezone)
+	}
+	return nil
+}
+
+// SetPreferences saves the user's preferences
+func SetPreferences(username string, p Preferences) error {
+	if err := p.check(options()); err != nil {
+		return err
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	acc, ok := users[username]
+	if !ok {
+		return errors.New("no such user")
+	}
+
+	acc.Preferences = p
+	return mu.Put("users", username, acc, true)
+}
+
+// SettingsHandler shows and saves the user's preferences
+func SettingsHandler(w http.ResponseWriter, r *http.Request) {
+	acc, _ := FromContext(r.Context())
+
+	if r.Method == "POST" {
+		r.ParseForm()
+		p := Preferences{
+			City:        r.Form.Get("city"),
+			Madhab:      r.Form.Get("madhab"),
+			Translation: r.Form.Get("translation"),
+			Categories:  r.Form["categories"],
+			Theme:       r.Form.Get("theme"),
+			Timezone:    r.Form.Get("timezone"),
+		}
+		if err := SetPreferences(acc.Username, p); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		http.Redirect(w, r, "/account/settings?saved=true", 302)
+		return
+	}
+
+	p := PreferencesFromContext(r.Context())
+	selected := map[string]bool{}
+	for _, c := range p.Categories {
+		selected[c] = true
+	}
+
+	mu.Render(w, settingsTmpl, map[string]interface{}{
+		"Preferences": p,
+		"Options":     options(),
+		"Selected":    selected,
+		"Madhabs":     Madhabs,
+		"Themes":      Themes,
+		"Saved":       r.URL.Query().Get("saved") == "true",
+	})
+}
@@ -0,0 +1,124 @@
+package user
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"mu.dev"
+)
+
+// optionsApp offers choices for the preferences like pray, reminder and news
+type optionsApp struct{}
+
+func (o *optionsApp) Name() string        { return "Options" }
+func (o *optionsApp) Description() string { return "" }
+func (o *optionsApp) Icon() string        { return "" }
+func (o *optionsApp) Routes() []mu.Route  { return nil }
+func (o *optionsApp) Start() error        { return nil }
+func (o *optionsApp) Stop() error         { return nil }
+func (o *optionsApp) Options() map[string][]string {
+	return map[string][]string{
+		"city":        {"London", "Makkah"},
+		"translation": {"en.khattab", "en.sahih"},
+		"categories":  {"Tech", "World"},
+	}
+}
+
+func init() {
+	mu.Register(new(optionsApp))
+}
+
+func TestPreferencesFromContext(t *testing.T) {
+	testInit(t)
+
+	// no user gets the defaults
+	p := PreferencesFromContext(context.Background())
+	if !reflect.DeepEqual(p, Preferences{}) {
+		t.Errorf("got %+v, want the defaults", p)
+	}
+	if p.Location() != time.Local {
+		t.Errorf("default location %v", p.Location())
+	}
+
+	acc := testUser(t, "alice", "correct horse")
+	ctx := context.WithValue(context.Background(), contextKey{}, acc)
+
+	if p := PreferencesFromContext(ctx); !reflect.DeepEqual(p, Preferences{Categories: []string{}}) {
+		t.Errorf("new user got %+v, want the defaults", p)
+	}
+
+	want := Preferences{City: "Makkah", Translation: "en.sahih", Categories: []string{"Tech"}, Timezone: "Asia/Riyadh"}
+	if err := SetPreferences("alice", want); err != nil {
+		t.Fatal(err)
+	}
+
+	p = PreferencesFromContext(ctx)
+	if !reflect.DeepEqual(p, want) {
+		t.Errorf("got %+v, want %+v", p, want)
+	}
+	if p.Location().String() != "Asia/Riyadh" {
+		t.Errorf("location %v", p.Location())
+	}
+
+	// a copy the caller can't change the account through
+	p.Categories[0] = "World"
+	if acc.Preferences.Categories[0] != "Tech" {
+		t.Error("categories shared with the account")
+	}
+}
+
+func TestSetPreferences(t *testing.T) {
+	testInit(t)
+	testUser(t, "alice", "correct horse")
+
+	tests := []struct {
+		name  string
+		prefs Preferences
+		ok    bool
+	}{
+		{"defaults", Preferences{}, true},
+		{"all set", Preferences{
+			City:        "London",
+			Madhab:      "hanafi",
+			Translation: "en.khattab",
+			Categories:  []string{"Tech", "World"},
+			Theme:       "dark",
+			Timezone:    "Europe/London",
+		}, true},
+		{"unknown city", Preferences{City: "Atlantis"}, false},
+		{"unknown madhab", Preferences{Madhab: "other"}, false},
+		{"unknown translation", Preferences{Translation: "en.other"}, false},
+		{"unknown category", Preferences{Categories: []string{"Tech", "Gossip"}}, false},
+		{"unknown theme", Preferences{Theme: "pink"}, false},
+		{"unknown timezone", Preferences{Timezone: "Mars/Olympus"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := users["alice"].Preferences
+
+			err := SetPreferences("alice", tt.prefs)
+			if (err == nil) != tt.ok {
+				t.Fatalf("got %v, want ok %v", err, tt.ok)
+			}
+
+			var acc Account
+			if err := mu.Get("users", "alice", &acc, true); err != nil {
+				t.Fatal(err)
+			}
+			want := tt.prefs
+			if !tt.ok {
+				want = before
+			}
+			if !reflect.DeepEqual(acc.Preferences, want) {
+				t.Errorf("stored %+v, want %+v", acc.Preferences, want)
+			}
+		})
+	}
+
+	if err := SetPreferences("nobody", Preferences{}); err == nil {
+		t.Error("set for an unknown user")
+	}
+}
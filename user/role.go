@@ -0,0 +1,112 @@
+package user
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"mu.dev"
+)
+
+// Role of an account, each includes the ones below it
+type Role string
+
+const (
+	RoleMember    Role = "member"
+	RoleModerator Role = "moderator"
+	RoleAdmin     Role = "admin"
+)
+
+// Roles from least to most privileged
+var Roles = []Role{RoleMember, RoleModerator, RoleAdmin}
+
+func (r Role) rank() int {
+	for i, role := range Roles {
+		if role == r {
+			return i
+		}
+	}
+	// no role is a member
+	return 0
+}
+
+// Valid reports whether it's a known role
+func (r Role) Valid() bool {
+	for _, role := range Roles {
+		if role == r {
+			return true
+		}
+	}
+	return false
+}
+
+// Has reports whether the account has the role or a higher one
+func (a *Account) Has(role Role) bool {
+	return a.Role.rank() >= role.rank()
+}
+
+// Has reports whether the logged in user has the role
+func Has(r *http.Request, role Role) bool {
+	acc, ok := FromContext(r.Context())
+	return ok && acc.Has(role)
+}
+
+// SetRole assigns a role to the account
+func SetRole(username string, role Role) error {
+	if !role.Valid() {
+		return fmt.Errorf("unknown role %s", role)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	acc, ok := users[username]
+	if !ok {
+		return fmt.Errorf("no such user %s", username)
+	}
+
+	acc.Role = role
+	return mu.Put("users", username, acc, true)
+}
+
+// Require a logged in user with the role, or a higher one
+func Require(role Role, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r = identify(r)
+
+		acc, ok := FromContext(r.Context())
+		if !ok {
+			unauthorized(w, r)
+			return
+		}
+		if !acc.Has(role) {
+			http.Error(w, "forbidden", 403)
+			return
+		}
+
+		h(w, r)
+	}
+}
+
+// grantAdmins makes the admins in the config admins the first time they're
+// named, if they've signed up by then. Each name is only applied once so a
+// demotion sticks and whoever signs up with the name later isn't an admin.
+// The caller holds the mutex.
+func grantAdmins() {
+	for _, name := range mu.Admins() {
+		var applied time.Time
+		if err := mu.Get("admins", name, &applied, true); !errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if acc, ok := users[name]; ok && acc.Role != RoleAdmin {
+			fmt.Println("Granting admin to", name)
+			acc.Role = RoleAdmin
+			saveAccount(acc)
+		}
+		if err := mu.Put("admins", name, time.Now(), true); err != nil {
+			fmt.Println("Error saving admin", name, err)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package user
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHas(t *testing.T) {
+	tests := []struct {
+		role Role
+		want []bool
+	}{
+		// has member, moderator, admin
+		{"", []bool{true, false, false}},
+		{"unknown", []bool{true, false, false}},
+		{RoleMember, []bool{true, false, false}},
+		{RoleModerator, []bool{true, true, false}},
+		{RoleAdmin, []bool{true, true, true}},
+	}
+
+	for _, tt := range tests {
+		acc := &Account{Role: tt.role}
+		for i, role := range Roles {
+			if got := acc.Has(role); got != tt.want[i] {
+				t.Errorf("%q has %s got %v", tt.role, role, got)
+			}
+		}
+	}
+}
+
+func TestRequire(t *testing.T) {
+	testInit(t)
+	member := testLogin(t, testUser(t, "alice", "correct horse"))
+	testUser(t, "bob", "battery staple")
+	if err := SetRole("bob", RoleModerator); err != nil {
+		t.Fatal(err)
+	}
+	moderator := testLogin(t, users["bob"])
+
+	if err := SetRole("bob", "owner"); err == nil {
+		t.Error("set an unknown role")
+	}
+
+	h := Require(RoleModerator, func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		name     string
+		cookie   *http.Cookie
+		auth     string
+		want     int
+		location string
+	}{
+		{"anonymous", nil, "", 302, "/login"},
+		{"bad token", nil, "Bearer " + tokenPrefix + "bad", 401, ""},
+		{"member", member, "", 403, ""},
+		{"moderator", moderator, "", 200, ""},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/test", nil)
+		if tt.cookie != nil {
+			r.AddCookie(tt.cookie)
+		}
+		if len(tt.auth) > 0 {
+			r.Header.Set("Authorization", tt.auth)
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+
+		if w.Code != tt.want || w.Header().Get("Location") != tt.location {
+			t.Errorf("%s got %d %q, want %d %q", tt.name, w.Code, w.Header().Get("Location"), tt.want, tt.location)
+		}
+	}
+}
+
+func TestGrantAdmins(t *testing.T) {
+	testInit(t)
+	testUser(t, "alice", "correct horse")
+
+	grant := func(name string) {
+		t.Setenv("USER_ADMIN", name)
+		mutex.Lock()
+		grantAdmins()
+		mutex.Unlock()
+	}
+
+	// signing up doesn't make an admin
+	if users["alice"].Role == RoleAdmin {
+		t.Fatal("admin before the config is applied")
+	}
+	grant("alice")
+	if users["alice"].Role != RoleAdmin {
+		t.Fatal("not made an admin")
+	}
+
+	// a demotion sticks after a restart
+	if err := SetRole("alice", RoleMember); err != nil {
+		t.Fatal(err)
+	}
+	mutex.Lock()
+	users = map[string]*Account{}
+	mutex.Unlock()
+	t.Setenv("USER_ADMIN", "alice")
+	load()
+	if users["alice"].Role != RoleMember {
+		t.Errorf("granted again over a demotion")
+	}
+
+	// a name nobody has isn't granted to whoever takes it
+	grant("bob")
+	testUser(t, "bob", "battery staple")
+	grant("bob")
+	if users["bob"].Role == RoleAdmin {
+		t.Error("granted to a later signup")
+	}
+}
@@ -0,0 +1,217 @@
+package user
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"mu.dev"
+)
+
+// session timeouts, set from the user section of mu.yaml
+var (
+	// IdleTimeout expires sessions which haven't been used for this long
+	IdleTimeout = time.Hour * 24 * 7
+	// MaxAge expires sessions this long after login regardless of use
+	MaxAge = time.Hour * 24 * 30
+)
+
+// how often LastSeen is written and expired sessions are reaped
+var (
+	touchInterval = time.Minute
+	reapInterval  = time.Minute * 10
+)
+
+// stops the reaper, made again on each start
+var done = make(chan bool)
+var wg sync.WaitGroup
+
+type Session struct {
+	ID        string
+	Username  string
+	Created   time.Time
+	LastSeen  time.Time
+	ExpiresAt time.Time
+
+	// last use in memory, LastSeen is only written now and then
+	seen time.Time
+}
+
+// Expired if past the absolute or idle timeout
+func (s *Session) Expired() bool {
+	now := time.Now()
+	seen := s.LastSeen
+	if s.seen.After(seen) {
+		seen = s.seen
+	}
+	return now.After(s.ExpiresAt) || now.Sub(seen) > IdleTimeout
+}
+
+func newSess(acc *Account) *Session {
+	id := mu.ID()
+	now := time.Now()
+	sess := &Session{
+		ID:        base64.StdEncoding.EncodeToString([]byte(id)),
+		Username:  acc.Username,
+		Created:   now,
+		LastSeen:  now,
+		ExpiresAt: now.Add(MaxAge),
+	}
+	return sess
+}
+
+// revoke a session, the caller holds the mutex
+func revoke(id string) error {
+	delete(sessions, id)
+	return mu.Delete("sessions", id)
+}
+
+// Logout the user
+func Logout(username string, sess *Session) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	s, ok := sessions[sess.ID]
+	if !ok || s.Username != username {
+		return nil
+	}
+
+	return revoke(sess.ID)
+}
+
+// LogoutAll revokes every session of the user e.g to log out all devices
+func LogoutAll(username string) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	var err error
+	for id, sess := range sessions {
+		if sess.Username != username {
+			continue
+		}
+		if rerr := revoke(id); rerr != nil {
+			err = rerr
+		}
+	}
+	return err
+}
+
+// Verify a session and return it
+func Verify(sessID string) (*Session, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	sess, ok := sessions[sessID]
+	if !ok {
+		return nil, errors.New("invalid session")
+	}
+	if sess.Expired() {
+		revoke(sessID)
+		return nil, errors.New("expired session")
+	}
+	if acc, ok := users[sess.Username]; !ok || acc.Disabled {
+		return nil, errors.New("invalid user")
+	}
+
+	// only write the last seen time now and then
+	now := time.Now()
+	if now.Sub(sess.LastSeen) > touchInterval {
+		sess.LastSeen = now
+		mu.Put("sessions", sess.ID, sess, true)
+	}
+	sess.seen = now
+
+	return sess, nil
+}
+
+type contextKey struct{}
+
+// FromContext returns the logged in account added to the request context
+func FromContext(ctx context.Context) (*Account, bool) {
+	acc, ok := ctx.Value(contextKey{}).(*Account)
+	return acc, ok
+}
+
+// sessionID returns the session id from the signed cookie
+func sessionID(r *http.Request) (string, bool) {
+	c, err := r.Cookie("sess")
+	if err != nil || len(c.Value) == 0 {
+		return "", false
+	}
+	return mu.Unsign(c.Value)
+}
+
+// identify returns the request with the account of a valid session in its context
+func identify(r *http.Request) *http.Request {
+	if _, ok := FromContext(r.Context()); ok {
+		return r
+	}
+
+	// an api request never falls back to the cookies
+	if token, ok := bearer(r); ok {
+		acc, err := VerifyToken(token, r.URL.Path)
+		if err != nil {
+			return r
+		}
+		return r.WithContext(context.WithValue(r.Context(), contextKey{}, acc))
+	}
+
+	id, ok := sessionID(r)
+	if !ok {
+		return r
+	}
+
+	sess, err := Verify(id)
+	if err != nil {
+		return r
+	}
+
+	// deleted or disabled since it was verified
+	mutex.Lock()
+	acc, ok := users[sess.Username]
+	mutex.Unlock()
+	if !ok || acc.Disabled {
+		return r
+	}
+
+	return r.WithContext(context.WithValue(r.Context(), contextKey{}, acc))
+}
+
+// reap deletes expired sessions and old login attempts
+func reap() {
+	ipAttempts.clean()
+	accountFailures.clean()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for id, sess := range sessions {
+		if !sess.Expired() {
+			continue
+		}
+		if err := revoke(id); err != nil {
+			fmt.Println("Error deleting session:", err)
+		}
+	}
+}
+
+// reap expired sessions until done is closed
+func reaper(done chan bool) {
+	defer wg.Done()
+
+	t := time.NewTicker(reapInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			reap()
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package user
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"mu.dev"
+)
+
+func TestIdentify(t *testing.T) {
+	testInit(t)
+	acc := testUser(t, "alice", "correct horse")
+	testUser(t, "bob", "battery staple")
+	cookie := testLogin(t, acc)
+	id, _ := mu.Unsign(cookie.Value)
+
+	tests := []struct {
+		name    string
+		cookies []*http.Cookie
+		want    string
+	}{
+		{"none", nil, ""},
+		{"session", []*http.Cookie{cookie}, "alice"},
+		{"forged user", []*http.Cookie{{Name: "user", Value: "bob"}}, ""},
+		{"forged user with session", []*http.Cookie{cookie, {Name: "user", Value: "bob"}}, "alice"},
+		{"unsigned session", []*http.Cookie{{Name: "sess", Value: id}}, ""},
+		{"resigned session", []*http.Cookie{{Name: "sess", Value: id + ".c2lnbmVk"}}, ""},
+		{"unknown session", []*http.Cookie{{Name: "sess", Value: mu.Sign("unknown")}}, ""},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/home", nil)
+		for _, c := range tt.cookies {
+			r.AddCookie(c)
+		}
+
+		var got string
+		if acc, ok := FromContext(identify(r).Context()); ok {
+			got = acc.Username
+		}
+		if got != tt.want {
+			t.Errorf("%s got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// an account which has gone isn't in the context
+	for _, change := range []func(){
+		func() { acc.Disabled = true },
+		func() { acc.Disabled = false; delete(users, "alice") },
+	} {
+		mutex.Lock()
+		change()
+		mutex.Unlock()
+
+		r := httptest.NewRequest("GET", "/home", nil)
+		r.AddCookie(cookie)
+		if acc, ok := FromContext(identify(r).Context()); ok {
+			t.Errorf("got %+v", acc)
+		}
+	}
+}
+
+func TestExpired(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name string
+		sess Session
+		want bool
+	}{
+		{"new", Session{LastSeen: now, ExpiresAt: now.Add(MaxAge)}, false},
+		{"past max age", Session{LastSeen: now, ExpiresAt: now.Add(-time.Second)}, true},
+		{"idle", Session{LastSeen: now.Add(-IdleTimeout - time.Second), ExpiresAt: now.Add(MaxAge)}, true},
+		// used since LastSeen was last written
+		{"seen", Session{LastSeen: now.Add(-IdleTimeout - time.Second), ExpiresAt: now.Add(MaxAge), seen: now}, false},
+		{"seen past max age", Session{LastSeen: now, ExpiresAt: now.Add(-time.Second), seen: now}, true},
+	}
+
+	for _, tt := range tests {
+		if got := tt.sess.Expired(); got != tt.want {
+			t.Errorf("%s got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestReaper(t *testing.T) {
+	testInit(t)
+	acc := testUser(t, "alice", "correct horse")
+	testLogin(t, acc)
+
+	// idle for too long
+	old := newSess(acc)
+	old.LastSeen = time.Now().Add(-IdleTimeout - time.Minute)
+	if err := mu.Put("sessions", old.ID, old, true); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(d time.Duration) { reapInterval = d }(reapInterval)
+	reapInterval = time.Millisecond * 10
+
+	// started and stopped more than once like a restart in tests
+	app := new(App)
+	for i := 0; i < 2; i++ {
+		if err := app.Start(); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(reapInterval * 5)
+		if err := app.Stop(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, ok := sessions[old.ID]; ok {
+		t.Error("expired session not reaped")
+	}
+	var sess *Session
+	if err := mu.Get("sessions", old.ID, &sess, true); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expired session still stored, got %v", err)
+	}
+	if len(sessions) != 1 {
+		t.Errorf("%d sessions left, want 1", len(sessions))
+	}
+}
+
+func TestLoginRotates(t *testing.T) {
+	testInit(t)
+	acc := testUser(t, "alice", "correct horse")
+	before := testLogin(t, acc)
+	id, _ := mu.Unsign(before.Value)
+
+	r := httptest.NewRequest("POST", "/login", strings.NewReader(url.Values{
+		"username": {"alice"},
+		"password": {"correct horse"},
+	}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(before)
+	w := httptest.NewRecorder()
+	LoginHandler(w, r)
+
+	if w.Code != 302 {
+		t.Fatalf("got %d", w.Code)
+	}
+	var after string
+	for _, c := range w.Result().Cookies() {
+		if c.Name == "sess" {
+			after, _ = mu.Unsign(c.Value)
+		}
+	}
+	if len(after) == 0 || after == id {
+		t.Fatalf("session not rotated, got %q", after)
+	}
+	if _, ok := sessions[id]; ok {
+		t.Error("old session left")
+	}
+	if _, ok := sessions[after]; !ok || len(sessions) != 1 {
+		t.Errorf("new session missing from %d", len(sessions))
+	}
+}
+
+func TestLogoutAll(t *testing.T) {
+	testInit(t)
+	alice := testUser(t, "alice", "correct horse")
+	bob := testUser(t, "bob", "battery staple")
+
+	testLogin(t, alice)
+	testLogin(t, alice)
+	kept := testLogin(t, bob)
+
+	if err := LogoutAll("alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, _ := mu.List("sessions")
+	id, _ := mu.Unsign(kept.Value)
+	if len(sessions) != 1 || sessions[id] == nil || len(keys) != 1 || keys[0] != id {
+		t.Errorf("got %d sessions and stored %v, want bob's", len(sessions), keys)
+	}
+}
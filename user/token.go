@@ -0,0 +1,248 @@
+package user
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"mu.dev"
+)
+
+// tokens start with this so they're easy to spot in scripts and logs
+const tokenPrefix = "mu_"
+
+// the username for each token hash, guarded by the mutex
+var tokenOwners = map[string]string{}
+
+// Token is a personal API token sent as Authorization: Bearer
+type Token struct {
+	ID   string
+	Name string
+	// Hash is the sha256 of the token, which is only shown when created
+	Hash string
+	// Scopes are the apps the token can call e.g chat
+	Scopes   []string
+	Created  time.Time
+	LastUsed time.Time
+}
+
+// Allows reports whether the path is under one of the token's apps
+func (t *Token) Allows(path string) bool {
+	first, _, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	for _, s := range t.Scopes {
+		if s == first {
+			return true
+		}
+	}
+	return false
+}
+
+var tokensTmpl = mu.Template("tokens", `
+{{define "title"}}API tokens{{end}}
+{{define "description"}}Personal API tokens{{end}}
+{{define "content"}}
+<div style="padding-top: 100px;">
+<h1>API tokens</h1>
+{{if .New}}
+<p>Copy the token now, it won't be shown again.</p>
+<p><code>{{.New}}</code></p>
+{{end}}
+<p>Send a token as <code>Authorization: Bearer &lt;token&gt;</code> to call the apps it's scoped to.</p>
+{{range .Tokens}}
+<form action="/account/tokens" method="post">{{csrfField}}
+  {{.Name}} - {{range $i, $s := .Scopes}}{{if $i}}, {{end}}{{$s}}{{end}} -
+  created {{.Created.Format "2 January 2006"}}{{if not .LastUsed.IsZero}}, last used {{.LastUsed.Format "2 January 2006 15:04"}}{{end}}
+  <input type="hidden" name="action" value="revoke">
+  <input type="hidden" name="id" value="{{.ID}}">
+  <button>Revoke</button>
+</form>
+{{end}}
+<h2>New token</h2>
+<form action="/account/tokens" method="post">{{csrfField}}
+  <input type="hidden" name="action" value="create">
+  <input name="name" placeholder="Name e.g My script" required>
+  <br><br>
+  {{range .Scopes}}<label><input type="checkbox" name="scope" value="{{.}}"> {{.}}</label> {{end}}
+  <br><br>
+  <button>Create</button>
+</form>
+<p><a href="/account">Back</a></p>
+</div>
+{{end}}
+`)
+
+// tokenScopes are the apps a token can be scoped to, not the user app
+// so a token can't manage the account
+func tokenScopes() []string {
+	var scopes []string
+	for _, app := range mu.Apps() {
+		if _, ok := app.(*App); ok {
+			continue
+		}
+		scopes = append(scopes, strings.ToLower(app.Name()))
+	}
+	sort.Strings(scopes)
+	return scopes
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewToken creates a token for the user, returning it to show once
+func NewToken(username, name string, scopes []string) (string, error) {
+	if len(strings.TrimSpace(name)) == 0 {
+		return "", errors.New("name required")
+	}
+	if len(scopes) == 0 {
+		return "", errors.New("pick at least one scope")
+	}
+	valid := tokenScopes()
+	for _, s := range scopes {
+		i := sort.SearchStrings(valid, s)
+		if i == len(valid) || valid[i] != s {
+			return "", errors.New("unknown scope " + s)
+		}
+	}
+
+	b := make([]byte, 32)
+	rand.Read(b)
+	token := tokenPrefix + b64.EncodeToString(b)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	acc, ok := users[username]
+	if !ok {
+		return "", errors.New("no such user")
+	}
+
+	t := &Token{
+		ID:      mu.ID(),
+		Name:    name,
+		Hash:    hashToken(token),
+		Scopes:  scopes,
+		Created: time.Now(),
+	}
+	acc.Tokens = append(acc.Tokens, t)
+	if err := mu.Put("users", username, acc, true); err != nil {
+		acc.Tokens = acc.Tokens[:len(acc.Tokens)-1]
+		return "", err
+	}
+	tokenOwners[t.Hash] = username
+
+	return token, nil
+}
+
+// RevokeToken deletes one of the user's tokens
+func RevokeToken(username, id string) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	acc, ok := users[username]
+	if !ok {
+		return errors.New("no such user")
+	}
+
+	var tokens []*Token
+	for _, t := range acc.Tokens {
+		if t.ID != id {
+			tokens = append(tokens, t)
+		} else {
+			delete(tokenOwners, t.Hash)
+		}
+	}
+	acc.Tokens = tokens
+	return mu.Put("users", username, acc, true)
+}
+
+// bearer returns the token from the Authorization header
+func bearer(r *http.Request) (string, bool) {
+	v := r.Header.Get("Authorization")
+	if len(v) < 7 || !strings.EqualFold(v[:7], "bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(v[7:]), true
+}
+
+// VerifyToken returns the account for a token scoped to the path
+func VerifyToken(token, path string) (*Account, error) {
+	if !strings.HasPrefix(token, tokenPrefix) {
+		return nil, errors.New("invalid token")
+	}
+	hash := []byte(hashToken(token))
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	acc, ok := users[tokenOwners[string(hash)]]
+	if ok {
+		for _, t := range acc.Tokens {
+			if subtle.ConstantTimeCompare([]byte(t.Hash), hash) != 1 {
+				continue
+			}
+			if acc.Disabled {
+				return nil, ErrDisabled
+			}
+			if !t.Allows(path) {
+				return nil, errors.New("token not scoped for " + path)
+			}
+			// only write the last used time now and then
+			if time.Since(t.LastUsed) > touchInterval {
+				t.LastUsed = time.Now()
+				saveAccount(acc)
+			}
+			return acc, nil
+		}
+	}
+
+	return nil, errors.New("invalid token")
+}
+
+// TokensHandler lists, creates and revokes the user's API tokens
+func TokensHandler(w http.ResponseWriter, r *http.Request) {
+	acc, _ := FromContext(r.Context())
+
+	var created string
+
+	if r.Method == "POST" {
+		var err error
+		switch r.PostFormValue("action") {
+		case "create":
+			created, err = NewToken(acc.Username, r.PostFormValue("name"), r.PostForm["scope"])
+		case "revoke":
+			err = RevokeToken(acc.Username, r.PostFormValue("id"))
+		default:
+			err = errors.New("unknown action")
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		// show a new token straight away rather than redirect so it's not in a url
+		if len(created) == 0 {
+			http.Redirect(w, r, "/account/tokens", 302)
+			return
+		}
+	}
+
+	var tokens []Token
+	mutex.Lock()
+	for _, t := range acc.Tokens {
+		tokens = append(tokens, *t)
+	}
+	mutex.Unlock()
+
+	mu.Render(w, tokensTmpl, map[string]interface{}{
+		"Tokens": tokens,
+		"Scopes": tokenScopes(),
+		"New":    created,
+	})
+}
@@ -0,0 +1,196 @@
+package user
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"mu.dev"
+)
+
+func TestTokenAllows(t *testing.T) {
+	tok := &Token{Scopes: []string{"chat", "news"}}
+
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/chat", true},
+		{"/chat/prompt", true},
+		{"chat", true},
+		{"/news/", true},
+		{"/chatter", false},
+		{"/watch/chat", false},
+		{"/account", false},
+		{"/", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := tok.Allows(tt.path); got != tt.want {
+			t.Errorf("%q got %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestTokens(t *testing.T) {
+	testInit(t)
+	testUser(t, "alice", "correct horse")
+
+	for _, bad := range []struct {
+		name   string
+		scopes []string
+	}{
+		{"", []string{"test"}},
+		{"script", nil},
+		{"script", []string{"user"}},
+		{"script", []string{"nothing"}},
+	} {
+		if _, err := NewToken("alice", bad.name, bad.scopes); err == nil {
+			t.Errorf("created %q with %v", bad.name, bad.scopes)
+		}
+	}
+	if _, err := NewToken("nobody", "script", []string{"test"}); err == nil {
+		t.Error("created for an unknown user")
+	}
+
+	token, err := NewToken("alice", "script", []string{"test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(token, tokenPrefix) {
+		t.Errorf("got %q", token)
+	}
+
+	// only the hash is stored
+	var stored Account
+	if err := mu.Get("users", "alice", &stored, true); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(stored)
+	if strings.Contains(string(b), token) || strings.Contains(string(b), strings.TrimPrefix(token, tokenPrefix)) {
+		t.Error("token stored in the clear")
+	}
+	if len(stored.Tokens) != 1 || stored.Tokens[0].Hash != hashToken(token) {
+		t.Errorf("stored tokens %+v", stored.Tokens)
+	}
+
+	acc, err := VerifyToken(token, "/test/api")
+	if err != nil || acc.Username != "alice" {
+		t.Fatalf("verify got %v", err)
+	}
+	if time.Since(acc.Tokens[0].LastUsed) > time.Minute {
+		t.Error("last used not set")
+	}
+
+	for _, bad := range []struct{ token, path string }{
+		{token, "/chat"},
+		{token, "/account/tokens"},
+		{strings.TrimPrefix(token, tokenPrefix), "/test"},
+		{token + "x", "/test"},
+		{tokenPrefix + "unknown", "/test"},
+	} {
+		if _, err := VerifyToken(bad.token, bad.path); err == nil {
+			t.Errorf("verified %.10s for %s", bad.token, bad.path)
+		}
+	}
+
+	if err := SetDisabled("alice", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyToken(token, "/test"); !errors.Is(err, ErrDisabled) {
+		t.Errorf("disabled got %v, want %v", err, ErrDisabled)
+	}
+	SetDisabled("alice", false)
+
+	// found again after a restart
+	mutex.Lock()
+	users = map[string]*Account{}
+	tokenOwners = map[string]string{}
+	mutex.Unlock()
+	load()
+	if _, err := VerifyToken(token, "/test"); err != nil {
+		t.Errorf("after loading got %v", err)
+	}
+
+	mutex.Lock()
+	id := users["alice"].Tokens[0].ID
+	mutex.Unlock()
+	if err := RevokeToken("alice", id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyToken(token, "/test"); err == nil {
+		t.Error("revoked token verified")
+	}
+	if err := mu.Get("users", "alice", &stored, true); err != nil || len(stored.Tokens) != 0 {
+		t.Errorf("stored tokens after revoke %+v %v", stored.Tokens, err)
+	}
+
+	// and gone with the account
+	token, _ = NewToken("alice", "script", []string{"test"})
+	if err := Delete("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyToken(token, "/test"); err == nil || len(tokenOwners) != 0 {
+		t.Errorf("deleted user's token got %v, %d left", err, len(tokenOwners))
+	}
+}
+
+func TestBearer(t *testing.T) {
+	testInit(t)
+	acc := testUser(t, "alice", "correct horse")
+	sess := testLogin(t, acc)
+
+	token, err := NewToken("alice", "script", []string{"test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		auth   string
+		cookie bool
+		want   int
+		user   string
+	}{
+		{"token", "Bearer " + token, false, 200, "alice"},
+		{"lower case", "bearer " + token, false, 200, "alice"},
+		{"cookie without csrf", "", true, 403, ""},
+		{"bad token", "Bearer " + tokenPrefix + "bad", false, 401, ""},
+		// a bad token doesn't fall back to the session
+		{"bad token with cookie", "Bearer " + tokenPrefix + "bad", true, 401, ""},
+		{"basic", "Basic YWxpY2U6cGFzcw==", false, 403, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var user string
+			h := Identify(CSRF(Auth(func(w http.ResponseWriter, r *http.Request) {
+				if acc, ok := FromContext(r.Context()); ok {
+					user = acc.Username
+				}
+			})))
+
+			r := httptest.NewRequest("POST", "/test/api", strings.NewReader("{}"))
+			if len(tt.auth) > 0 {
+				r.Header.Set("Authorization", tt.auth)
+			}
+			if tt.cookie {
+				r.AddCookie(sess)
+			}
+			w := httptest.NewRecorder()
+			h(w, r)
+
+			if w.Code != tt.want || user != tt.user {
+				t.Errorf("got %d as %q, want %d as %q", w.Code, user, tt.want, tt.user)
+			}
+			if tt.want == 401 && !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Bearer") {
+				t.Error("no WWW-Authenticate header")
+			}
+		})
+	}
+}
@@ -0,0 +1,434 @@
+package user
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+	"golang.org/x/crypto/bcrypt"
+
+	"mu.dev"
+)
+
+// RFC 6238 with the defaults authenticator apps expect
+const (
+	totpDigits = 6
+	totpPeriod = 30
+	// steps either side of now to allow for clock drift
+	totpSkew = 1
+	// recovery codes given on enrolment
+	recoveryCodes = 10
+)
+
+// how long the code can be entered after the password
+var challengeTimeout = time.Minute * 5
+
+var ErrTwoFactor = errors.New("two factor code required")
+
+// password checked, waiting on the code, keyed by id
+var challenges = map[string]*challenge{}
+
+// secrets being enrolled by username until confirmed with a code
+var pending = map[string]string{}
+
+var totpMutex sync.Mutex
+
+type challenge struct {
+	Username string
+	Expires  time.Time
+}
+
+var twoFactorTmpl = mu.Template("2fa", `
+{{define "title"}}Two factor{{end}}
+{{define "description"}}Enter your code{{end}}
+{{define "content"}}
+<div style="padding-top: 100px;">
+<h1>Two factor</h1>
+<form action="/login/2fa" method="post">{{csrfField}}
+  <input name="code" placeholder="Code or recovery code" autocomplete="one-time-code" autofocus>
+  <br><br>
+  <button>Submit</button>
+</form>
+</div>
+{{end}}
+`)
+
+var enrolTmpl = mu.Template("2fa-enrol", `
+{{define "title"}}Two factor{{end}}
+{{define "description"}}Two factor authentication{{end}}
+{{define "content"}}
+<div style="padding-top: 100px;">
+<h1>Two factor</h1>
+{{if .Codes}}
+<p>Two factor is on. Keep these recovery codes somewhere safe, each works once if you lose your device. They won't be shown again.</p>
+<pre>{{range .Codes}}{{.}}
+{{end}}</pre>
+<a href="/account">Done</a>
+{{else if .Enabled}}
+<p>Two factor is on. Enter a code to turn it off.</p>
+<form action="/account/2fa" method="post">{{csrfField}}
+  <input name="code" placeholder="Code or recovery code" autocomplete="one-time-code">
+  <input type="hidden" name="action" value="disable">
+  <button>Turn off</button>
+</form>
+{{else}}
+<p>Scan the code with an authenticator app, or enter the secret, then enter the code it shows.</p>
+<img src="{{.QR}}" alt="QR code" width="256" height="256">
+<p><code>{{.Secret}}</code></p>
+<form action="/account/2fa" method="post">{{csrfField}}
+  <input name="code" placeholder="Code" autocomplete="one-time-code" autofocus>
+  <input type="hidden" name="action" value="enable">
+  <button>Turn on</button>
+</form>
+{{end}}
+</div>
+{{end}}
+`)
+
+// totpCode is the code for a base32 secret at a time step
+func totpCode(secret string, step int64) (string, error) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+
+	m := hmac.New(sha1.New, key)
+	m.Write(msg[:])
+	sum := m.Sum(nil)
+
+	// dynamic truncation
+	off := sum[len(sum)-1] & 0xf
+	v := binary.BigEndian.Uint32(sum[off:]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", totpDigits, v%mod), nil
+}
+
+// totpStep returns the step the code is valid for, or -1
+func totpStep(secret, code string, now time.Time) int64 {
+	step := now.Unix() / totpPeriod
+	for i := -totpSkew; i <= totpSkew; i++ {
+		c, err := totpCode(secret, step+int64(i))
+		if err == nil && hmac.Equal([]byte(c), []byte(code)) {
+			return step + int64(i)
+		}
+	}
+	return -1
+}
+
+// newSecret is 160 bits as recommended by RFC 4226
+func newSecret() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+}
+
+// provisioningURI is the otpauth uri scanned by authenticator apps
+func provisioningURI(issuer, username, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + url.PathEscape(issuer+":"+username) + "?" + v.Encode()
+}
+
+// newRecoveryCodes returns the codes to show and their hashes to store
+func newRecoveryCodes() ([]string, []string, error) {
+	var codes, hashes []string
+	for i := 0; i < recoveryCodes; i++ {
+		b := make([]byte, 5)
+		rand.Read(b)
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+		h, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, nil, err
+		}
+		codes = append(codes, code)
+		hashes = append(hashes, string(h))
+	}
+	return codes, hashes, nil
+}
+
+// checkCode checks a code or recovery code, using it up. The caller holds the
+// mutex, which is released while the recovery codes are compared.
+func checkCode(acc *Account, code string) bool {
+	code = strings.ToLower(strings.ReplaceAll(code, " ", ""))
+
+	if step := totpStep(acc.TOTPSecret, code, time.Now()); step > acc.TOTPStep {
+		// a code can't be used twice
+		acc.TOTPStep = step
+		saveAccount(acc)
+		return true
+	}
+
+	// recovery codes are longer, skip the slow compares
+	if len(code) == totpDigits {
+		return false
+	}
+
+	// bcrypt is slow so don't hold up every other request
+	hashes := append([]string{}, acc.RecoveryCodes...)
+	mutex.Unlock()
+	var match string
+	for _, h := range hashes {
+		if bcrypt.CompareHashAndPassword([]byte(h), []byte(code)) == nil {
+			match = h
+			break
+		}
+	}
+	mutex.Lock()
+
+	// deleted or replaced meanwhile so there's nothing to use up
+	if len(match) == 0 || users[acc.Username] != acc {
+		return false
+	}
+
+	// use it up unless another request got there first
+	for i, h := range acc.RecoveryCodes {
+		if h == match {
+			acc.RecoveryCodes = append(acc.RecoveryCodes[:i:i], acc.RecoveryCodes[i+1:]...)
+			saveAccount(acc)
+			return true
+		}
+	}
+
+	return false
+}
+
+// LoginCode completes a login after the password with a code or recovery code
+func LoginCode(username, code string) (*Account, *Session, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if accountFailures.count(username) >= accountLimit {
+		return nil, nil, ErrTooManyAttempts
+	}
+
+	acc, ok := users[username]
+	if !ok || len(acc.TOTPSecret) == 0 {
+		return nil, nil, ErrInvalidLogin
+	}
+	if acc.Locked() {
+		return nil, nil, ErrTooManyAttempts
+	}
+	if acc.Disabled {
+		return nil, nil, ErrDisabled
+	}
+
+	ok = checkCode(acc, code)
+
+	// the mutex was let go while checking so look again
+	if users[username] != acc || len(acc.TOTPSecret) == 0 {
+		return nil, nil, ErrInvalidLogin
+	}
+	if acc.Disabled {
+		return nil, nil, ErrDisabled
+	}
+	if !ok {
+		failed(username, acc)
+		return nil, nil, errors.New("invalid code")
+	}
+
+	return acc, login(acc), nil
+}
+
+// ResetTwoFactor turns off two factor e.g for a user who lost their device
+func ResetTwoFactor(username string) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	acc, ok := users[username]
+	if !ok {
+		return errors.New("no such user")
+	}
+
+	acc.TOTPSecret = ""
+	acc.TOTPStep = 0
+	acc.RecoveryCodes = nil
+
+	return mu.Put("users", username, acc, true)
+}
+
+// newChallenge remembers the password was right and sets a cookie to continue with the code
+func newChallenge(w http.ResponseWriter, username string) {
+	id := mu.ID()
+
+	totpMutex.Lock()
+	// drop any which were never completed
+	for k, c := range challenges {
+		if time.Now().After(c.Expires) {
+			delete(challenges, k)
+		}
+	}
+	challenges[id] = &challenge{Username: username, Expires: time.Now().Add(challengeTimeout)}
+	totpMutex.Unlock()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "2fa",
+		Value:    mu.Sign(id),
+		Path:     "/login/2fa",
+		MaxAge:   int(challengeTimeout.Seconds()),
+		Secure:   mu.Secure(),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// TwoFactorHandler is the second login step
+func TwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	var id string
+	if c, err := r.Cookie("2fa"); err == nil {
+		id, _ = mu.Unsign(c.Value)
+	}
+
+	totpMutex.Lock()
+	ch, ok := challenges[id]
+	totpMutex.Unlock()
+
+	if !ok || time.Now().After(ch.Expires) {
+		http.Redirect(w, r, "/login", 302)
+		return
+	}
+
+	if r.Method != "POST" {
+		mu.Render(w, twoFactorTmpl, nil)
+		return
+	}
+
+	if !allowIP(r) {
+		http.Error(w, ErrTooManyAttempts.Error(), 429)
+		return
+	}
+
+	_, sess, err := LoginCode(ch.Username, r.PostFormValue("code"))
+	if err == ErrTooManyAttempts {
+		http.Error(w, err.Error(), 429)
+		return
+	} else if err == ErrDisabled {
+		http.Error(w, err.Error(), 403)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), 401)
+		return
+	}
+
+	totpMutex.Lock()
+	delete(challenges, id)
+	totpMutex.Unlock()
+
+	http.SetCookie(w, &http.Cookie{Name: "2fa", Path: "/login/2fa", MaxAge: -1})
+	setCookies(w, r, sess)
+	http.Redirect(w, r, "/home", 302)
+}
+
+// EnrolHandler turns two factor on and off for the logged in user
+func EnrolHandler(w http.ResponseWriter, r *http.Request) {
+	acc, _ := FromContext(r.Context())
+
+	if r.Method == "POST" {
+		if !allowIP(r) {
+			http.Error(w, ErrTooManyAttempts.Error(), 429)
+			return
+		}
+
+		code := r.PostFormValue("code")
+
+		switch r.PostFormValue("action") {
+		case "enable":
+			totpMutex.Lock()
+			secret := pending[acc.Username]
+			totpMutex.Unlock()
+
+			step := totpStep(secret, strings.TrimSpace(code), time.Now())
+			if len(secret) == 0 || step < 0 {
+				http.Error(w, "invalid code", 400)
+				return
+			}
+
+			codes, hashes, err := newRecoveryCodes()
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+
+			mutex.Lock()
+			acc.TOTPSecret = secret
+			acc.TOTPStep = step
+			acc.RecoveryCodes = hashes
+			err = mu.Put("users", acc.Username, acc, true)
+			mutex.Unlock()
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+
+			totpMutex.Lock()
+			delete(pending, acc.Username)
+			totpMutex.Unlock()
+
+			mu.Render(w, enrolTmpl, map[string]interface{}{"Codes": codes})
+		case "disable":
+			mutex.Lock()
+			ok := len(acc.TOTPSecret) > 0 && checkCode(acc, code)
+			mutex.Unlock()
+			if !ok {
+				http.Error(w, "invalid code", 400)
+				return
+			}
+			if err := ResetTwoFactor(acc.Username); err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+			http.Redirect(w, r, "/account", 302)
+		default:
+			http.Error(w, "unknown action", 400)
+		}
+		return
+	}
+
+	if len(acc.TOTPSecret) > 0 {
+		mu.Render(w, enrolTmpl, map[string]interface{}{"Enabled": true})
+		return
+	}
+
+	// keep the same secret until it's confirmed so a reload doesn't break a scan
+	totpMutex.Lock()
+	secret, ok := pending[acc.Username]
+	if !ok {
+		secret = newSecret()
+		pending[acc.Username] = secret
+	}
+	totpMutex.Unlock()
+
+	uri := provisioningURI("Mu", acc.Username, secret)
+	png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	mu.Render(w, enrolTmpl, map[string]interface{}{
+		"Secret": secret,
+		"QR":     template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png)),
+	})
+}
@@ -0,0 +1,307 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"mu.dev"
+)
+
+// testTwoFactor turns two factor on for the account with the recovery codes
+func testTwoFactor(t *testing.T, acc *Account, cost int, codes ...string) {
+	t.Helper()
+
+	var hashes []string
+	for _, c := range codes {
+		h, err := bcrypt.GenerateFromPassword([]byte(c), cost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, string(h))
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	acc.TOTPSecret = newSecret()
+	acc.TOTPStep = 0
+	acc.RecoveryCodes = hashes
+	saveAccount(acc)
+}
+
+// testCode is the account's code a number of steps from now
+func testCode(t *testing.T, acc *Account, steps int64) string {
+	t.Helper()
+
+	c, err := totpCode(acc.TOTPSecret, time.Now().Unix()/totpPeriod+steps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestCheckCode(t *testing.T) {
+	testInit(t)
+	acc := testUser(t, "alice", "correct horse")
+	codes := []string{"aaaabbbb", "ccccdddd", "eeeeffff"}
+	testTwoFactor(t, acc, bcrypt.MinCost, codes...)
+
+	now := testCode(t, acc, 0)
+	old := testCode(t, acc, -5)
+
+	tests := []struct {
+		name string
+		code string
+		ok   bool
+	}{
+		{"code", now, true},
+		{"replayed code", now, false},
+		{"old code", old, false},
+		{"wrong", "000000", false},
+		{"recovery code", codes[0], true},
+		{"recovery code spaced", " " + codes[1][:4] + " " + codes[1][4:], true},
+		{"used recovery code", codes[0], false},
+		{"unknown recovery code", "gggghhhh", false},
+	}
+
+	for _, tt := range tests {
+		mutex.Lock()
+		ok := checkCode(acc, tt.code)
+		mutex.Unlock()
+
+		if ok != tt.ok {
+			t.Errorf("%s got %v, want %v", tt.name, ok, tt.ok)
+		}
+	}
+
+	if len(acc.RecoveryCodes) != 1 {
+		t.Errorf("%d recovery codes left, want 1", len(acc.RecoveryCodes))
+	}
+}
+
+func TestLoginCode(t *testing.T) {
+	testInit(t)
+	acc := testUser(t, "alice", "correct horse")
+	testUser(t, "bob", "battery staple")
+	testTwoFactor(t, acc, bcrypt.MinCost, "aaaabbbb", "ccccdddd")
+
+	if _, _, err := LoginCode("bob", "000000"); !errors.Is(err, ErrInvalidLogin) {
+		t.Errorf("without two factor got %v", err)
+	}
+	if _, _, err := LoginCode("nobody", "000000"); !errors.Is(err, ErrInvalidLogin) {
+		t.Errorf("unknown user got %v", err)
+	}
+
+	if _, _, err := LoginCode("alice", "000000"); err == nil {
+		t.Error("logged in with a wrong code")
+	}
+	if acc.FailedLogins != 1 {
+		t.Errorf("%d failed logins, want 1", acc.FailedLogins)
+	}
+
+	code := testCode(t, acc, 0)
+	got, sess, err := LoginCode("alice", code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != acc || sess == nil || sessions[sess.ID] != sess || acc.FailedLogins != 0 {
+		t.Errorf("got %v %+v, %d failed logins", got, sess, acc.FailedLogins)
+	}
+	if _, _, err := LoginCode("alice", code); err == nil {
+		t.Error("logged in with a replayed code")
+	}
+
+	// recovery codes work once and stay used after a restart
+	if _, _, err := LoginCode("alice", "AAAA BBBB"); err != nil {
+		t.Errorf("recovery code got %v", err)
+	}
+	if _, _, err := LoginCode("alice", "aaaabbbb"); err == nil {
+		t.Error("recovery code used twice")
+	}
+	var stored Account
+	if err := mu.Get("users", "alice", &stored, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(stored.RecoveryCodes) != 1 {
+		t.Errorf("stored %d recovery codes, want 1", len(stored.RecoveryCodes))
+	}
+
+	if err := SetDisabled("alice", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := LoginCode("alice", "ccccdddd"); !errors.Is(err, ErrDisabled) {
+		t.Errorf("disabled got %v, want %v", err, ErrDisabled)
+	}
+}
+
+func TestLoginCodeWithoutMutex(t *testing.T) {
+	testInit(t)
+	acc := testUser(t, "alice", "correct horse")
+
+	// slow enough to be comparing while the test takes the mutex
+	testTwoFactor(t, acc, 11, "aaaabbbb")
+
+	res := make(chan error)
+	go func() {
+		_, _, err := LoginCode("alice", "aaaabbbb")
+		res <- err
+	}()
+
+	time.Sleep(time.Millisecond * 20)
+	mutex.Lock()
+	// deleted while it's comparing
+	delete(users, "alice")
+	mu.Delete("users", "alice")
+	mutex.Unlock()
+
+	if err := <-res; !errors.Is(err, ErrInvalidLogin) {
+		t.Errorf("got %v, want %v", err, ErrInvalidLogin)
+	}
+
+	// not written back
+	var stored Account
+	if err := mu.Get("users", "alice", &stored, true); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("account saved after delete, got %v", err)
+	}
+	if len(sessions) != 0 {
+		t.Errorf("got %d sessions", len(sessions))
+	}
+}
+
+func TestTwoFactorHandler(t *testing.T) {
+	testInit(t)
+	acc := testUser(t, "alice", "correct horse")
+	testTwoFactor(t, acc, bcrypt.MinCost)
+
+	// the cookie set after the password
+	w := httptest.NewRecorder()
+	newChallenge(w, "alice")
+	cookie := w.Result().Cookies()[0]
+
+	post := func(c *http.Cookie, code string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/login/2fa", strings.NewReader(url.Values{"code": {code}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if c != nil {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		TwoFactorHandler(w, r)
+		return w
+	}
+
+	forged := &http.Cookie{Name: "2fa", Value: cookie.Value[:strings.LastIndex(cookie.Value, ".")] + ".forged"}
+	for _, c := range []*http.Cookie{nil, forged} {
+		if w := post(c, testCode(t, acc, 0)); w.Code != 302 || w.Header().Get("Location") != "/login" {
+			t.Errorf("%v got %d %s", c, w.Code, w.Header().Get("Location"))
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/login/2fa", nil)
+	r.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	TwoFactorHandler(w, r)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `name="code"`) {
+		t.Errorf("form got %d", w.Code)
+	}
+
+	if w := post(cookie, "000000"); w.Code != 401 {
+		t.Errorf("wrong code got %d", w.Code)
+	}
+
+	w = post(cookie, testCode(t, acc, 0))
+	if w.Code != 302 || w.Header().Get("Location") != "/home" {
+		t.Fatalf("got %d %s", w.Code, w.Header().Get("Location"))
+	}
+	var sess bool
+	for _, c := range w.Result().Cookies() {
+		sess = sess || (c.Name == "sess" && len(c.Value) > 0)
+	}
+	if !sess || len(sessions) != 1 {
+		t.Errorf("no session, %d stored", len(sessions))
+	}
+
+	// done with
+	if w := post(cookie, testCode(t, acc, 1)); w.Code != 302 || w.Header().Get("Location") != "/login" {
+		t.Errorf("reused challenge got %d %s", w.Code, w.Header().Get("Location"))
+	}
+
+	// and expires
+	defer func(d time.Duration) { challengeTimeout = d }(challengeTimeout)
+	challengeTimeout = -time.Second
+	w = httptest.NewRecorder()
+	newChallenge(w, "alice")
+	if w := post(w.Result().Cookies()[0], testCode(t, acc, 1)); w.Code != 302 || w.Header().Get("Location") != "/login" {
+		t.Errorf("expired challenge got %d %s", w.Code, w.Header().Get("Location"))
+	}
+}
+
+func TestEnrolHandler(t *testing.T) {
+	testInit(t)
+	acc := testUser(t, "alice", "correct horse")
+	ctx := context.WithValue(context.Background(), contextKey{}, acc)
+
+	do := func(method string, form url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/account/2fa", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		EnrolHandler(w, r.WithContext(ctx))
+		return w
+	}
+
+	// the same secret until it's confirmed
+	if w := do("GET", nil); w.Code != 200 || !strings.Contains(w.Body.String(), "data:image/png;base64,") {
+		t.Fatalf("got %d", w.Code)
+	}
+	secret := pending["alice"]
+	if w := do("GET", nil); !strings.Contains(w.Body.String(), secret) || pending["alice"] != secret {
+		t.Error("secret changed on reload")
+	}
+
+	if w := do("POST", url.Values{"action": {"enable"}, "code": {"000000"}}); w.Code != 400 || len(acc.TOTPSecret) > 0 {
+		t.Errorf("wrong code got %d", w.Code)
+	}
+	if w := do("POST", url.Values{"action": {"other"}}); w.Code != 400 {
+		t.Errorf("unknown action got %d", w.Code)
+	}
+
+	code, _ := totpCode(secret, time.Now().Unix()/totpPeriod)
+	w := do("POST", url.Values{"action": {"enable"}, "code": {code}})
+	if w.Code != 200 || acc.TOTPSecret != secret || len(acc.RecoveryCodes) != recoveryCodes {
+		t.Fatalf("enable got %d with %d recovery codes", w.Code, len(acc.RecoveryCodes))
+	}
+	if _, ok := pending["alice"]; ok {
+		t.Error("still pending")
+	}
+	var stored Account
+	if err := mu.Get("users", "alice", &stored, true); err != nil || stored.TOTPSecret != secret {
+		t.Errorf("not stored %v", err)
+	}
+
+	// the codes are shown once
+	body := w.Body.String()
+	start := strings.Index(body, "<pre>") + len("<pre>")
+	shown := strings.Fields(body[start : start+strings.Index(body[start:], "</pre>")])
+	if len(shown) != recoveryCodes {
+		t.Fatalf("showed %d recovery codes", len(shown))
+	}
+	if w := do("GET", nil); w.Code != 200 || strings.Contains(w.Body.String(), shown[0]) {
+		t.Error("recovery codes shown again")
+	}
+
+	// the enrolling code can't turn it off again
+	if w := do("POST", url.Values{"action": {"disable"}, "code": {code}}); w.Code != 400 || len(acc.TOTPSecret) == 0 {
+		t.Errorf("disable with a used code got %d", w.Code)
+	}
+	if w := do("POST", url.Values{"action": {"disable"}, "code": {shown[0]}}); w.Code != 302 || len(acc.TOTPSecret) > 0 || len(acc.RecoveryCodes) > 0 {
+		t.Errorf("disable got %d", w.Code)
+	}
+}
@@ -2,12 +2,11 @@
 package user
 
 import (
-	"encoding/base64"
 	"errors"
 	"fmt"
+	"html/template"
 	"net/http"
 	"os"
-	"sort"
 	"sync"
 	"time"
 
@@ -20,12 +19,225 @@ var mutex sync.Mutex
 var users = map[string]*Account{}
 var sessions = map[string]*Session{}
 
-var admin = os.Getenv("USER_ADMIN")
+var loginTmpl = mu.Template("login", `
+{{define "title"}}Login{{end}}
+{{define "description"}}Login to your account{{end}}
+{{define "content"}}
+<style>
+  #login {
+    padding-top: 100px;
+  }
+</style>
+<div id="login">
+<h1>Login</h1>
+<form action="/login" method="post">{{csrfField}}
+  <input id="username" name="username" placeholder=Username autocomplete="username webauthn">
+  <br><br>
+  <input id="password" name="password" type="password" placeholder=Password>
+  <br><br>
+  <button>Submit</button>
+</form>
+<br>
+<button id="passkey" style="display: none;">Login with a passkey</button>
+{{range .Providers}}
+<p><a href="/login/oidc/{{.Name}}">Login with {{.Label}}</a></p>
+{{end}}
+<p id="error"></p>
+</div>
+<script>
+{{.JS}}
+if (window.PublicKeyCredential) {
+  var btn = document.getElementById("passkey");
+  btn.style.display = "inline-block";
+  btn.onclick = function() {
+    post("/login/passkey/begin").then(opts => {
+      opts.challenge = b64ToBuf(opts.challenge);
+      return navigator.credentials.get({publicKey: opts});
+    }).then(cred => post("/login/passkey/finish", {
+      id: bufToB64(cred.rawId),
+      response: {
+        clientDataJSON: bufToB64(cred.response.clientDataJSON),
+        authenticatorData: bufToB64(cred.response.authenticatorData),
+        signature: bufToB64(cred.response.signature),
+        userHandle: cred.response.userHandle ? bufToB64(cred.response.userHandle) : "",
+      },
+    })).then(rsp => { window.location = rsp.redirect; })
+      .catch(err => { document.getElementById("error").innerText = err.message; });
+  };
+}
+</script>
+{{end}}
+`)
+
+var signupTmpl = mu.Template("signup", `
+{{define "title"}}Signup{{end}}
+{{define "description"}}Signup for an account{{end}}
+{{define "content"}}
+<style>
+  #signup {
+    padding-top: 100px;
+  }
+</style>
+<div id="signup">
+<h1>Signup</h1>
+{{if eq .Mode "closed"}}
+<p>Signup is closed.</p>
+{{else}}
+<form action="/signup" method="post">{{csrfField}}
+  <input id="username" name="username" placeholder=Username pattern="[a-z0-9][a-z0-9_\-]{2,31}" title="3 to 32 lowercase letters, digits, - or _">
+  <br><br>
+  <input id="password" name="password" type="password" placeholder=Password minlength="8">
+  <br><br>
+  {{if or (eq .Mode "invite") .Invite}}
+  <input id="invite" name="invite" placeholder="Invite code" value="{{.Invite}}"{{if eq .Mode "invite"}} required{{end}}>
+  <br><br>
+  {{end}}
+  <button>Submit</button>
+</form>
+{{end}}
+</div>
+{{end}}
+`)
+
+var accountTmpl = mu.Template("account", `
+{{define "title"}}Account{{end}}
+{{define "description"}}Your account{{end}}
+{{define "content"}}
+<div id="account" style="padding-top: 100px;">
+<h1>{{.Account.Username}}</h1>
+{{if not .Account.Created.IsZero}}<p>Joined {{.Account.Created.Format "2 January 2006"}}</p>{{end}}
+<h2>Change password</h2>
+{{if .Changed}}<p>Password changed, other devices have been logged out.</p>{{end}}
+<form action="/account" method="post">{{csrfField}}
+  <input name="old" type="password" placeholder="Current password">
+  <br><br>
+  <input name="password" type="password" placeholder="New password" minlength="{{.Min}}">
+  <br><br>
+  <input name="confirm" type="password" placeholder="Confirm new password" minlength="{{.Min}}">
+  <br><br>
+  <button>Change</button>
+</form>
+<h2>Passkeys</h2>
+{{range .Account.Credentials}}
+<form action="/account/passkey/remove" method="post">{{csrfField}}
+  {{.Name}} - added {{.Created.Format "2 January 2006"}}
+  <input type="hidden" name="id" value="{{.EncodedID}}">
+  <button>Remove</button>
+</form>
+{{end}}
+<input id="passkey-name" placeholder="Name e.g My phone">
+<button id="passkey">Add a passkey</button>
+<p id="error"></p>
+<script>
+{{.JS}}
+document.getElementById("passkey").onclick = function() {
+  post("/account/passkey/begin").then(opts => {
+    opts.challenge = b64ToBuf(opts.challenge);
+    opts.user.id = b64ToBuf(opts.user.id);
+    opts.excludeCredentials.forEach(c => { c.id = b64ToBuf(c.id); });
+    return navigator.credentials.create({publicKey: opts});
+  }).then(cred => post("/account/passkey/finish", {
+    id: bufToB64(cred.rawId),
+    name: document.getElementById("passkey-name").value,
+    response: {
+      clientDataJSON: bufToB64(cred.response.clientDataJSON),
+      attestationObject: bufToB64(cred.response.attestationObject),
+    },
+  })).then(() => { window.location.reload(); })
+    .catch(err => { document.getElementById("error").innerText = err.message; });
+};
+</script>
+{{if .Providers}}
+<h2>Linked logins</h2>
+{{$ids := .Account.Identities}}
+{{range .Providers}}
+{{$name := .Name}}{{$linked := false}}
+{{range $ids}}{{if eq .Provider $name}}{{$linked = true}}
+<form action="/account/oidc/unlink" method="post">{{csrfField}}
+  {{$name}}{{if .Email}} - {{.Email}}{{end}} - linked {{.Linked.Format "2 January 2006"}}
+  <input type="hidden" name="provider" value="{{$name}}">
+  <button>Unlink</button>
+</form>
+{{end}}{{end}}
+{{if not $linked}}<p><a href="/login/oidc/{{.Name}}?link=true">Link {{.Label}}</a></p>{{end}}
+{{end}}
+{{end}}
+<h2>Two factor</h2>
+<p><a href="/account/2fa">{{if .Account.TOTPSecret}}Manage{{else}}Turn on{{end}} two factor</a></p>
+<p><a href="/account/settings">Settings</a></p>
+<p><a href="/account/tokens">API tokens</a></p>
+<p><a href="/account/export">Export your data</a></p>
+<p><a href="/account/delete">Delete account</a></p>
+<p><a href="/logout/all">Logout all devices</a></p>
+</div>
+{{end}}
+`)
+
+var logoutAllTmpl = mu.Template("logout-all", `
+{{define "title"}}Logout{{end}}
+{{define "description"}}Logout of all devices{{end}}
+{{define "content"}}
+<div style="padding-top: 100px;">
+<h1>Logout all devices</h1>
+<p>End every session for your account, including this one.</p>
+<form action="/logout/all" method="post">{{csrfField}}
+  <button>Logout all</button>
+</form>
+</div>
+{{end}}
+`)
+
+func load() {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	// move the old cache files into buckets
+	if err := mu.Migrate("users.enc", "users", true); err != nil && !errors.Is(err, os.ErrNotExist) {
+		fmt.Println("Error migrating users:", err)
+	}
+	if err := mu.Migrate("sessions.enc", "sessions", true); err != nil && !errors.Is(err, os.ErrNotExist) {
+		fmt.Println("Error migrating sessions:", err)
+	}
 
-func init() {
 	// load users
-	mu.Load(&users, "users.enc", true)
-	mu.Load(&sessions, "sessions.enc", true)
+	keys, _ := mu.List("users")
+	for _, k := range keys {
+		acc := new(Account)
+		if err := mu.Get("users", k, acc, true); err != nil {
+			fmt.Println("Error loading user", k, err)
+			continue
+		}
+		users[k] = acc
+		for _, t := range acc.Tokens {
+			tokenOwners[t.Hash] = k
+		}
+	}
+
+	// load sessions
+	keys, _ = mu.List("sessions")
+	for _, k := range keys {
+		var sess *Session
+		if err := mu.Get("sessions", k, &sess, true); err != nil {
+			fmt.Println("Error loading session:", err)
+			continue
+		}
+		// logged out before sessions were deleted
+		if sess == nil {
+			mu.Delete("sessions", k)
+			continue
+		}
+		// created before sessions expired, start the clock now
+		if sess.Created.IsZero() {
+			sess.Created = time.Now()
+			sess.LastSeen = sess.Created
+			sess.ExpiresAt = sess.Created.Add(MaxAge)
+		}
+		sessions[k] = sess
+	}
+
+	loadInvites()
+
+	grantAdmins()
 }
 
 type Account struct {
@@ -33,182 +245,335 @@ type Account struct {
 	Username string
 	Password string
 	Created  time.Time
+	// FailedLogins in a row, reset on login
+	FailedLogins int
+	LockedUntil  time.Time
+	// TOTPSecret is set when two factor is on
+	TOTPSecret string
+	// TOTPStep is the last step a code was used for so it can't be replayed
+	TOTPStep int64
+	// RecoveryCodes are bcrypt hashes, each used once
+	RecoveryCodes []string
+	// Credentials are passkeys
+	Credentials []*Credential
+	// Role of the account, member if not set
+	Role Role
+	// LastLogin is when a session was last started
+	LastLogin time.Time
+	// Disabled accounts can't login
+	Disabled bool
+	// InvitedBy is who created the invite code used to signup
+	InvitedBy string
+	// Identities at external providers linked to the account
+	Identities []*Identity
+	// Tokens for the API, hashed
+	Tokens []*Token
+	// Preferences set on /account/settings
+	Preferences Preferences
 }
 
-type Session struct {
-	ID       string
-	Username string
+// Config is the user section of mu.yaml
+type Config struct {
+	// IdleTimeout e.g 168h, defaults to a week
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+	// MaxAge e.g 720h, defaults to 30 days
+	MaxAge time.Duration `yaml:"max_age"`
+	// RPID is the passkey domain e.g example.com, defaults to the request host
+	RPID string `yaml:"rp_id"`
+	// Origin passkeys are used from e.g https://example.com, defaults to the request
+	Origin string `yaml:"origin"`
+	// Signup is open, invite or closed, defaults to open
+	Signup string `yaml:"signup"`
+	// Providers to login with using OpenID Connect
+	Providers []ProviderConfig `yaml:"providers"`
 }
 
-func newSess(acc *Account) *Session {
-	id := mu.ID()
-	sess := &Session{
-		ID:       base64.StdEncoding.EncodeToString([]byte(id)),
-		Username: acc.Username,
-	}
-	return sess
-}
+// the user section of the config
+var config Config
 
-// Admin is the user admin
-func Admin(w http.ResponseWriter, r *http.Request) {
-	// get user cookie
-	c, err := r.Cookie("user")
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
+// Login a user
+func Login(username, password string) (*Account, *Session, error) {
+	if accountFailures.count(username) >= accountLimit {
+		return nil, nil, ErrTooManyAttempts
 	}
 
-	if len(c.Value) == 0 || len(admin) == 0 {
-		return
-	}
+	// always compare so unknown users take as long
+	hash := dummy()
 
-	// check if its the admin
-	if c.Value != admin {
-		return
+	mutex.Lock()
+	acc, ok := users[username]
+	if ok && acc.Locked() {
+		mutex.Unlock()
+		return nil, nil, ErrTooManyAttempts
 	}
+	if ok {
+		hash = []byte(acc.Password)
+	}
+	mutex.Unlock()
 
-	var div string
+	// bcrypt is slow so don't hold up every other request
+	err := bcrypt.CompareHashAndPassword(hash, []byte(password))
 
-	var userList []string
 	mutex.Lock()
-	for _, user := range users {
-		userList = append(userList, user.Username)
-	}
-	mutex.Unlock()
-	sort.Strings(userList)
+	defer mutex.Unlock()
 
-	for _, user := range userList {
-		div += fmt.Sprintf(`<div class="user">%s</div>`, user)
+	// the account was deleted or its password changed while comparing
+	if ok && (users[username] != acc || acc.Password != string(hash)) {
+		acc, ok = nil, false
 	}
 
-	// list the users
-	html := mu.Template("Admin", "User Admin", "", `<h1 style="padding-top: 100px;">Users</h1>`+div)
-	mu.Render(w, html)
-}
+	// other attempts may have locked it meanwhile
+	if accountFailures.count(username) >= accountLimit || ok && acc.Locked() {
+		return nil, nil, ErrTooManyAttempts
+	}
 
-// Login a user
-func Login(username, password string) (*Account, *Session, error) {
-	mutex.Lock()
-	defer mutex.Unlock()
+	if err != nil || !ok {
+		failed(username, acc)
+		return nil, nil, ErrInvalidLogin
+	}
 
-	acc, ok := users[username]
-	if !ok {
-		return nil, nil, errors.New("does not exist")
+	if acc.Disabled {
+		return nil, nil, ErrDisabled
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(acc.Password), []byte(password)); err != nil {
-		return nil, nil, errors.New("invalid password")
+	// the code is checked by LoginCode
+	if len(acc.TOTPSecret) > 0 {
+		return acc, nil, ErrTwoFactor
 	}
 
+	return acc, login(acc), nil
+}
+
+// login resets failures and starts a session, the caller holds the mutex
+func login(acc *Account) *Session {
+	acc.FailedLogins = 0
+	acc.LockedUntil = time.Time{}
+	acc.LastLogin = time.Now()
+	saveAccount(acc)
+	accountFailures.reset(acc.Username)
+
 	sess := newSess(acc)
 	sessions[sess.ID] = sess
 
-	mu.Save(sessions, "sessions.enc", true)
+	mu.Put("sessions", sess.ID, sess, true)
 
-	return acc, sess, nil
+	return sess
 }
 
-// Logout the user
-func Logout(username string, sess *Session) error {
+// saveAccount writes the account, the caller holds the mutex
+func saveAccount(acc *Account) {
+	if err := mu.Put("users", acc.Username, acc, true); err != nil {
+		fmt.Println("Error saving user", acc.Username, err)
+	}
+}
+
+// Unlock an account locked out by failed logins
+func Unlock(username string) error {
 	mutex.Lock()
 	defer mutex.Unlock()
 
-	// logout
-	sessions[sess.ID] = nil
+	acc, ok := users[username]
+	if !ok {
+		return errors.New("no such user")
+	}
+
+	acc.FailedLogins = 0
+	acc.LockedUntil = time.Time{}
+	accountFailures.reset(username)
 
-	// TODO: ...
-	return mu.Save(sessions, "sessions.enc", true)
+	return mu.Put("users", username, acc, true)
 }
 
-// Signup a user
+// Signup a user regardless of the signup mode e.g from the command line
 func Signup(username, password string) error {
-	if _, ok := users[username]; ok {
-		return errors.New("already exists")
+	return signup(username, password, "")
+}
+
+// SignupInvite signs up a user from the signup page, checking the signup
+// mode and the invite code if one is given or required
+func SignupInvite(username, password, code string) error {
+	switch signupMode() {
+	case ModeClosed:
+		return ErrSignupClosed
+	case ModeInvite:
+		if len(code) == 0 {
+			return ErrInviteInvalid
+		}
 	}
+	return signup(username, password, code)
+}
 
+func signup(username, password, code string) error {
+	if err := validUsername(username); err != nil {
+		return err
+	}
+	if err := validPassword(username, password); err != nil {
+		return err
+	}
+
+	// hash before taking the lock, it's slow
 	pw, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
 		return err
 	}
 
 	mutex.Lock()
-	users[username] = &Account{
-		ID:       mu.ID(),
-		Username: username,
-		Password: string(pw),
+	defer mutex.Unlock()
+
+	if _, ok := users[username]; ok {
+		return errors.New("already exists")
+	}
+
+	var inviter string
+	if len(code) > 0 {
+		if inviter, err = useInvite(code, username); err != nil {
+			return err
+		}
 	}
-	mutex.Unlock()
 
-	// save accounts
-	return mu.Save(users, "users.enc", true)
+	acc := &Account{
+		ID:        mu.ID(),
+		Username:  username,
+		Password:  string(pw),
+		Created:   time.Now(),
+		InvitedBy: inviter,
+	}
+
+	// save account
+	if err := mu.Put("users", username, acc, true); err != nil {
+		return err
+	}
+
+	users[username] = acc
+
+	return nil
 }
 
-// Verify a session
-func Verify(sessID, user string) error {
-	mutex.Lock()
-	defer mutex.Unlock()
+// ChangePassword checks the old password before setting the new one and
+// logs out every other session
+func ChangePassword(username, old, password, current string) error {
+	if err := validPassword(username, password); err != nil {
+		return err
+	}
 
-	sess, ok := sessions[sessID]
+	mutex.Lock()
+	acc, ok := users[username]
+	mutex.Unlock()
 	if !ok {
-		return errors.New("invalid session")
+		return errors.New("no such user")
 	}
-	if sess == nil {
-		return errors.New("expired session")
+
+	// accounts created with a provider don't have one to check
+	if len(acc.Password) > 0 {
+		if err := bcrypt.CompareHashAndPassword([]byte(acc.Password), []byte(old)); err != nil {
+			return errors.New("current password is wrong")
+		}
+	}
+
+	pw, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	acc.Password = string(pw)
+	if err := mu.Put("users", username, acc, true); err != nil {
+		return err
 	}
-	if user != sess.Username {
-		return errors.New("invalid user")
+
+	for id, sess := range sessions {
+		if sess.Username == username && id != current {
+			revoke(id)
+		}
 	}
 
 	return nil
 }
 
+// setCookies starts the session in the browser, replacing any previous session
+func setCookies(w http.ResponseWriter, r *http.Request, sess *Session) {
+	// rotate rather than reuse a session from before login
+	if id, ok := sessionID(r); ok && id != sess.ID {
+		mutex.Lock()
+		if _, ok := sessions[id]; ok {
+			revoke(id)
+		}
+		mutex.Unlock()
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "sess",
+		Value:    mu.Sign(sess.ID),
+		Path:     "/",
+		Expires:  sess.ExpiresAt,
+		Secure:   mu.Secure(),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	// identity only comes from the session now
+	http.SetCookie(w, &http.Cookie{
+		Name:   "user",
+		MaxAge: -1,
+	})
+}
+
+// clearCookies ends the session in the browser
+func clearCookies(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "sess",
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   mu.Secure(),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:   "user",
+		MaxAge: -1,
+	})
+}
+
 func LoginHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "POST" {
+		if !allowIP(r) {
+			http.Error(w, ErrTooManyAttempts.Error(), 429)
+			return
+		}
+
 		r.ParseForm()
 		user := r.Form.Get("username")
 		pass := r.Form.Get("password")
 
-		acc, sess, err := Login(user, pass)
-		if err != nil {
+		_, sess, err := Login(user, pass)
+		if err == ErrTwoFactor {
+			newChallenge(w, user)
+			http.Redirect(w, r, "/login/2fa", 302)
+			return
+		} else if err == ErrTooManyAttempts {
+			http.Error(w, err.Error(), 429)
+			return
+		} else if err == ErrDisabled {
+			http.Error(w, err.Error(), 403)
+			return
+		} else if err != nil {
 			http.Error(w, err.Error(), 401)
 			return
 		}
 
-		http.SetCookie(w, &http.Cookie{
-			Name:    "sess",
-			Value:   sess.ID,
-			Expires: time.Now().Add(time.Hour * 24 * 30),
-		})
-
-		http.SetCookie(w, &http.Cookie{
-			Name:    "user",
-			Value:   acc.Username,
-			Expires: time.Now().Add(time.Hour * 24 * 30),
-		})
+		setCookies(w, r, sess)
 
 		http.Redirect(w, r, "/home", 302)
 		return
 	}
 
 	// Login screen
-	html := mu.Template("Login", "Login to your account", "", `
-<style>
-  #login {
-    padding-top: 100px;
-  }
-</style>
-<div id="login">
-<h1>Login</h1>
-<form action="/login", method="post">
-  <input id="username" name="username" placeholder=Username>
-  <br><br>
-  <input id="password" name="password" type="password" placeholder=Password>
-  <br><br>
-  <button>Submit</button>
-</form>
-</div>
-`)
-	mu.Render(w, html)
+	mu.Render(w, loginTmpl, map[string]interface{}{
+		"JS":        template.JS(passkeyJS),
+		"Providers": Providers(),
+	})
 }
 
 func SignupHandler(w http.ResponseWriter, r *http.Request) {
@@ -217,88 +582,213 @@ func SignupHandler(w http.ResponseWriter, r *http.Request) {
 		user := r.Form.Get("username")
 		pass := r.Form.Get("password")
 
-		err := Signup(user, pass)
-		if err != nil {
-			http.Error(w, err.Error(), 500)
+		err := SignupInvite(user, pass, r.Form.Get("invite"))
+		if err == ErrSignupClosed {
+			http.Error(w, err.Error(), 403)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), 400)
 			return
 		}
 
-		acc, sess, err := Login(user, pass)
+		_, sess, err := Login(user, pass)
 		if err != nil {
 			http.Error(w, err.Error(), 401)
 			return
 		}
 
-		http.SetCookie(w, &http.Cookie{
-			Name:    "sess",
-			Value:   sess.ID,
-			Expires: time.Now().Add(time.Hour * 24 * 30),
-		})
-
-		http.SetCookie(w, &http.Cookie{
-			Name:    "user",
-			Value:   acc.Username,
-			Expires: time.Now().Add(time.Hour * 24 * 30),
-		})
+		setCookies(w, r, sess)
 
 		http.Redirect(w, r, "/home", 302)
 		return
 	}
 
-	// Login screen
-	html := mu.Template("Signup", "Signup for an account", "", `
-<style>
-  #signup {
-    padding-top: 100px;
-  }
-</style>
-<div id="signup">
-<h1>Signup</h1>
-<form action="/signup", method="post">
-  <input id="username" name="username" placeholder=Username>
-  <br><br>
-  <input id="password" name="password" type="password" placeholder=Password>
-  <br><br>
-  <button>Submit</button>
-</form>
-</div>
-`)
-	mu.Render(w, html)
+	// Signup screen
+	mu.Render(w, signupTmpl, map[string]interface{}{
+		"Mode":   signupMode(),
+		"Invite": r.URL.Query().Get("invite"),
+	})
 }
 
-func LogoutHandler(w http.ResponseWriter, r *http.Request) {
-	http.SetCookie(w, &http.Cookie{
-		Name:   "sess",
-		MaxAge: -1,
-	})
-	http.SetCookie(w, &http.Cookie{
-		Name:   "user",
-		MaxAge: -1,
+// AccountHandler shows the account and changes the password
+func AccountHandler(w http.ResponseWriter, r *http.Request) {
+	acc, _ := FromContext(r.Context())
+
+	if r.Method == "POST" {
+		r.ParseForm()
+		old := r.Form.Get("old")
+		pass := r.Form.Get("password")
+
+		if pass != r.Form.Get("confirm") {
+			http.Error(w, "passwords do not match", 400)
+			return
+		}
+
+		id, _ := sessionID(r)
+		if err := ChangePassword(acc.Username, old, pass, id); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		http.Redirect(w, r, "/account?changed=true", 302)
+		return
+	}
+
+	mu.Render(w, accountTmpl, map[string]interface{}{
+		"Account":   acc,
+		"Changed":   r.URL.Query().Get("changed") == "true",
+		"Min":       minPassword,
+		"JS":        template.JS(passkeyJS),
+		"Providers": Providers(),
 	})
+}
+
+func LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if id, ok := sessionID(r); ok {
+		mutex.Lock()
+		sess, ok := sessions[id]
+		mutex.Unlock()
+
+		if ok {
+			if err := Logout(sess.Username, sess); err != nil {
+				fmt.Println("Error logging out:", err)
+			}
+		}
+	}
+
+	clearCookies(w)
+	http.Redirect(w, r, "/", 302)
+}
+
+// LogoutAllHandler logs the user out on every device
+func LogoutAllHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		mu.Render(w, logoutAllTmpl, nil)
+		return
+	}
+
+	acc, _ := FromContext(r.Context())
+	if err := LogoutAll(acc.Username); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	clearCookies(w)
 	http.Redirect(w, r, "/", 302)
 }
 
-func Register() {}
+// App is the user app for accounts and auth
+type App struct{}
+
+func (a *App) Name() string        { return "User" }
+func (a *App) Description() string { return "User accounts" }
+func (a *App) Icon() string        { return "" }
+
+func (a *App) Routes() []mu.Route {
+	return []mu.Route{
+		{Path: "/account", Handler: AccountHandler, Auth: true},
+		{Path: "/account/2fa", Handler: EnrolHandler, Auth: true},
+		{Path: "/account/passkey/begin", Handler: RegisterBeginHandler, Auth: true},
+		{Path: "/account/passkey/finish", Handler: RegisterFinishHandler, Auth: true},
+		{Path: "/account/passkey/remove", Handler: RemovePasskeyHandler, Auth: true},
+		{Path: "/account/oidc/unlink", Handler: UnlinkHandler, Auth: true},
+		{Path: "/account/settings", Handler: SettingsHandler, Auth: true},
+		{Path: "/account/tokens", Handler: TokensHandler, Auth: true},
+		{Path: "/account/export", Handler: AccountExportHandler, Auth: true},
+		{Path: "/account/delete", Handler: AccountDeleteHandler, Auth: true},
+		{Path: "/admin", Handler: Require(RoleAdmin, Admin), Auth: true},
+		{Path: "/admin/users.csv", Handler: Require(RoleAdmin, ExportHandler), Auth: true},
+		{Path: "/login", Handler: LoginHandler},
+		{Path: "/login/2fa", Handler: TwoFactorHandler},
+		{Path: "/login/passkey/begin", Handler: PasskeyBeginHandler},
+		{Path: "/login/passkey/finish", Handler: PasskeyFinishHandler},
+		{Path: "/login/oidc/", Handler: OIDCHandler},
+		{Path: "/logout", Handler: LogoutHandler},
+		{Path: "/logout/all", Handler: LogoutAllHandler, Auth: true},
+		{Path: "/signup", Handler: SignupHandler},
+	}
+}
 
-// Authenticated handler
+// Check the user section of the config
+func (a *App) Check() error {
+	var c Config
+	if err := mu.Section("user", &c); err != nil {
+		return err
+	}
+	switch c.Signup {
+	case "", ModeOpen, ModeInvite, ModeClosed:
+	default:
+		return fmt.Errorf("unknown signup mode %s", c.Signup)
+	}
+	return checkProviders(c.Providers)
+}
+
+func (a *App) Start() error {
+	if err := mu.Section("user", &config); err != nil {
+		return err
+	}
+	if config.IdleTimeout > 0 {
+		IdleTimeout = config.IdleTimeout
+	}
+	if config.MaxAge > 0 {
+		MaxAge = config.MaxAge
+	}
+	for _, p := range config.Providers {
+		RegisterProvider(NewOIDC(p))
+	}
+
+	load()
+
+	done = make(chan bool)
+	wg.Add(1)
+	go reaper(done)
+
+	return nil
+}
+
+// sessions and accounts are written as they change so only the reaper needs stopping
+func (a *App) Stop() error {
+	close(done)
+	wg.Wait()
+	return nil
+}
+
+func Register() {
+	// protect routes of every app
+	mu.Auth = Auth
+
+	// identify the user then check the csrf token for their session
+	mu.Identify = func(h http.HandlerFunc) http.HandlerFunc {
+		return Identify(CSRF(h))
+	}
+
+	mu.Register(new(App))
+}
+
+// Identify adds the logged in account, if any, to the request context
+func Identify(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h(w, identify(r))
+	}
+}
+
+// unauthorized sends browsers to login and tells API clients their token is no good
+func unauthorized(w http.ResponseWriter, r *http.Request) {
+	if _, ok := bearer(r); ok {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, "invalid token", 401)
+		return
+	}
+	http.Redirect(w, r, "/login", 302)
+}
+
+// Authenticated handler, with a session cookie or an API token
 func Auth(h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// check the session cookie exists
-		c, err := r.Cookie("sess")
-		if err != nil || len(c.Value) == 0 {
-			http.Redirect(w, r, "/login", 302)
-			return
-		}
-		// check the session cookie exists
-		cu, err := r.Cookie("user")
-		if err != nil || len(cu.Value) == 0 {
-			http.Redirect(w, r, "/login", 302)
-			return
-		}
+		r = identify(r)
 
-		// TODO: check the cookie is valid
-		if err := Verify(c.Value, cu.Value); err != nil {
-			http.Redirect(w, r, "/login", 302)
+		if _, ok := FromContext(r.Context()); !ok {
+			unauthorized(w, r)
 			return
 		}
 
@@ -0,0 +1,63 @@
+package user
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"mu.dev"
+)
+
+// testInit sets up mu in a temp dir and empties the user app's state
+func testInit(t *testing.T) {
+	t.Helper()
+
+	for _, env := range []string{"MU_KEY", "MU_KEY_FILE", "MU_PASSPHRASE", "MU_STORE", "USER_ADMIN"} {
+		t.Setenv(env, "")
+	}
+
+	if err := mu.Init(mu.Config{DataDir: t.TempDir()}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mu.Storage.Close() })
+
+	mutex.Lock()
+	users = map[string]*Account{}
+	sessions = map[string]*Session{}
+	invites = map[string]*Invite{}
+	tokenOwners = map[string]string{}
+	mutex.Unlock()
+
+	oidcMutex.Lock()
+	providers = map[string]Provider{}
+	flows = map[string]*flow{}
+	oidcMutex.Unlock()
+
+	ipAttempts = &window{size: ipWindow, events: map[string][]time.Time{}}
+	accountFailures = &window{size: accountWindow, events: map[string][]time.Time{}}
+	config = Config{}
+}
+
+// testUser signs up a user and returns the account
+func testUser(t *testing.T, username, password string) *Account {
+	t.Helper()
+
+	if err := Signup(username, password); err != nil {
+		t.Fatal(err)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	return users[username]
+}
+
+// testLogin starts a session for the user and returns its cookie
+func testLogin(t *testing.T, acc *Account) *http.Cookie {
+	t.Helper()
+
+	mutex.Lock()
+	sess := login(acc)
+	mutex.Unlock()
+
+	return &http.Cookie{Name: "sess", Value: mu.Sign(sess.ID)}
+}
@@ -0,0 +1,74 @@
+package user
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// password length limits, bcrypt ignores anything past 72 bytes
+const (
+	minPassword = 8
+	maxPassword = 72
+)
+
+// lowercase letters, digits, dash and underscore, starting with a letter or digit
+var usernameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{2,31}$`)
+
+// names which could be mistaken for the site or its pages
+var reserved = map[string]bool{
+	"admin":         true,
+	"administrator": true,
+	"root":          true,
+	"system":        true,
+	"support":       true,
+	"mu":            true,
+	"account":       true,
+	"login":         true,
+	"logout":        true,
+	"signup":        true,
+	"api":           true,
+	"null":          true,
+}
+
+// passwords too common to allow
+var common = map[string]bool{
+	"password":   true,
+	"password1":  true,
+	"12345678":   true,
+	"123456789":  true,
+	"1234567890": true,
+	"qwertyuiop": true,
+	"qwerty123":  true,
+	"iloveyou":   true,
+	"letmein1":   true,
+	"11111111":   true,
+	"abc12345":   true,
+}
+
+func validUsername(username string) error {
+	if !usernameRe.MatchString(username) {
+		return errors.New("username must be 3 to 32 lowercase letters, digits, - or _")
+	}
+	if reserved[username] {
+		return errors.New("username is reserved")
+	}
+	return nil
+}
+
+func validPassword(username, password string) error {
+	switch {
+	case len(password) < minPassword:
+		return fmt.Errorf("password must be at least %d characters", minPassword)
+	case len(password) > maxPassword:
+		return fmt.Errorf("password must be at most %d bytes", maxPassword)
+	case len(username) >= 3 && strings.Contains(strings.ToLower(password), username):
+		return errors.New("password must not contain the username")
+	case common[strings.ToLower(password)]:
+		return errors.New("password is too common")
+	case len(strings.Trim(password, password[:1])) == 0:
+		return errors.New("password must not repeat one character")
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package user
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidUsername(t *testing.T) {
+	tests := []struct {
+		username string
+		ok       bool
+	}{
+		{"asim", true},
+		{"a_b-9", true},
+		{"007", true},
+		{"ab", false},
+		{strings.Repeat("a", 32), true},
+		{strings.Repeat("a", 33), false},
+		{"Asim", false},
+		{"-asim", false},
+		{"_asim", false},
+		{"as im", false},
+		{"asim!", false},
+		{"ásim", false},
+		{"admin", false},
+		{"login", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if err := validUsername(tt.username); (err == nil) != tt.ok {
+			t.Errorf("%q got %v, want ok %v", tt.username, err, tt.ok)
+		}
+	}
+}
+
+func TestValidPassword(t *testing.T) {
+	tests := []struct {
+		password string
+		ok       bool
+	}{
+		{"correct horse", true},
+		{"short", false},
+		{strings.Repeat("ab", 36), true},
+		{strings.Repeat("ab", 36) + "c", false},
+		{"my-alice-pass", false},
+		{"ALICE1234", false},
+		{"password", false},
+		{"Password1", false},
+		{"aaaaaaaaaa", false},
+		{"aaaaaaaaab", true},
+	}
+
+	for _, tt := range tests {
+		if err := validPassword("alice", tt.password); (err == nil) != tt.ok {
+			t.Errorf("%q got %v, want ok %v", tt.password, err, tt.ok)
+		}
+	}
+}
@@ -2,10 +2,13 @@ package watch
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"html"
+	"html/template"
 	"mu.dev"
+	"mu.dev/user"
 	"net/http"
-	"net/url"
 	"os"
 	"strings"
 	"sync"
@@ -15,35 +18,62 @@ import (
 	"google.golang.org/api/youtube/v3"
 )
 
-var Key = os.Getenv("YOUTUBE_API_KEY")
-var Client, _ = youtube.NewService(context.TODO(), option.WithAPIKey(Key))
+var Key string
+var Client *youtube.Service
 
 var mutex sync.Mutex
 
+// Result of a search
+type Result struct {
+	URL          string
+	Thumbnail    string
+	Title        string
+	ChannelID    string
+	ChannelTitle string
+	Description  string
+}
+
 // recent query cache keyed by the query string
-var Recent = map[string]string{}
+var Recent = map[string][]*Result{}
 
 // searches by user
 var Searches = map[string][]string{}
 
-func init() {
-	mu.Load(&Searches, "searches.enc", true)
-	mu.Load(&Recent, "recent.json", false)
-}
+func load() {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	// move the old cache file into a bucket
+	if err := mu.Migrate("searches.enc", "searches", true); err != nil && !errors.Is(err, os.ErrNotExist) {
+		fmt.Println("Error migrating searches:", err)
+	}
 
-func embedVideo(id string) string {
-	u := "https://www.youtube.com/embed/" + id
-	style := `style="position: absolute; top: 0; left: 0; right: 0; width: 100%; height: 100%; border: none;"`
-	return `<iframe width="560" height="315" ` + style + ` src="` + u + `" title="YouTube video player" frameborder="0" allow="accelerometer; autoplay; clipboard-write; encrypted-media; gyroscope; picture-in-picture" allowfullscreen></iframe>`
+	keys, _ := mu.List("searches")
+	for _, k := range keys {
+		var searches []string
+		if err := mu.Get("searches", k, &searches, true); err != nil {
+			fmt.Println("Error loading searches", k, err)
+			continue
+		}
+		Searches[k] = searches
+	}
+
+	if err := mu.Load(&Recent, "results.json", false); err != nil && !errors.Is(err, os.ErrNotExist) {
+		fmt.Println("Error loading recent searches:", err)
+	}
 }
 
-func getResults(q string) (string, error) {
+func getResults(q string) ([]*Result, error) {
+	if Client == nil {
+		return nil, errors.New("search unavailable")
+	}
+
 	resp, err := Client.Search.List([]string{"id", "snippet"}).Q(q).MaxResults(25).Do()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	var results string
+	var results []*Result
 
 	for _, item := range resp.Items {
 		var id, url, desc string
@@ -62,26 +92,30 @@ func getResults(q string) (string, error) {
 			url = "https://www.youtube.com/channel/" + id
 			desc = "[channel]"
 		}
-		channel := fmt.Sprintf(`<a href="https://youtube.com/channel/%s">%s</a>`, item.Snippet.ChannelId, item.Snippet.ChannelTitle)
-		results += fmt.Sprintf(`
-			<div class="thumbnail"><a href="%s"><img src="%s"><h3>%s</h3></a>%s | %s</div>`,
-			url, item.Snippet.Thumbnails.Medium.Url, item.Snippet.Title, channel, desc)
+		// titles come html escaped, the template escapes them again
+		results = append(results, &Result{
+			URL:          url,
+			Thumbnail:    item.Snippet.Thumbnails.Medium.Url,
+			Title:        html.UnescapeString(item.Snippet.Title),
+			ChannelID:    item.Snippet.ChannelId,
+			ChannelTitle: html.UnescapeString(item.Snippet.ChannelTitle),
+			Description:  desc,
+		})
 	}
 
 	return results, nil
 }
 
-func makeNav(uid string) string {
+func makeNav(uid string) []string {
 	// build the nav
-	var nav string
+	var nav []string
 
 	mutex.Lock()
 
 	searches := Searches[uid]
 
 	for i := len(searches); i > 0; i-- {
-		k := searches[i-1]
-		nav += fmt.Sprintf(`<a class="head" href="/watch?q=%s">%s</a>`, url.QueryEscape(k), k)
+		nav = append(nav, searches[i-1])
 	}
 
 	mutex.Unlock()
@@ -103,10 +137,14 @@ func saveSearch(uid string, q string) {
 	}
 
 	Searches[uid] = searches
-	mu.Save(Searches, "searches.enc", true)
+	mu.Put("searches", uid, searches, true)
 }
 
-var Results = `
+var Template = mu.Template("watch", `
+{{define "title"}}Watch{{end}}
+{{define "description"}}{{if .Results}}{{.Query}} | Results{{else}}Watch YouTube Videos{{end}}{{end}}
+{{define "nav"}}{{range .Nav}}<a class="head" href="/watch?q={{.}}">{{.}}</a>{{end}}{{end}}
+{{define "content"}}
 <style>
   form {
     margin-top: 100px;
@@ -121,42 +159,34 @@ var Results = `
     margin-bottom: 5px;
   }
 </style>
-<form action="/watch" method="POST">
-  <input name="q" id="q" value="%s">
+<form action="/watch" method="POST">{{csrfField}}
+  <input name="q" id="q" value="{{.Query}}" placeholder=Search>
   <button>Submit</button>
 </form>
+{{if .Results}}
 <h1>Results</h1>
 <div id="results">
-%s
-</div>`
-
-var Template = `
-<style>
-form {
-  margin-top: 100px;
-}
-.video {
-  width: 100%;
-  overflow: hidden;
-  padding-top: 56.25%;
-  position: relative;
-}
-</style>
-<form action="/watch" method="POST">
-  <input name="q" id="q" placeholder=Search>
-  <button>Submit</button>
-</form>`
+{{range .Results}}
+	<div class="thumbnail"><a href="{{.URL}}"><img src="{{.Thumbnail}}"><h3>{{.Title}}</h3></a><a href="https://youtube.com/channel/{{.ChannelID}}">{{.ChannelTitle}}</a> | {{.Description}}</div>
+{{end}}
+</div>
+{{end}}
+{{end}}
+`)
+
+var Video = template.Must(template.New("video").Parse(`<html>
+<body>
+<div class="video" style="padding-top: 100px"><iframe width="560" height="315" style="position: absolute; top: 0; left: 0; right: 0; width: 100%; height: 100%; border: none;" src="https://www.youtube.com/embed/{{.}}" title="YouTube video player" frameborder="0" allow="accelerometer; autoplay; clipboard-write; encrypted-media; gyroscope; picture-in-picture" allowfullscreen></iframe></div>
+</body>
+</html>`))
 
 func WatchHandler(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
 	q := r.Form.Get("q")
 
-	var uid string
-	c, err := r.Cookie("user")
-	if err != nil {
-		uid = "default"
-	} else if len(c.Value) > 0 {
-		uid = c.Value
+	uid := "default"
+	if acc, ok := user.FromContext(r.Context()); ok {
+		uid = acc.Username
 	}
 
 	if r.Method == "POST" {
@@ -179,52 +209,93 @@ func WatchHandler(w http.ResponseWriter, r *http.Request) {
 			// recent queries
 			mutex.Lock()
 			Recent[q] = results
-			mu.Save(Recent, "recent.json", false)
+			mu.Save(Recent, "results.json", false)
 			mutex.Unlock()
 		}
 
-		nav := makeNav(uid)
-
-		html := mu.Template("Watch", q+" | Results", nav, fmt.Sprintf(Results, q, results))
-		mu.Render(w, html)
+		mu.Render(w, Template, map[string]interface{}{
+			"Query":   q,
+			"Results": results,
+			"Nav":     makeNav(uid),
+		})
 		return
 	}
 
 	id := r.Form.Get("id")
-	nav := makeNav(uid)
 
 	// render watch page
 	if len(id) > 0 {
-		// get the page
-		html := fmt.Sprintf(`<html><body><div class="video" style="padding-top: 100px">%s</div></body></html>`, embedVideo(id))
-		mu.Render(w, html)
+		Video.Execute(w, id)
 		return
 	}
 
 	// GET
 	// check recent cache
+	mutex.Lock()
+	results := Recent[q]
+	mutex.Unlock()
 
-	if len(q) == 0 {
-		html := mu.Template("Watch", "Watch YouTube Videos", nav, Template)
-		mu.Render(w, html)
-		return
+	mu.Render(w, Template, map[string]interface{}{
+		"Query":   q,
+		"Results": results,
+		"Nav":     makeNav(uid),
+	})
+}
+
+// App is the watch app
+type App struct{}
+
+func (a *App) Name() string        { return "Watch" }
+func (a *App) Description() string { return "Search and watch YouTube videos" }
+func (a *App) Icon() string        { return "" }
+
+func (a *App) Routes() []mu.Route {
+	return []mu.Route{
+		{Path: "/watch", Handler: WatchHandler, Nav: true},
+	}
+}
+
+func (a *App) Start() error {
+	Key = mu.APIKey("youtube", "YOUTUBE_API_KEY")
+
+	// search is unavailable without a key but the app still serves
+	c, err := youtube.NewService(context.TODO(), option.WithAPIKey(Key))
+	if err != nil {
+		fmt.Println("Error creating youtube client:", err)
 	}
+	Client = c
 
+	load()
+	return nil
+}
+
+// Usage is the size of the user's saved searches
+func (a *App) Usage(username string) int64 {
+	return mu.Size("searches", username)
+}
+
+// Export returns the user's saved searches
+func (a *App) Export(username string) (interface{}, error) {
 	mutex.Lock()
-	results, ok := Recent[q]
-	mutex.Unlock()
+	defer mutex.Unlock()
 
-	var content string
+	return append([]string{}, Searches[username]...), nil
+}
+
+// Erase deletes the user's saved searches
+func (a *App) Erase(username string) error {
+	mutex.Lock()
+	defer mutex.Unlock()
 
-	if ok {
-		content = fmt.Sprintf(Results, q, results)
-	} else {
-		content = Template
+	delete(Searches, username)
+	if err := mu.Delete("searches", username); err != nil {
+		return err
 	}
+	return mu.Purge("searches", username)
+}
 
-	html := mu.Template("Watch", "Watch YouTube Videos", nav, content)
+func (a *App) Stop() error { return nil }
 
-	mu.Render(w, html)
+func Register() {
+	mu.Register(new(App))
 }
-
-func Register() {}
@@ -6,7 +6,11 @@ import (
 	"mu.dev"
 )
 
-	var timer = `
+	var timer = mu.Template("work", `
+{{define "title"}}Work{{end}}
+{{define "description"}}Do work by the hour{{end}}
+{{define "nav"}}<a href="/work" class="head">New Job</a>{{end}}
+{{define "content"}}
 <style>
   
 .main { 
@@ -141,12 +145,29 @@ window.onload = (event) => {
 	startTimer()
 }
 </script>
-`
+{{end}}
+`)
 
 func Handler(w http.ResponseWriter, r *http.Request) {
-	nav := `<a href="/work" class="head">New Job</a>`
-	html := mu.Template("Work", "Do work by the hour", nav, timer)
-	mu.Render(w, html)
+	mu.Render(w, timer, nil)
 }
 
-func Register() {}
+// App is the work app
+type App struct{}
+
+func (a *App) Name() string        { return "Work" }
+func (a *App) Description() string { return "Do work for the sake of Allah" }
+func (a *App) Icon() string        { return "" }
+
+func (a *App) Routes() []mu.Route {
+	return []mu.Route{
+		{Path: "/work", Handler: Handler, Nav: true},
+	}
+}
+
+func (a *App) Start() error { return nil }
+func (a *App) Stop() error  { return nil }
+
+func Register() {
+	mu.Register(new(App))
+}